@@ -9,4 +9,39 @@ api.interceptors.request.use((config) => {
   }
   return config
 })
+
+// Access-токен живёт 15 минут: при 401 один раз пробуем обменять refresh-токен
+// и повторяем запрос. Параллельные запросы ждут одного и того же обновления.
+let refreshing = null
+
+async function refreshTokens() {
+  const refreshToken = localStorage.getItem('refresh_token')
+  if (!refreshToken) throw new Error('no refresh token')
+  const res = await axios.post(`${api.defaults.baseURL}/api/token/refresh`, { refresh_token: refreshToken })
+  localStorage.setItem('token', res.data.token)
+  localStorage.setItem('refresh_token', res.data.refresh_token)
+  localStorage.setItem('is_admin', res.data.is_admin)
+  localStorage.setItem('permissions', JSON.stringify(res.data.permissions))
+}
+
+api.interceptors.response.use(
+  (response) => response,
+  async (error) => {
+    const config = error.config
+    if (error.response?.status !== 401 || !config || config._retried || config.url.includes('/api/token/refresh')) {
+      return Promise.reject(error)
+    }
+    config._retried = true
+    try {
+      refreshing = refreshing || refreshTokens().finally(() => { refreshing = null })
+      await refreshing
+    } catch (e) {
+      localStorage.removeItem('token')
+      localStorage.removeItem('refresh_token')
+      return Promise.reject(error)
+    }
+    return api(config)
+  }
+)
+
 export default api
@@ -0,0 +1,44 @@
+import api from './axios'
+
+// Подписка на события сервера (GET /api/events, Server-Sent Events).
+// EventSource не умеет передавать заголовки, поэтому перед каждым подключением
+// берём одноразовый тикет (POST /api/events/ticket) и передаём его в query.
+// Сервер закрывает поток по истечении access-токена — переподключаемся с новым тикетом.
+export function subscribeEvents(handlers) {
+  let source = null
+  let closed = false
+
+  function reconnect() {
+    setTimeout(connect, 3000)
+  }
+
+  async function connect() {
+    if (closed || !localStorage.getItem('token')) return
+    let ticket
+    try {
+      // Запрос через api заодно обновит истёкший access-токен.
+      const { data } = await api.post('/api/events/ticket')
+      ticket = data.ticket
+    } catch (e) {
+      reconnect()
+      return
+    }
+    if (closed) return
+
+    source = new EventSource(`${api.defaults.baseURL}/api/events?ticket=${encodeURIComponent(ticket)}`)
+    for (const [type, handler] of Object.entries(handlers)) {
+      source.addEventListener(type, (e) => handler(JSON.parse(e.data).data))
+    }
+    source.onerror = () => {
+      // Тикет одноразовый, поэтому встроенное переподключение EventSource не подходит.
+      source.close()
+      reconnect()
+    }
+  }
+
+  connect()
+  return () => {
+    closed = true
+    if (source) source.close()
+  }
+}
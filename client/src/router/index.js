@@ -6,6 +6,8 @@ import RateView from '../views/Rate.vue'
 import PersonView from '../views/Person.vue'
 import LoginView from '../views/Login.vue'
 import RegisterView from '../views/Register.vue'
+import ForgotPasswordView from '../views/ForgotPassword.vue'
+import ResetPasswordView from '../views/ResetPassword.vue'
 import ProfileView from '../views/Profile.vue'
 import ProductsView from '../views/Products.vue'
 import CartView from '../views/Cart.vue'
@@ -20,11 +22,13 @@ const routes = [
   { path: '/todo', name: 'todo', component: TodoView, meta: { requiresAuth: true } },
   { path: '/login', name: 'login', component: LoginView },
   { path: '/register', name: 'register', component: RegisterView },
+  { path: '/forgot-password', name: 'forgot-password', component: ForgotPasswordView },
+  { path: '/reset-password', name: 'reset-password', component: ResetPasswordView },
   { path: '/profile', name: 'profile', component: ProfileView, meta: { requiresAuth: true } },
   { path: '/products', name: 'products', component: ProductsView },
   { path: '/cart', component: CartView, meta: { requiresAuth: true } },
-  { path: '/admin/products', component: AdminProducts, meta: { requiresAuth: true, requiresAdmin: true } },
-  { path: '/admin/reviews', component: AdminReviews, meta: { requiresAuth: true, requiresAdmin: true } },
+  { path: '/admin/products', component: AdminProducts, meta: { requiresAuth: true, permission: 'products:write' } },
+  { path: '/admin/reviews', component: AdminReviews, meta: { requiresAuth: true, permission: 'reviews:moderate' } },
 ]
 
 const router = createRouter({
@@ -34,11 +38,11 @@ const router = createRouter({
 
 router.beforeEach((to, from, next) => {
   const token = localStorage.getItem('token')
-  const is_admin = localStorage.getItem('is_admin')
+  const permissions = JSON.parse(localStorage.getItem('permissions') || '[]')
 
   if (to.meta.requiresAuth && !token) {
     next('/login')
-  } else if (to.meta.requiresAdmin && is_admin !== 'true') {
+  } else if (to.meta.permission && !permissions.includes(to.meta.permission)) {
     next('/')
   } else {
     next()
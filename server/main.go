@@ -1,42 +1,111 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/smtp"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
 var db *sql.DB
 var jwtKey []byte
+var mailer MailSender
+
+// notificationChannels — каналы доставки уведомлений из NOTIFY_CHANNELS.
+var notificationChannels []NotificationChannel
+
+// storage хранит загруженные файлы (изображения товаров).
+var storage FileStorage
+
+// events раздаёт события реального времени подписчикам GET /api/events этого экземпляра.
+var events = newEventHub()
+
+const trashPurgeTick = time.Hour
+
+// trashRetentionDays — сколько дней удалённые группы и задачи хранятся в корзине (TRASH_RETENTION_DAYS).
+var trashRetentionDays = 30
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+	resetTokenTTL   = time.Hour
+)
+
+// Параметры защиты входа: первые loginFreeAttempts неудач без задержки, затем задержка
+// удваивается начиная с loginBackoffBase, после loginMaxFailures — блокировка на loginLockout.
+// Счётчик сбрасывается, если неудач не было дольше loginFailureWindow.
+const (
+	loginFreeAttempts  = 3
+	loginMaxFailures   = 10
+	loginBackoffBase   = time.Second
+	loginLockout       = 15 * time.Minute
+	loginFailureWindow = time.Hour
+)
+
+// dummyPasswordHash сравнивается с паролем для несуществующих пользователей,
+// чтобы время ответа не выдавало, есть ли такой логин.
+var dummyPasswordHash []byte
+
+// queryer — общее подмножество *sql.DB и *sql.Tx, чтобы хелперы работали и внутри транзакций.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
 
 // ============ Структуры данных ============
 
 type User struct {
-	ID         string `json:"id"`
-	Username   string `json:"username"`
-	Password   string `json:"-"`
-	FirstName  string `json:"first_name"`
-	LastName   string `json:"last_name"`
-	Birthdate  string `json:"birthdate"`
-	IsMale     bool   `json:"is_male"` // Указатель, чтобы корректно обрабатывать NULL
-	ProfileTag string `json:"profile_tag"`
-	IsAdmin    bool   `json:"is_admin"`
+	ID          string   `json:"id"`
+	Username    string   `json:"username"`
+	Password    string   `json:"-"`
+	FirstName   string   `json:"first_name"`
+	LastName    string   `json:"last_name"`
+	Birthdate   string   `json:"birthdate"`
+	IsMale      bool     `json:"is_male"` // Указатель, чтобы корректно обрабатывать NULL
+	ProfileTag  string   `json:"profile_tag"`
+	Email       string   `json:"email"`
+	IsAdmin     bool     `json:"is_admin"`
+	Permissions []string `json:"permissions"`
 }
 
+// Claims — содержимое access-токена. Права пользователя в токене не хранятся:
+// authMiddleware проверяет сессию и загружает права по БД на каждый запрос.
 type Claims struct {
-	UserID  string `json:"user_id"`
-	IsAdmin bool   `json:"is_admin"`
+	UserID    string `json:"user_id"`
+	SessionID string `json:"sid"`
 	jwt.RegisteredClaims
 }
 
@@ -44,32 +113,311 @@ type Group struct {
 	ID     string `json:"id"`
 	Title  string `json:"title"`
 	UserID string `json:"user_id"`
+	Role   string `json:"role"`
 }
 
+type GroupMember struct {
+	UserID     string `json:"user_id"`
+	Username   string `json:"username"`
+	ProfileTag string `json:"profile_tag"`
+	Role       string `json:"role"`
+	Status     string `json:"status"`
+	InvitedAt  string `json:"invited_at"`
+}
+
+type GroupInvitation struct {
+	GroupID   string `json:"group_id"`
+	Title     string `json:"title"`
+	Role      string `json:"role"`
+	InvitedBy string `json:"invited_by"`
+	InvitedAt string `json:"invited_at"`
+}
+
+type InviteMemberRequest struct {
+	User string `json:"user"`
+	Role string `json:"role"`
+}
+
+type UpdateMemberRequest struct {
+	Role string `json:"role"`
+}
+
+// Task — задача в группе. due_at и completed_at хранятся в UTC.
 type Task struct {
-	ID      string `json:"id"`
-	Title   string `json:"title"`
-	Done    bool   `json:"done"`
-	GroupID string `json:"group_id"`
+	ID          string     `json:"id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Done        bool       `json:"done"`
+	GroupID     string     `json:"group_id"`
+	DueAt       *time.Time `json:"due_at"`
+	Priority    string     `json:"priority"`
+	Position    int        `json:"position"`
+	CompletedAt *time.Time `json:"completed_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ItemsTotal  int        `json:"items_total"`
+	ItemsDone   int        `json:"items_done"`
+	Progress    int        `json:"progress"`
+	Recurrence  *string    `json:"recurrence"`
+	SeriesID    *string    `json:"series_id"`
+	Occurrence  int        `json:"occurrence"`
+	Labels      []Label    `json:"labels"`
+}
+
+// TrashItem — удалённая группа или задача в корзине; PurgeAt — когда она будет удалена навсегда.
+type TrashItem struct {
+	Type      string    `json:"type"`
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	GroupID   *string   `json:"group_id,omitempty"`
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+// TaskSearchResult — страница результатов поиска задач по всем доступным группам.
+type TaskSearchResult struct {
+	Items []Task `json:"items"`
+	Total int    `json:"total"`
+	Page  int    `json:"page"`
+	Limit int    `json:"limit"`
+}
+
+// TaskItem — пункт чек-листа внутри задачи.
+type TaskItem struct {
+	ID       string `json:"id"`
+	TaskID   string `json:"task_id"`
+	Title    string `json:"title"`
+	Done     bool   `json:"done"`
+	Position int    `json:"position"`
 }
 
+type TaskItemRequest struct {
+	Title    *string `json:"title"`
+	Done     *bool   `json:"done"`
+	Position *int    `json:"position"`
+}
+
+// Label — пользовательская метка; метками владельца можно помечать задачи любых доступных ему групп.
+type Label struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+type LabelRequest struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+// CartItem — строка корзины. Price — цена за единицу: базовая цена товара плюс надбавки
+// выбранного варианта и модификаторов.
 type CartItem struct {
-	ID        string `json:"id"`
-	UserID    string `json:"user_id"`
-	ProductID string `json:"product_id"`
-	Quantity  int    `json:"quantity"`
-	Name      string `json:"name"`
-	Image     string `json:"image"`
-	Price     int    `json:"price"`
+	ID                string   `json:"id"`
+	UserID            string   `json:"user_id"`
+	ProductID         string   `json:"product_id"`
+	VariantID         *string  `json:"variant_id"`
+	ModifierIDs       []string `json:"modifier_ids"`
+	Quantity          int      `json:"quantity"`
+	Name              string   `json:"name"`
+	VariantName       string   `json:"variant_name,omitempty"`
+	Modifiers         []string `json:"modifiers"`
+	Image             string   `json:"image"`
+	Price             int      `json:"price"`
+	Stock             *int     `json:"stock"`
+	Subtotal          int      `json:"subtotal"`
+	Available         bool     `json:"available"`
+	UnavailableReason string   `json:"unavailable_reason,omitempty"`
+}
+
+// Cart — корзина с посчитанными на сервере суммами.
+// price, subtotal, discount и total в рублях (как products.price), total_kopecks — итог в копейках.
+// Недоступные позиции в суммы не входят.
+type Cart struct {
+	Items          []CartItem `json:"items"`
+	ItemCount      int        `json:"item_count"`
+	Subtotal       int        `json:"subtotal"`
+	Discount       int        `json:"discount"`
+	Total          int        `json:"total"`
+	TotalKopecks   int64      `json:"total_kopecks"`
+	HasUnavailable bool       `json:"has_unavailable"`
+	Promo          *CartPromo `json:"promo"`
+}
+
+type CartPromo struct {
+	ID       string `json:"-"`
+	Code     string `json:"code"`
+	Kind     string `json:"kind"`
+	Applied  bool   `json:"applied"`
+	Reason   string `json:"reason,omitempty"`
+	Discount int    `json:"discount"`
+}
+
+type PromoCode struct {
+	ID             string     `json:"id"`
+	Code           string     `json:"code"`
+	Kind           string     `json:"kind"`
+	Value          int        `json:"value"`
+	ProductID      *string    `json:"product_id"`
+	BuyQuantity    int        `json:"buy_quantity"`
+	MinOrderTotal  int        `json:"min_order_total"`
+	StartsAt       *time.Time `json:"starts_at"`
+	EndsAt         *time.Time `json:"ends_at"`
+	MaxUses        *int       `json:"max_uses"`
+	MaxUsesPerUser *int       `json:"max_uses_per_user"`
+	IsActive       bool       `json:"is_active"`
+	UsedCount      int        `json:"used_count"`
 }
 
 type Product struct {
-	ID          string `json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Price       int    `json:"price"`
-	ImageURL    string `json:"image_url"`
-	IsActive    bool   `json:"is_active"`
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Price       int      `json:"price"`
+	ImageURL    string   `json:"image_url"`
+	IsActive    bool     `json:"is_active"`
+	CategoryIDs []string `json:"category_ids"`
+	AvgRating   float64  `json:"avg_rating"`
+	ReviewCount int      `json:"review_count"`
+	ThumbURL    string   `json:"thumbnail_url"`
+	Stock       *int     `json:"stock"`
+	InStock     bool     `json:"in_stock"`
+}
+
+// ProductDetail — карточка товара: гистограмма оценок (ключи 1–5), последние одобренные отзывы
+// и доступные для выбора варианты и модификаторы.
+type ProductDetail struct {
+	Product
+	RatingHistogram map[int]int `json:"rating_histogram"`
+	LatestReviews   []Review    `json:"latest_reviews"`
+	ProductOptions
+}
+
+// ProductList — страница каталога; NextCursor равен null на последней странице.
+type ProductList struct {
+	Items      []Product `json:"items"`
+	Total      int       `json:"total"`
+	Limit      int       `json:"limit"`
+	NextCursor *string   `json:"next_cursor"`
+}
+
+// Category — раздел каталога; Children заполняется только в дереве GET /api/categories.
+type Category struct {
+	ID           string      `json:"id"`
+	ParentID     *string     `json:"parent_id"`
+	Name         string      `json:"name"`
+	Slug         string      `json:"slug"`
+	SortOrder    int         `json:"sort_order"`
+	IsActive     bool        `json:"is_active"`
+	ProductCount int         `json:"product_count"`
+	Children     []*Category `json:"children,omitempty"`
+}
+
+type CategoryRequest struct {
+	ParentID  *string `json:"parent_id"`
+	Name      string  `json:"name"`
+	Slug      string  `json:"slug"`
+	SortOrder int     `json:"sort_order"`
+	IsActive  *bool   `json:"is_active"`
+}
+
+// ProductVariant — размер товара (S/M/L); price_delta прибавляется к базовой цене, может быть отрицательной.
+// Stock равен null, если остаток варианта не ведётся и списывается с остатка товара.
+type ProductVariant struct {
+	ID         string `json:"id"`
+	ProductID  string `json:"product_id"`
+	Name       string `json:"name"`
+	PriceDelta int    `json:"price_delta"`
+	SortOrder  int    `json:"sort_order"`
+	IsDefault  bool   `json:"is_default"`
+	IsActive   bool   `json:"is_active"`
+	Stock      *int   `json:"stock"`
+}
+
+// ModifierGroup — группа добавок товара. Группа обязательна, если min_select > 0.
+type ModifierGroup struct {
+	ID        string     `json:"id"`
+	ProductID string     `json:"product_id"`
+	Name      string     `json:"name"`
+	MinSelect int        `json:"min_select"`
+	MaxSelect int        `json:"max_select"`
+	SortOrder int        `json:"sort_order"`
+	Modifiers []Modifier `json:"modifiers"`
+}
+
+type Modifier struct {
+	ID         string `json:"id"`
+	GroupID    string `json:"group_id"`
+	Name       string `json:"name"`
+	PriceDelta int    `json:"price_delta"`
+	SortOrder  int    `json:"sort_order"`
+	IsActive   bool   `json:"is_active"`
+}
+
+// ProductOptions — варианты и группы модификаторов товара.
+type ProductOptions struct {
+	Variants       []ProductVariant `json:"variants"`
+	ModifierGroups []ModifierGroup  `json:"modifier_groups"`
+}
+
+type VariantRequest struct {
+	Name       string `json:"name"`
+	PriceDelta int    `json:"price_delta"`
+	SortOrder  int    `json:"sort_order"`
+	IsDefault  bool   `json:"is_default"`
+	IsActive   *bool  `json:"is_active"`
+}
+
+type ModifierGroupRequest struct {
+	Name      string `json:"name"`
+	MinSelect int    `json:"min_select"`
+	MaxSelect int    `json:"max_select"`
+	SortOrder int    `json:"sort_order"`
+}
+
+type ModifierRequest struct {
+	Name       string `json:"name"`
+	PriceDelta int    `json:"price_delta"`
+	SortOrder  int    `json:"sort_order"`
+	IsActive   *bool  `json:"is_active"`
+}
+
+// StockMovement — запись журнала движения остатков. Balance — остаток после движения.
+type StockMovement struct {
+	ID        string    `json:"id"`
+	ProductID string    `json:"product_id"`
+	VariantID *string   `json:"variant_id"`
+	Delta     int       `json:"delta"`
+	Balance   int       `json:"balance"`
+	Reason    string    `json:"reason"`
+	Note      string    `json:"note,omitempty"`
+	OrderID   *string   `json:"order_id"`
+	UserID    *string   `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type StockMovementList struct {
+	Items []StockMovement `json:"items"`
+	Total int             `json:"total"`
+	Page  int             `json:"page"`
+	Limit int             `json:"limit"`
+}
+
+// StockAdjustRequest — корректировка остатка: quantity задаёт остаток (и включает учёт),
+// delta изменяет уже учитываемый остаток. Передаётся ровно одно из двух.
+type StockAdjustRequest struct {
+	VariantID string `json:"variant_id"`
+	Delta     *int   `json:"delta"`
+	Quantity  *int   `json:"quantity"`
+	Note      string `json:"note"`
+}
+
+// LowStockItem — товар или вариант, остаток которого опустился до порога товара.
+type LowStockItem struct {
+	ProductID   string  `json:"product_id"`
+	ProductName string  `json:"product_name"`
+	VariantID   *string `json:"variant_id"`
+	VariantName string  `json:"variant_name,omitempty"`
+	Stock       int     `json:"stock"`
+	Threshold   int     `json:"threshold"`
 }
 
 type Review struct {
@@ -94,6 +442,24 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type ForgotPasswordRequest struct {
+	Username string `json:"username"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
 type CreateGroupRequest struct {
 	Title string `json:"title"`
 }
@@ -103,16 +469,55 @@ type UpdateGroupRequest struct {
 }
 
 type CreateTaskRequest struct {
-	Title string `json:"title"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	DueAt       *time.Time `json:"due_at"`
+	Priority    string     `json:"priority"`
+	Recurrence  string     `json:"recurrence"`
 }
 
+// UpdateTaskRequest — частичное обновление задачи; пустая строка в due_at снимает срок,
+// в recurrence — останавливает повторение всей серии.
 type UpdateTaskRequest struct {
-	Title *string `json:"title"`
-	Done  *bool   `json:"done"`
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+	Done        *bool   `json:"done"`
+	DueAt       *string `json:"due_at"`
+	Priority    *string `json:"priority"`
+	Recurrence  *string `json:"recurrence"`
+}
+
+type ReorderTasksRequest struct {
+	TaskIDs []string `json:"task_ids"`
 }
 
 type AddToCartRequest struct {
-	ProductID string `json:"product_id"`
+	ProductID   string   `json:"product_id"`
+	Quantity    int      `json:"quantity"`
+	VariantID   string   `json:"variant_id"`
+	ModifierIDs []string `json:"modifier_ids"`
+}
+
+type ApplyPromoRequest struct {
+	Code string `json:"code"`
+}
+
+type PromoRequest struct {
+	Code           string     `json:"code"`
+	Kind           string     `json:"kind"`
+	Value          int        `json:"value"`
+	ProductID      string     `json:"product_id"`
+	BuyQuantity    int        `json:"buy_quantity"`
+	MinOrderTotal  int        `json:"min_order_total"`
+	StartsAt       *time.Time `json:"starts_at"`
+	EndsAt         *time.Time `json:"ends_at"`
+	MaxUses        *int       `json:"max_uses"`
+	MaxUsesPerUser *int       `json:"max_uses_per_user"`
+	IsActive       bool       `json:"is_active"`
+}
+
+type UpdateCartItemRequest struct {
+	Quantity *int `json:"quantity"`
 }
 
 type CreateReviewRequest struct {
@@ -126,14 +531,129 @@ type UpdateProfileRequest struct {
 	LastName  string `json:"last_name"`
 	Birthdate string `json:"birthdate"`
 	Gender    string `json:"gender"`
+	Email     string `json:"email"`
 }
 
+// ProductRequest — данные товара; category_ids заменяет список категорий, а если не передан — не меняет его.
+// low_stock_threshold без значения тоже не меняется. Остаток меняется только через POST /admin/products/:id/stock.
 type ProductRequest struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Price       int    `json:"price"`
-	ImageURL    string `json:"image_url"`
-	IsActive    bool   `json:"is_active"`
+	Name              string   `json:"name"`
+	Description       string   `json:"description"`
+	Price             int      `json:"price"`
+	ImageURL          string   `json:"image_url"`
+	IsActive          bool     `json:"is_active"`
+	CategoryIDs       []string `json:"category_ids"`
+	LowStockThreshold *int     `json:"low_stock_threshold"`
+}
+
+type Order struct {
+	ID        string              `json:"id"`
+	UserID    string              `json:"user_id"`
+	Status    string              `json:"status"`
+	Subtotal  int                 `json:"subtotal"`
+	Discount  int                 `json:"discount"`
+	PromoCode *string             `json:"promo_code"`
+	Total     int                 `json:"total"`
+	CreatedAt string              `json:"created_at"`
+	Items     []OrderItem         `json:"items,omitempty"`
+	History   []OrderStatusChange `json:"history,omitempty"`
+}
+
+type OrderItem struct {
+	ID        string  `json:"id"`
+	ProductID *string `json:"product_id"`
+	VariantID *string `json:"variant_id"`
+	Name      string  `json:"name"`
+	Price     int     `json:"price"`
+	Quantity  int     `json:"quantity"`
+}
+
+type OrderStatusChange struct {
+	FromStatus *string `json:"from_status"`
+	ToStatus   string  `json:"to_status"`
+	ChangedBy  *string `json:"changed_by"`
+	ChangedAt  string  `json:"changed_at"`
+}
+
+type OrderTransitionRequest struct {
+	Status string `json:"status"`
+}
+
+// Notification — уведомление во входящих пользователя (канал inapp).
+type Notification struct {
+	ID        string     `json:"id"`
+	Kind      string     `json:"kind"`
+	Title     string     `json:"title"`
+	Body      string     `json:"body"`
+	Link      string     `json:"link,omitempty"`
+	ReadAt    *time.Time `json:"read_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type NotificationList struct {
+	Items  []Notification `json:"items"`
+	Total  int            `json:"total"`
+	Unread int            `json:"unread"`
+	Page   int            `json:"page"`
+	Limit  int            `json:"limit"`
+}
+
+type Role struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	IsSystem    bool     `json:"is_system"`
+	Permissions []string `json:"permissions"`
+	UserCount   int      `json:"user_count"`
+}
+
+type RoleRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+type UserRolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+// AdminUser — пользователь в админке; ActiveSessions заполняется только в карточке пользователя.
+type AdminUser struct {
+	ID             string   `json:"id"`
+	Username       string   `json:"username"`
+	ProfileTag     string   `json:"profile_tag"`
+	FirstName      string   `json:"first_name"`
+	LastName       string   `json:"last_name"`
+	Email          string   `json:"email"`
+	Roles          []string `json:"roles"`
+	IsAdmin        bool     `json:"is_admin"`
+	IsBlocked      bool     `json:"is_blocked"`
+	BlockedAt      *string  `json:"blocked_at"`
+	DeletedAt      *string  `json:"deleted_at"`
+	CreatedAt      string   `json:"created_at"`
+	ActiveSessions *int     `json:"active_sessions,omitempty"`
+}
+
+type AdminUserList struct {
+	Items []AdminUser `json:"items"`
+	Total int         `json:"total"`
+	Page  int         `json:"page"`
+	Limit int         `json:"limit"`
+}
+
+type UpdateUserStatusRequest struct {
+	IsAdmin   *bool `json:"is_admin"`
+	IsBlocked *bool `json:"is_blocked"`
+}
+
+type LoginThrottle struct {
+	ID            string  `json:"id"`
+	Kind          string  `json:"kind"`
+	Key           string  `json:"key"`
+	Failures      int     `json:"failures"`
+	LastFailureAt string  `json:"last_failure_at"`
+	LockedUntil   *string `json:"locked_until"`
+	Locked        bool    `json:"locked"`
 }
 
 type ErrorResponse struct {
@@ -152,6 +672,83 @@ func init() {
 		log.Fatal("JWT_SECRET environment variable is not set")
 	}
 	jwtKey = []byte(jwtSecret)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(fmt.Sprintf("dummy-%d", time.Now().UnixNano())), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatalf("Failed to init password hash: %v", err)
+	}
+	dummyPasswordHash = hash
+
+	switch os.Getenv("MAIL_SENDER") {
+	case "", "log":
+		mailer = logMailSender{}
+	case "file":
+		path := os.Getenv("MAIL_FILE")
+		if path == "" {
+			path = "mail.log"
+		}
+		mailer = fileMailSender{Path: path}
+	case "smtp":
+		addr := os.Getenv("SMTP_ADDR")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			log.Fatalf("SMTP_ADDR must be host:port, got %q", addr)
+		}
+		from := os.Getenv("MAIL_FROM")
+		if from == "" {
+			log.Fatal("MAIL_FROM environment variable is not set")
+		}
+		m := smtpMailSender{Addr: addr, From: from}
+		if user := os.Getenv("SMTP_USER"); user != "" {
+			m.Auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		mailer = m
+	default:
+		log.Fatalf("unknown MAIL_SENDER %q, use log, file or smtp", os.Getenv("MAIL_SENDER"))
+	}
+
+	channels := os.Getenv("NOTIFY_CHANNELS")
+	if channels == "" {
+		channels = notifyChannelInApp
+	}
+	for _, name := range strings.Split(channels, ",") {
+		switch strings.TrimSpace(name) {
+		case notifyChannelInApp:
+			notificationChannels = append(notificationChannels, inAppChannel{})
+		case notifyChannelEmail:
+			notificationChannels = append(notificationChannels, emailChannel{})
+		case notifyChannelWebhook:
+			url := os.Getenv("NOTIFY_WEBHOOK_URL")
+			if url == "" {
+				log.Fatal("NOTIFY_WEBHOOK_URL environment variable is not set")
+			}
+			notificationChannels = append(notificationChannels, webhookChannel{
+				URL:    url,
+				Secret: os.Getenv("NOTIFY_WEBHOOK_SECRET"),
+				Client: &http.Client{Timeout: 10 * time.Second},
+			})
+		default:
+			log.Fatalf("unknown notification channel %q, use inapp, email or webhook", name)
+		}
+	}
+
+	uploadDir := os.Getenv("UPLOAD_DIR")
+	if uploadDir == "" {
+		uploadDir = "uploads"
+	}
+	uploadURL := os.Getenv("UPLOAD_URL")
+	if uploadURL == "" {
+		uploadURL = "/uploads"
+	}
+	storage = localFileStorage{Dir: uploadDir, BaseURL: strings.TrimRight(uploadURL, "/")}
+
+	if v := os.Getenv("TRASH_RETENTION_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 {
+			log.Fatalf("TRASH_RETENTION_DAYS must be a positive integer, got %q", v)
+		}
+		trashRetentionDays = days
+	}
 }
 
 func main() {
@@ -177,6 +774,27 @@ func main() {
 
 	defer db.Close()
 
+	go runRecurrenceScheduler()
+	go runTrashPurge()
+	go runNotificationDispatcher()
+	go runTaskReminders()
+	go listenEvents(dsn)
+
+	e := newServer()
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	log.Printf("Server starting on port %s", port)
+	if err := e.Start(":" + port); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Server error: %v", err)
+	}
+}
+
+// newServer собирает echo с middleware и всеми маршрутами API.
+func newServer() *echo.Echo {
 	e := echo.New()
 
 	e.Use(middleware.Logger())
@@ -186,54 +804,155 @@ func main() {
 
 	e.POST("/api/register", register)
 	e.POST("/api/login", login)
+	e.POST("/api/token/refresh", refreshToken)
+	e.POST("/api/password/forgot", forgotPassword)
+	e.POST("/api/password/reset", resetPassword)
 	e.GET("/health", healthCheck)
+
+	// Имена загруженных файлов уникальны и не переиспользуются, поэтому их можно кэшировать навсегда.
+	if local, ok := storage.(localFileStorage); ok {
+		uploads := e.Group("/uploads", func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				c.Response().Header().Set(echo.HeaderCacheControl, "public, max-age=31536000, immutable")
+				c.Response().Header().Set("X-Content-Type-Options", "nosniff")
+				return next(c)
+			}
+		})
+		uploads.Static("/", local.Dir)
+	}
 	e.GET("/api/products", getProducts)
+	e.GET("/api/products/:id", getProduct)
+	e.GET("/api/categories", getCategories)
 	e.GET("/api/reviews", getReviews)
 
+	// EventSource в браузере не умеет передавать заголовки, поэтому поток открывается
+	// по одноразовому тикету в query, а не по access-токену (URL попадает в журнал запросов).
+	e.GET("/api/events", streamEvents, eventTicketAuth)
+
 	r := e.Group("/api")
 	r.Use(authMiddleware)
 
+	r.POST("/events/ticket", createEventTicket)
+	r.POST("/logout", logout)
+	r.POST("/logout-all", logoutAll)
+
 	r.POST("/reviews", createReview)
 	r.GET("/profile", getProfile)
 	r.PUT("/profile", updateProfile)
+	r.PUT("/profile/password", changePassword)
 
 	r.GET("/groups", getGroups)
 	r.POST("/groups", createGroup)
 	r.PUT("/groups/:id", updateGroup)
 	r.DELETE("/groups/:id", deleteGroup)
 
+	r.GET("/groups/:id/members", getGroupMembers)
+	r.POST("/groups/:id/members", inviteGroupMember)
+	r.PUT("/groups/:id/members/:userId", updateGroupMember)
+	r.DELETE("/groups/:id/members/:userId", removeGroupMember)
+
+	r.GET("/invitations", getInvitations)
+	r.POST("/invitations/:groupId/accept", acceptInvitation)
+	r.POST("/invitations/:groupId/decline", declineInvitation)
+
 	r.GET("/groups/:id/tasks", getTasksByGroup)
 	r.POST("/groups/:id/tasks", createTask)
+	r.POST("/groups/:id/tasks/reorder", reorderTasks)
 	r.PUT("/tasks/:id", updateTask)
 	r.DELETE("/tasks/:id", deleteTask)
 
+	r.GET("/tasks/:id/items", getTaskItems)
+	r.POST("/tasks/:id/items", createTaskItem)
+	r.PUT("/tasks/:id/items/:itemId", updateTaskItem)
+	r.DELETE("/tasks/:id/items/:itemId", deleteTaskItem)
+	r.POST("/tasks/:id/labels/:labelId", addTaskLabel)
+	r.DELETE("/tasks/:id/labels/:labelId", removeTaskLabel)
+	r.GET("/tasks/search", searchTasks)
+	r.GET("/notifications", getNotifications)
+	r.GET("/notifications/unread-count", getUnreadNotificationCount)
+	r.POST("/notifications/read-all", markAllNotificationsRead)
+	r.POST("/notifications/:id/read", markNotificationRead)
+	r.GET("/trash", getTrash)
+	r.POST("/trash/:type/:id/restore", restoreFromTrash)
+	r.GET("/labels", getLabels)
+	r.POST("/labels", createLabel)
+	r.PUT("/labels/:id", updateLabel)
+	r.DELETE("/labels/:id", deleteLabel)
+
 	r.GET("/cart", getCart)
 	r.POST("/cart", addToCart)
 	r.DELETE("/cart", clearCart)
+	r.POST("/cart/promo", applyCartPromo)
+	r.DELETE("/cart/promo", removeCartPromo)
+	r.PATCH("/cart/:itemId", updateCartItem)
+	r.DELETE("/cart/:itemId", deleteCartItem)
+
+	r.GET("/orders", getOrders)
+	r.POST("/orders", createOrder)
+	r.GET("/orders/:id", getOrder)
 
 	admin := e.Group("/api/admin")
 	admin.Use(authMiddleware)
-	admin.Use(adminMiddleware)
 
-	admin.GET("/products", getAdminProducts)
-	admin.POST("/products", createProduct)
-	admin.PUT("/products/:id", updateProduct)
-	admin.DELETE("/products/:id", deleteProduct)
-
-	admin.GET("/reviews", getAdminReviews)
-	admin.POST("/reviews/:id/approve", approveReview)
-	admin.POST("/reviews/:id/reject", rejectReview)
-	admin.DELETE("/reviews/:id", deleteReview)
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-
-	log.Printf("Server starting on port %s", port)
-	if err := e.Start(":" + port); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("Server error: %v", err)
-	}
+	products := requirePermission(permProductsWrite)
+	admin.GET("/products", getAdminProducts, products)
+	admin.POST("/products", createProduct, products)
+	admin.PUT("/products/:id", updateProduct, products)
+	admin.DELETE("/products/:id", deleteProduct, products)
+	admin.POST("/products/:id/image", uploadProductImage, products)
+	admin.POST("/products/:id/stock", adjustStock, products)
+	admin.GET("/products/:id/stock-movements", getStockMovements, products)
+	admin.GET("/inventory/low-stock", getLowStock, products)
+	admin.GET("/products/:id/options", getAdminProductOptions, products)
+	admin.POST("/products/:id/variants", createVariant, products)
+	admin.PUT("/variants/:id", updateVariant, products)
+	admin.DELETE("/variants/:id", deleteVariant, products)
+	admin.POST("/products/:id/modifier-groups", createModifierGroup, products)
+	admin.PUT("/modifier-groups/:id", updateModifierGroup, products)
+	admin.DELETE("/modifier-groups/:id", deleteModifierGroup, products)
+	admin.POST("/modifier-groups/:id/modifiers", createModifier, products)
+	admin.PUT("/modifiers/:id", updateModifier, products)
+	admin.DELETE("/modifiers/:id", deleteModifier, products)
+	admin.GET("/categories", getAdminCategories, products)
+	admin.POST("/categories", createCategory, products)
+	admin.PUT("/categories/:id", updateCategory, products)
+	admin.DELETE("/categories/:id", deleteCategory, products)
+
+	reviews := requirePermission(permReviewsModerate)
+	admin.GET("/reviews", getAdminReviews, reviews)
+	admin.POST("/reviews/:id/approve", approveReview, reviews)
+	admin.POST("/reviews/:id/reject", rejectReview, reviews)
+	admin.DELETE("/reviews/:id", deleteReview, reviews)
+
+	promos := requirePermission(permPromosManage)
+	admin.GET("/promos", getAdminPromos, promos)
+	admin.POST("/promos", createPromo, promos)
+	admin.PUT("/promos/:id", updatePromo, promos)
+	admin.DELETE("/promos/:id", deletePromo, promos)
+
+	users := requirePermission(permUsersManage)
+	admin.GET("/lockouts", getLockouts, users)
+	admin.DELETE("/lockouts/:id", clearLockout, users)
+
+	admin.GET("/permissions", getPermissions, users)
+	admin.GET("/roles", getRoles, users)
+	admin.POST("/roles", createRole, users)
+	admin.PUT("/roles/:id", updateRole, users)
+	admin.DELETE("/roles/:id", deleteRole, users)
+	admin.GET("/users", getAdminUsers, users)
+	admin.GET("/users/:id", getAdminUser, users)
+	admin.PATCH("/users/:id", updateUserStatus, users)
+	admin.DELETE("/users/:id", deleteUser, users)
+	admin.POST("/users/:id/logout", logoutUser, users)
+	admin.GET("/users/:id/roles", getUserRoles, users)
+	admin.PUT("/users/:id/roles", setUserRoles, users)
+
+	orders := requirePermission(permOrdersManage)
+	admin.GET("/orders", getAdminOrders, orders)
+	admin.GET("/orders/:id", getAdminOrder, orders)
+	admin.POST("/orders/:id/transition", transitionOrder, orders)
+
+	return e
 }
 
 // ============ Middleware ============
@@ -262,23 +981,58 @@ func authMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 			return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "invalid or expired token"})
 		}
 
-		if claims.UserID == "" {
+		if claims.UserID == "" || claims.SessionID == "" {
 			return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "invalid token claims"})
 		}
 
+		permissions, err := sessionPermissions(claims.UserID, claims.SessionID)
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "session has been revoked"})
+		}
+		if err != nil {
+			log.Printf("Auth error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+
 		c.Set("user_id", claims.UserID)
-		c.Set("is_admin", claims.IsAdmin)
+		c.Set("session_id", claims.SessionID)
+		c.Set("permissions", permissions)
 		return next(c)
 	}
 }
 
-func adminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		isAdmin, ok := c.Get("is_admin").(bool)
-		if !ok || !isAdmin {
-			return c.JSON(http.StatusForbidden, ErrorResponse{Error: "admin access required"})
+// sessionPermissions возвращает права пользователя, если его сессия ещё действует, иначе sql.ErrNoRows.
+// Сессия могла быть отозвана (logout, смена пароля), а права — измениться после выдачи токена.
+func sessionPermissions(userID, sessionID string) ([]string, error) {
+	var permissions []string
+	err := db.QueryRow(`
+		SELECT COALESCE(array_agg(DISTINCT rp.permission) FILTER (WHERE rp.permission IS NOT NULL), '{}')
+		FROM users u
+		LEFT JOIN user_roles ur ON ur.user_id = u.id
+		LEFT JOIN role_permissions rp ON rp.role_id = ur.role_id
+		WHERE u.id = $1 AND u.blocked_at IS NULL AND u.deleted_at IS NULL AND EXISTS (
+			SELECT 1 FROM sessions s
+			WHERE s.family_id = $2 AND s.user_id = u.id
+				AND s.revoked_at IS NULL AND s.used_at IS NULL AND s.expires_at > NOW()
+		)
+		GROUP BY u.id`,
+		userID, sessionID).Scan(pq.Array(&permissions))
+	return permissions, err
+}
+
+// requirePermission пропускает запрос, только если у пользователя есть все перечисленные права.
+// Ставится после authMiddleware.
+func requirePermission(perms ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			granted, _ := c.Get("permissions").([]string)
+			for _, p := range perms {
+				if !hasPermission(granted, p) {
+					return c.JSON(http.StatusForbidden, ErrorResponse{Error: "permission required: " + p})
+				}
+			}
+			return next(c)
 		}
-		return next(c)
 	}
 }
 
@@ -306,8 +1060,8 @@ func register(c echo.Context) error {
 	var userID string
 
 	err = db.QueryRow(
-		`INSERT INTO users (username, password, profile_tag, is_admin) VALUES ($1, $2, $3, $4) RETURNING id`,
-		req.Username, string(hash), profileTag, false).Scan(&userID)
+		`INSERT INTO users (username, password, profile_tag) VALUES ($1, $2, $3) RETURNING id`,
+		req.Username, string(hash), profileTag).Scan(&userID)
 
 	if err != nil {
 		if strings.Contains(err.Error(), "duplicate key") {
@@ -330,43 +1084,80 @@ func login(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
 	}
 
+	usernameKey := strings.ToLower(req.Username)
+	ip := c.RealIP()
+
+	retryAfter, err := loginRetryAfter(usernameKey, ip)
+	if err != nil {
+		log.Printf("Login throttle error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if retryAfter > 0 {
+		c.Response().Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+		return c.JSON(http.StatusTooManyRequests, ErrorResponse{Error: "too many failed login attempts, try again later"})
+	}
+
 	var user User
-	err := db.QueryRow(
-		`SELECT id, password, is_admin FROM users WHERE username=$1`,
-		req.Username).Scan(&user.ID, &user.Password, &user.IsAdmin)
+	var blocked bool
+	err = db.QueryRow(
+		`SELECT id, password, blocked_at IS NOT NULL FROM users WHERE username=$1 AND deleted_at IS NULL`,
+		req.Username).Scan(&user.ID, &user.Password, &blocked)
 
-	if err == sql.ErrNoRows {
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Login error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	hash := dummyPasswordHash
+	if err == nil {
+		hash = []byte(user.Password)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) != nil || err == sql.ErrNoRows {
+		if err := recordLoginFailure(usernameKey, ip); err != nil {
+			log.Printf("Login throttle error: %v", err)
+		}
 		return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "invalid credentials"})
 	}
+
+	if err := clearLoginFailures("username", usernameKey); err != nil {
+		log.Printf("Login throttle error: %v", err)
+	}
+
+	if blocked {
+		return c.JSON(http.StatusForbidden, ErrorResponse{Error: "account is blocked"})
+	}
+
+	permissions, err := loadPermissions(db, user.ID)
 	if err != nil {
 		log.Printf("Login error: %v", err)
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "invalid credentials"})
+	var familyID string
+	if err := db.QueryRow(`SELECT gen_random_uuid()`).Scan(&familyID); err != nil {
+		log.Printf("Login error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
 
-	token, err := createJWT(user.ID, user.IsAdmin)
+	tokens, err := issueTokens(db, c, user.ID, familyID)
 	if err != nil {
-		log.Printf("JWT error: %v", err)
+		log.Printf("Login session error: %v", err)
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
 
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"token":    token,
-		"user_id":  user.ID,
-		"username": req.Username,
-		"is_admin": user.IsAdmin,
-	})
+	tokens["user_id"] = user.ID
+	tokens["username"] = req.Username
+	tokens["is_admin"] = len(permissions) > 0
+	tokens["permissions"] = permissions
+	return c.JSON(http.StatusOK, tokens)
 }
 
-func createJWT(userID string, isAdmin bool) (string, error) {
+func createJWT(userID, sessionID string) (string, error) {
 	claims := &Claims{
-		UserID:  userID,
-		IsAdmin: isAdmin,
+		UserID:    userID,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(72 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
@@ -374,479 +1165,6375 @@ func createJWT(userID string, isAdmin bool) (string, error) {
 	return token.SignedString(jwtKey)
 }
 
-// ============ Профили ============
+// ============ Сессии ============
 
-func getProfile(c echo.Context) error {
-	userID := c.Get("user_id").(string)
+// Сессия — цепочка (family_id) refresh-токенов одного входа. При каждом обновлении
+// текущий токен помечается used_at и выдаётся новый в той же цепочке. Повторное
+// предъявление уже использованного токена означает его утечку, и вся цепочка отзывается.
 
-	var user User
-	err := db.QueryRow(`
-		SELECT id, username, 
-			COALESCE(first_name, '') AS first_name,
-			COALESCE(last_name, '') AS last_name,
-			COALESCE(TO_CHAR(birthdate, 'YYYY-MM-DD'), '') AS birthdate,
-			is_male,
-			COALESCE(profile_tag, '') AS profile_tag,
-			is_admin
-		FROM users WHERE id=$1`,
-		userID).Scan(
-		&user.ID, &user.Username, &user.FirstName, &user.LastName,
-		&user.Birthdate, &user.IsMale, &user.ProfileTag, &user.IsAdmin)
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
 
-	if err == sql.ErrNoRows {
-		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "profile not found"})
+func generateSecureToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// issueTokens создаёт новый refresh-токен в цепочке familyID и access-токен к нему.
+func issueTokens(q queryer, c echo.Context, userID, familyID string) (map[string]interface{}, error) {
+	refresh, err := generateSecureToken()
 	if err != nil {
-		log.Printf("Profile error: %v", err)
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		return nil, err
 	}
 
-	return c.JSON(http.StatusOK, user)
-}
+	_, err = q.Exec(`
+		INSERT INTO sessions (family_id, user_id, token_hash, expires_at, user_agent, ip)
+		VALUES ($1, $2, $3, NOW() + $4 * INTERVAL '1 second', $5, $6)`,
+		familyID, userID, hashToken(refresh), int(refreshTokenTTL.Seconds()),
+		c.Request().UserAgent(), c.RealIP())
+	if err != nil {
+		return nil, err
+	}
 
-func updateProfile(c echo.Context) error {
-	userID := c.Get("user_id").(string)
+	access, err := createJWT(userID, familyID)
+	if err != nil {
+		return nil, err
+	}
 
-	var req UpdateProfileRequest
+	return map[string]interface{}{
+		"token":         access,
+		"refresh_token": refresh,
+		"expires_in":    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+func refreshToken(c echo.Context) error {
+	var req RefreshTokenRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
 	}
-
-	if req.Birthdate != "" {
-		if _, err := time.Parse("2006-01-02", req.Birthdate); err != nil {
-			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid birthdate format, use YYYY-MM-DD"})
-		}
+	if req.RefreshToken == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "refresh_token is required"})
 	}
 
-	var isMale *bool
-
-	switch req.Gender {
-	case "M":
-		t := true
-		isMale = &t
-	case "F":
-		f := false
-		isMale = &f
-	case "":
-		isMale = nil
-	default:
-		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "gender must be 'M' (Male) or 'F' (Female)"})
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Refresh token error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer tx.Rollback()
+
+	var sessionID, familyID, userID string
+	var expired, used, revoked bool
+	err = tx.QueryRow(`
+		SELECT id, family_id, user_id, expires_at <= NOW(), used_at IS NOT NULL, revoked_at IS NOT NULL
+		FROM sessions WHERE token_hash=$1
+		FOR UPDATE`,
+		hashToken(req.RefreshToken)).Scan(&sessionID, &familyID, &userID, &expired, &used, &revoked)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "invalid refresh token"})
+	}
+	if err != nil {
+		log.Printf("Refresh token error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if used && !revoked {
+		if err := revokeSessions(tx, `family_id=$1`, familyID); err != nil {
+			log.Printf("Refresh token error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Refresh token commit error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+		log.Printf("Refresh token reuse detected for user %s, session %s revoked", userID, familyID)
+		return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "refresh token reuse detected"})
+	}
+	if used || revoked || expired {
+		return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "invalid refresh token"})
 	}
-	result, err := db.Exec(`
-        UPDATE users 
-        SET first_name=$1, 
-            last_name=$2, 
-            birthdate=$3, 
-            is_male = COALESCE($4, is_male) 
-        WHERE id=$5`,
-		req.FirstName, req.LastName, req.Birthdate, isMale, userID)
 
+	var active bool
+	err = tx.QueryRow(
+		`SELECT blocked_at IS NULL AND deleted_at IS NULL FROM users WHERE id=$1`, userID).Scan(&active)
 	if err != nil {
-		log.Printf("Update profile error: %v", err)
+		log.Printf("Refresh token error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if !active {
+		return c.JSON(http.StatusForbidden, ErrorResponse{Error: "account is blocked"})
+	}
+
+	permissions, err := loadPermissions(tx, userID)
+	if err != nil {
+		log.Printf("Refresh token error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if _, err := tx.Exec(`UPDATE sessions SET used_at=NOW() WHERE id=$1`, sessionID); err != nil {
+		log.Printf("Refresh token error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	tokens, err := issueTokens(tx, c, userID, familyID)
+	if err != nil {
+		log.Printf("Refresh token error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Refresh token commit error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	tokens["user_id"] = userID
+	tokens["is_admin"] = len(permissions) > 0
+	tokens["permissions"] = permissions
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// revokeSessions отзывает все ещё действующие refresh-токены, подходящие под условие where.
+func revokeSessions(q queryer, where string, args ...interface{}) error {
+	_, err := q.Exec(`UPDATE sessions SET revoked_at=NOW() WHERE revoked_at IS NULL AND `+where, args...)
+	return err
+}
+
+func logout(c echo.Context) error {
+	sessionID := c.Get("session_id").(string)
+
+	if err := revokeSessions(db, `family_id=$1`, sessionID); err != nil {
+		log.Printf("Logout error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "logged out"})
+}
+
+func logoutAll(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	if err := revokeSessions(db, `user_id=$1`, userID); err != nil {
+		log.Printf("Logout all error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "all sessions logged out"})
+}
+
+// ============ Защита входа ============
+
+// loginRetryAfter возвращает, сколько секунд осталось до снятия блокировки
+// по имени пользователя или IP (0 — вход разрешён).
+func loginRetryAfter(username, ip string) (int, error) {
+	var seconds int
+	err := db.QueryRow(`
+		SELECT COALESCE(CEIL(EXTRACT(EPOCH FROM MAX(locked_until) - NOW())), 0)::int
+		FROM login_throttles
+		WHERE ((kind='username' AND key=$1) OR (kind='ip' AND key=$2)) AND locked_until > NOW()`,
+		username, ip).Scan(&seconds)
+	return seconds, err
+}
+
+// loginBackoff — на сколько блокировать вход после failures неудач подряд.
+func loginBackoff(failures int) time.Duration {
+	if failures >= loginMaxFailures {
+		return loginLockout
+	}
+	if failures <= loginFreeAttempts {
+		return 0
+	}
+	delay := loginBackoffBase << uint(failures-loginFreeAttempts-1)
+	if delay > loginLockout {
+		delay = loginLockout
+	}
+	return delay
+}
+
+func recordLoginFailure(username, ip string) error {
+	keys := []struct{ kind, key string }{{"username", username}, {"ip", ip}}
+	for _, k := range keys {
+		var failures int
+		err := db.QueryRow(`
+			INSERT INTO login_throttles (kind, key, failures, last_failure_at)
+			VALUES ($1, $2, 1, NOW())
+			ON CONFLICT (kind, key) DO UPDATE SET
+				failures = CASE
+					WHEN login_throttles.last_failure_at < NOW() - $3 * INTERVAL '1 second' THEN 1
+					ELSE login_throttles.failures + 1
+				END,
+				last_failure_at = NOW()
+			RETURNING failures`,
+			k.kind, k.key, int(loginFailureWindow.Seconds())).Scan(&failures)
+		if err != nil {
+			return err
+		}
+
+		if delay := loginBackoff(failures); delay > 0 {
+			_, err := db.Exec(`
+				UPDATE login_throttles SET locked_until = NOW() + $3 * INTERVAL '1 second'
+				WHERE kind=$1 AND key=$2`,
+				k.kind, k.key, int(delay.Seconds()))
+			if err != nil {
+				return err
+			}
+			if failures >= loginMaxFailures {
+				log.Printf("Login locked for %s %s after %d failures", k.kind, k.key, failures)
+			}
+		}
+	}
+	return nil
+}
+
+func clearLoginFailures(kind, key string) error {
+	_, err := db.Exec(`DELETE FROM login_throttles WHERE kind=$1 AND key=$2`, kind, key)
+	return err
+}
+
+func getLockouts(c echo.Context) error {
+	rows, err := db.Query(`
+		SELECT id, kind, key, failures, last_failure_at, locked_until, COALESCE(locked_until > NOW(), false)
+		FROM login_throttles
+		WHERE last_failure_at > NOW() - $1 * INTERVAL '1 second' OR locked_until > NOW()
+		ORDER BY last_failure_at DESC`,
+		int(loginFailureWindow.Seconds()))
+	if err != nil {
+		log.Printf("Get lockouts error: %v", err)
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
+	defer rows.Close()
+
+	var lockouts []LoginThrottle
+	for rows.Next() {
+		var l LoginThrottle
+		if err := rows.Scan(&l.ID, &l.Kind, &l.Key, &l.Failures, &l.LastFailureAt, &l.LockedUntil, &l.Locked); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		lockouts = append(lockouts, l)
+	}
+	if lockouts == nil {
+		lockouts = []LoginThrottle{}
+	}
+	return c.JSON(http.StatusOK, lockouts)
+}
 
+func clearLockout(c echo.Context) error {
+	id := c.Param("id")
+	result, err := db.Exec(`DELETE FROM login_throttles WHERE id=$1`, id)
+	if isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "lockout not found"})
+	}
+	if err != nil {
+		log.Printf("Clear lockout error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
 	rows, _ := result.RowsAffected()
 	if rows == 0 {
-		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "user not found"})
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "lockout not found"})
 	}
+	return c.NoContent(http.StatusOK)
+}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "profile updated successfully"})
+// ============ Роли и права ============
+
+const (
+	permProductsWrite   = "products:write"
+	permReviewsModerate = "reviews:moderate"
+	permOrdersManage    = "orders:manage"
+	permPromosManage    = "promos:manage"
+	permUsersManage     = "users:manage"
+)
+
+var allPermissions = []string{
+	permProductsWrite,
+	permReviewsModerate,
+	permOrdersManage,
+	permPromosManage,
+	permUsersManage,
 }
 
-// ============ Группы ============
+// adminRoleName — системная роль со всеми правами, её нельзя изменить или удалить.
+const adminRoleName = "admin"
 
-func getGroups(c echo.Context) error {
-	userID := c.Get("user_id").(string)
+func hasPermission(granted []string, perm string) bool {
+	for _, g := range granted {
+		if g == perm {
+			return true
+		}
+	}
+	return false
+}
 
-	rows, err := db.Query(
-		`SELECT id, title FROM groups WHERE user_id=$1 ORDER BY created_at DESC`,
-		userID)
+func loadPermissions(q queryer, userID string) ([]string, error) {
+	var permissions []string
+	err := q.QueryRow(`
+		SELECT COALESCE(array_agg(DISTINCT rp.permission), '{}')
+		FROM user_roles ur
+		JOIN role_permissions rp ON rp.role_id = ur.role_id
+		WHERE ur.user_id = $1`,
+		userID).Scan(pq.Array(&permissions))
+	return permissions, err
+}
+
+func getPermissions(c echo.Context) error {
+	return c.JSON(http.StatusOK, allPermissions)
+}
+
+func getRoles(c echo.Context) error {
+	rows, err := db.Query(`
+		SELECT r.id, r.name, COALESCE(r.description, ''), r.is_system,
+			COALESCE((SELECT array_agg(rp.permission ORDER BY rp.permission) FROM role_permissions rp WHERE rp.role_id = r.id), '{}'),
+			(SELECT COUNT(*) FROM user_roles ur WHERE ur.role_id = r.id)
+		FROM roles r
+		ORDER BY r.name`)
 	if err != nil {
-		log.Printf("Get groups error: %v", err)
+		log.Printf("Get roles error: %v", err)
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
 	defer rows.Close()
 
-	var groups []Group
+	var roles []Role
 	for rows.Next() {
-		var g Group
-		if err := rows.Scan(&g.ID, &g.Title); err != nil {
+		var r Role
+		if err := rows.Scan(&r.ID, &r.Name, &r.Description, &r.IsSystem, pq.Array(&r.Permissions), &r.UserCount); err != nil {
 			log.Printf("Scan error: %v", err)
 			continue
 		}
-		g.UserID = userID
-		groups = append(groups, g)
+		roles = append(roles, r)
+	}
+	if roles == nil {
+		roles = []Role{}
 	}
+	return c.JSON(http.StatusOK, roles)
+}
 
-	if groups == nil {
-		groups = []Group{}
+func validateRoleRequest(req *RoleRequest) error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 50 {
+		return fmt.Errorf("name must be between 1 and 50 characters")
 	}
-	return c.JSON(http.StatusOK, groups)
+	for _, p := range req.Permissions {
+		if !hasPermission(allPermissions, p) {
+			return fmt.Errorf("unknown permission: %s", p)
+		}
+	}
+	return nil
 }
 
-func createGroup(c echo.Context) error {
-	userID := c.Get("user_id").(string)
+func setRolePermissions(tx *sql.Tx, roleID string, permissions []string) error {
+	if _, err := tx.Exec(`DELETE FROM role_permissions WHERE role_id=$1`, roleID); err != nil {
+		return err
+	}
+	for _, p := range permissions {
+		_, err := tx.Exec(
+			`INSERT INTO role_permissions (role_id, permission) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+			roleID, p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	var req CreateGroupRequest
+func createRole(c echo.Context) error {
+	var req RoleRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
 	}
-
-	if req.Title == "" {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "title cannot be empty"})
+	if err := validateRoleRequest(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
 	}
 
-	var groupID string
-	err := db.QueryRow(
-		`INSERT INTO groups (title, user_id) VALUES ($1, $2) RETURNING id`,
-		req.Title, userID).Scan(&groupID)
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Create role error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer tx.Rollback()
 
+	var roleID string
+	err = tx.QueryRow(
+		`INSERT INTO roles (name, description) VALUES ($1, $2) RETURNING id`,
+		req.Name, req.Description).Scan(&roleID)
 	if err != nil {
-		log.Printf("Create group error: %v", err)
+		if strings.Contains(err.Error(), "duplicate key") {
+			return c.JSON(http.StatusConflict, ErrorResponse{Error: "role already exists"})
+		}
+		log.Printf("Create role error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if err := setRolePermissions(tx, roleID, req.Permissions); err != nil {
+		log.Printf("Create role error: %v", err)
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
 
+	if err := tx.Commit(); err != nil {
+		log.Printf("Create role commit error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
 	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"id":    groupID,
-		"title": req.Title,
+		"id": roleID,
 	})
 }
 
-func updateGroup(c echo.Context) error {
-	userID := c.Get("user_id").(string)
-	groupID := c.Param("id")
+func updateRole(c echo.Context) error {
+	roleID := c.Param("id")
 
-	var req UpdateGroupRequest
+	var req RoleRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
 	}
+	if err := validateRoleRequest(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
 
-	result, err := db.Exec(
-		`UPDATE groups SET title=$1 WHERE id=$2 AND user_id=$3`,
-		req.Title, groupID, userID)
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Update role error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer tx.Rollback()
+
+	var isSystem bool
+	err = tx.QueryRow(`SELECT is_system FROM roles WHERE id=$1 FOR UPDATE`, roleID).Scan(&isSystem)
+	if err == sql.ErrNoRows || isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "role not found"})
+	}
+	if err != nil {
+		log.Printf("Update role error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if isSystem {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "system role cannot be modified"})
+	}
 
+	_, err = tx.Exec(`UPDATE roles SET name=$1, description=$2 WHERE id=$3`, req.Name, req.Description, roleID)
 	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return c.JSON(http.StatusConflict, ErrorResponse{Error: "role already exists"})
+		}
+		log.Printf("Update role error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if err := setRolePermissions(tx, roleID, req.Permissions); err != nil {
+		log.Printf("Update role error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Update role commit error: %v", err)
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "role updated"})
+}
 
+func deleteRole(c echo.Context) error {
+	roleID := c.Param("id")
+	result, err := db.Exec(`DELETE FROM roles WHERE id=$1 AND NOT is_system`, roleID)
+	if isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "role not found or is a system role"})
+	}
+	if err != nil {
+		log.Printf("Delete role error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
 	rows, _ := result.RowsAffected()
 	if rows == 0 {
-		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "group not found"})
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "role not found or is a system role"})
 	}
+	return c.NoContent(http.StatusOK)
+}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "group updated"})
+func getUserRoles(c echo.Context) error {
+	userID := c.Param("id")
+
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id=$1)`, userID).Scan(&exists)
+	if isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "user not found"})
+	}
+	if err != nil {
+		log.Printf("Get user roles error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if !exists {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "user not found"})
+	}
+
+	var roles []string
+	err = db.QueryRow(`
+		SELECT COALESCE(array_agg(r.name ORDER BY r.name), '{}')
+		FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+		WHERE ur.user_id=$1`,
+		userID).Scan(pq.Array(&roles))
+	if err != nil {
+		log.Printf("Get user roles error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	permissions, err := loadPermissions(db, userID)
+	if err != nil {
+		log.Printf("Get user roles error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"roles":       roles,
+		"permissions": permissions,
+	})
 }
 
-func deleteGroup(c echo.Context) error {
-	userID := c.Get("user_id").(string)
-	groupID := c.Param("id")
+// setUserRoles заменяет набор ролей пользователя. Роли передаются по имени.
+func setUserRoles(c echo.Context) error {
+	userID := c.Param("id")
+
+	var req UserRolesRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Set user roles error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id=$1)`, userID).Scan(&exists)
+	if isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "user not found"})
+	}
+	if err != nil {
+		log.Printf("Set user roles error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if !exists {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "user not found"})
+	}
+
+	var roleIDs []string
+	err = tx.QueryRow(
+		`SELECT COALESCE(array_agg(id), '{}') FROM roles WHERE name = ANY($1)`,
+		pq.Array(req.Roles)).Scan(pq.Array(&roleIDs))
+	if err != nil {
+		log.Printf("Set user roles error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if len(roleIDs) != len(uniqueStrings(req.Roles)) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "unknown role"})
+	}
+
+	if _, err := tx.Exec(`DELETE FROM user_roles WHERE user_id=$1`, userID); err != nil {
+		log.Printf("Set user roles error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	for _, roleID := range roleIDs {
+		if _, err := tx.Exec(`INSERT INTO user_roles (user_id, role_id) VALUES ($1, $2)`, userID, roleID); err != nil {
+			log.Printf("Set user roles error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+	}
+
+	admins, err := countActiveAdmins(tx)
+	if err != nil {
+		log.Printf("Set user roles error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if admins == 0 {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "cannot remove the last administrator"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Set user roles commit error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "roles updated"})
+}
+
+// countActiveAdmins считает незаблокированных пользователей с ролью admin.
+// Изменения, после которых их не остаётся, отклоняются, чтобы не потерять доступ к админке.
+func countActiveAdmins(q queryer) (int, error) {
+	var admins int
+	err := q.QueryRow(`
+		SELECT COUNT(*) FROM user_roles ur
+		JOIN roles r ON r.id = ur.role_id
+		JOIN users u ON u.id = ur.user_id
+		WHERE r.name=$1 AND u.blocked_at IS NULL AND u.deleted_at IS NULL`,
+		adminRoleName).Scan(&admins)
+	return admins, err
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	var result []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// ============ Пользователи ============
+
+const adminUserColumns = `u.id, u.username, COALESCE(u.profile_tag, ''), COALESCE(u.first_name, ''),
+	COALESCE(u.last_name, ''), COALESCE(u.email, ''),
+	COALESCE((SELECT array_agg(r.name ORDER BY r.name) FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+		WHERE ur.user_id = u.id), '{}'),
+	u.blocked_at IS NOT NULL, u.blocked_at, u.deleted_at, u.created_at`
+
+func scanAdminUser(row interface{ Scan(...interface{}) error }, u *AdminUser) error {
+	err := row.Scan(&u.ID, &u.Username, &u.ProfileTag, &u.FirstName, &u.LastName, &u.Email,
+		pq.Array(&u.Roles), &u.IsBlocked, &u.BlockedAt, &u.DeletedAt, &u.CreatedAt)
+	for _, r := range u.Roles {
+		if r == adminRoleName {
+			u.IsAdmin = true
+		}
+	}
+	return err
+}
+
+// parsePagination читает page и limit из запроса (по умолчанию 1 и 20, limit не больше 100).
+func parsePagination(c echo.Context) (page, limit int, err error) {
+	page, limit = 1, 20
+	if v := c.QueryParam("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("page must be a positive integer")
+		}
+		page = n
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			return 0, 0, fmt.Errorf("limit must be between 1 and 100")
+		}
+		limit = n
+	}
+	return page, limit, nil
+}
+
+// getAdminUsers — список пользователей с поиском по username/profile_tag (?q=) и постраничным выводом
+// (?page=, ?limit=). Удалённые показываются только с ?deleted=true.
+func getAdminUsers(c echo.Context) error {
+	page, limit, err := parsePagination(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+	q := strings.TrimSpace(c.QueryParam("q"))
+	withDeleted := c.QueryParam("deleted") == "true"
+
+	const filter = `
+		FROM users u
+		WHERE ($1 = '' OR u.username ILIKE '%' || $1 || '%' OR u.profile_tag ILIKE '%' || $1 || '%')
+			AND ($2 OR u.deleted_at IS NULL)`
+
+	list := AdminUserList{Items: []AdminUser{}, Page: page, Limit: limit}
+	if err := db.QueryRow(`SELECT COUNT(*)`+filter, q, withDeleted).Scan(&list.Total); err != nil {
+		log.Printf("Get users error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	rows, err := db.Query(`SELECT `+adminUserColumns+filter+`
+		ORDER BY u.created_at DESC, u.id
+		LIMIT $3 OFFSET $4`,
+		q, withDeleted, limit, (page-1)*limit)
+	if err != nil {
+		log.Printf("Get users error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u AdminUser
+		if err := scanAdminUser(rows, &u); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		list.Items = append(list.Items, u)
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func getAdminUser(c echo.Context) error {
+	userID := c.Param("id")
+
+	var u AdminUser
+	err := scanAdminUser(db.QueryRow(`SELECT `+adminUserColumns+` FROM users u WHERE u.id=$1`, userID), &u)
+	if err == sql.ErrNoRows || isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "user not found"})
+	}
+	if err != nil {
+		log.Printf("Get user error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	var sessions int
+	err = db.QueryRow(`
+		SELECT COUNT(DISTINCT family_id) FROM sessions
+		WHERE user_id=$1 AND revoked_at IS NULL AND used_at IS NULL AND expires_at > NOW()`,
+		userID).Scan(&sessions)
+	if err != nil {
+		log.Printf("Get user error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	u.ActiveSessions = &sessions
+
+	return c.JSON(http.StatusOK, u)
+}
+
+// updateUserStatus выдаёт/снимает роль admin и блокирует/разблокирует пользователя.
+// Блокировка сразу завершает все его сессии.
+func updateUserStatus(c echo.Context) error {
+	userID := c.Param("id")
+	adminID := c.Get("user_id").(string)
+
+	var req UpdateUserStatusRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if req.IsAdmin == nil && req.IsBlocked == nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "nothing to update"})
+	}
+	if userID == adminID && ((req.IsAdmin != nil && !*req.IsAdmin) || (req.IsBlocked != nil && *req.IsBlocked)) {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "you cannot demote or block yourself"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Update user status error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer tx.Rollback()
+
+	var deleted bool
+	err = tx.QueryRow(`SELECT deleted_at IS NOT NULL FROM users WHERE id=$1 FOR UPDATE`, userID).Scan(&deleted)
+	if err == sql.ErrNoRows || isInvalidInput(err) || deleted {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "user not found"})
+	}
+	if err != nil {
+		log.Printf("Update user status error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if req.IsAdmin != nil {
+		query := `DELETE FROM user_roles WHERE user_id=$1 AND role_id=(SELECT id FROM roles WHERE name=$2)`
+		if *req.IsAdmin {
+			query = `INSERT INTO user_roles (user_id, role_id) SELECT $1, id FROM roles WHERE name=$2 ON CONFLICT DO NOTHING`
+		}
+		if _, err := tx.Exec(query, userID, adminRoleName); err != nil {
+			log.Printf("Update user status error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+	}
+
+	if req.IsBlocked != nil {
+		if *req.IsBlocked {
+			if _, err := tx.Exec(`UPDATE users SET blocked_at=COALESCE(blocked_at, NOW()) WHERE id=$1`, userID); err != nil {
+				log.Printf("Update user status error: %v", err)
+				return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+			}
+			if err := revokeSessions(tx, `user_id=$1`, userID); err != nil {
+				log.Printf("Update user status error: %v", err)
+				return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+			}
+		} else if _, err := tx.Exec(`UPDATE users SET blocked_at=NULL WHERE id=$1`, userID); err != nil {
+			log.Printf("Update user status error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+	}
+
+	admins, err := countActiveAdmins(tx)
+	if err != nil {
+		log.Printf("Update user status error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if admins == 0 {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "cannot remove the last administrator"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Update user status commit error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "user updated"})
+}
+
+func logoutUser(c echo.Context) error {
+	userID := c.Param("id")
+
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id=$1)`, userID).Scan(&exists)
+	if isInvalidInput(err) || (err == nil && !exists) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "user not found"})
+	}
+	if err != nil {
+		log.Printf("Logout user error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if err := revokeSessions(db, `user_id=$1`, userID); err != nil {
+		log.Printf("Logout user error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "user sessions revoked"})
+}
+
+// deleteUser помечает аккаунт удалённым: данные (заказы, отзывы) сохраняются,
+// но войти в него больше нельзя, а username остаётся занятым.
+func deleteUser(c echo.Context) error {
+	userID := c.Param("id")
+	adminID := c.Get("user_id").(string)
+
+	if userID == adminID {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "you cannot delete yourself"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Delete user error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE users SET deleted_at=NOW() WHERE id=$1 AND deleted_at IS NULL`, userID)
+	if isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "user not found"})
+	}
+	if err != nil {
+		log.Printf("Delete user error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "user not found"})
+	}
+
+	if err := revokeSessions(tx, `user_id=$1`, userID); err != nil {
+		log.Printf("Delete user error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if _, err := tx.Exec(`DELETE FROM cart_items WHERE user_id=$1`, userID); err != nil {
+		log.Printf("Delete user error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	admins, err := countActiveAdmins(tx)
+	if err != nil {
+		log.Printf("Delete user error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if admins == 0 {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "cannot remove the last administrator"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Delete user commit error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// ============ Профили ============
+
+func getProfile(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	var user User
+	err := db.QueryRow(`
+		SELECT id, username, 
+			COALESCE(first_name, '') AS first_name,
+			COALESCE(last_name, '') AS last_name,
+			COALESCE(TO_CHAR(birthdate, 'YYYY-MM-DD'), '') AS birthdate,
+			is_male,
+			COALESCE(profile_tag, '') AS profile_tag,
+			COALESCE(email, '') AS email
+		FROM users WHERE id=$1`,
+		userID).Scan(
+		&user.ID, &user.Username, &user.FirstName, &user.LastName,
+		&user.Birthdate, &user.IsMale, &user.ProfileTag, &user.Email)
+
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "profile not found"})
+	}
+	if err != nil {
+		log.Printf("Profile error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	user.Permissions = c.Get("permissions").([]string)
+	user.IsAdmin = len(user.Permissions) > 0
+	return c.JSON(http.StatusOK, user)
+}
+
+func updateProfile(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	var req UpdateProfileRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+
+	if req.Birthdate != "" {
+		if _, err := time.Parse("2006-01-02", req.Birthdate); err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid birthdate format, use YYYY-MM-DD"})
+		}
+	}
+
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email != "" && (len(req.Email) > 255 || !strings.Contains(req.Email, "@")) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid email"})
+	}
+
+	var isMale *bool
+
+	switch req.Gender {
+	case "M":
+		t := true
+		isMale = &t
+	case "F":
+		f := false
+		isMale = &f
+	case "":
+		isMale = nil
+	default:
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "gender must be 'M' (Male) or 'F' (Female)"})
+	}
+	result, err := db.Exec(`
+        UPDATE users 
+        SET first_name=$1, 
+            last_name=$2, 
+            birthdate=$3, 
+            is_male = COALESCE($4, is_male),
+            email = NULLIF($5, '')
+        WHERE id=$6`,
+		req.FirstName, req.LastName, req.Birthdate, isMale, req.Email, userID)
+
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return c.JSON(http.StatusConflict, ErrorResponse{Error: "email already in use"})
+		}
+		log.Printf("Update profile error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "user not found"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "profile updated successfully"})
+}
+
+// ============ Пароли ============
+
+// MailSender отправляет письма пользователям. Для локальной разработки есть
+// logMailSender (пишет письмо в лог) и fileMailSender (дописывает в файл),
+// в продакшене — smtpMailSender.
+type MailSender interface {
+	Send(to, subject, body string) error
+}
+
+type logMailSender struct{}
+
+func (logMailSender) Send(to, subject, body string) error {
+	log.Printf("Mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+type fileMailSender struct {
+	Path string
+}
+
+func (m fileMailSender) Send(to, subject, body string) error {
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().Format(time.RFC1123Z), to, subject, body)
+	return err
+}
+
+type smtpMailSender struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func (m smtpMailSender) Send(to, subject, body string) error {
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n"+
+		"MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		m.From, to, mime.QEncoding.Encode("utf-8", subject), time.Now().Format(time.RFC1123Z), body)
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(msg))
+}
+
+func changePassword(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	sessionID := c.Get("session_id").(string)
+
+	var req ChangePasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	var current string
+	err := db.QueryRow(`SELECT password FROM users WHERE id=$1`, userID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "user not found"})
+	}
+	if err != nil {
+		log.Printf("Change password error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(current), []byte(req.CurrentPassword)); err != nil {
+		return c.JSON(http.StatusForbidden, ErrorResponse{Error: "current password is incorrect"})
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Change password error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET password=$1, updated_at=NOW() WHERE id=$2`, string(hash), userID); err != nil {
+		log.Printf("Change password error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if err := revokeSessions(tx, `user_id=$1 AND family_id<>$2`, userID, sessionID); err != nil {
+		log.Printf("Change password error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Change password commit error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "password changed"})
+}
+
+// forgotPassword всегда отвечает одинаково, чтобы по ответу нельзя было узнать,
+// существует ли пользователь и указан ли у него email.
+func forgotPassword(c echo.Context) error {
+	var req ForgotPasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+
+	response := map[string]string{"message": "if the account exists, a reset link has been sent"}
+
+	var userID, email string
+	err := db.QueryRow(
+		`SELECT id, COALESCE(email, '') FROM users WHERE username=$1 AND blocked_at IS NULL AND deleted_at IS NULL`,
+		req.Username).Scan(&userID, &email)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusOK, response)
+	}
+	if err != nil {
+		log.Printf("Forgot password error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if email == "" {
+		log.Printf("Password reset requested for user %s without email", userID)
+		return c.JSON(http.StatusOK, response)
+	}
+
+	token, err := generateSecureToken()
+	if err != nil {
+		log.Printf("Forgot password error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO password_reset_tokens (user_id, token_hash, expires_at)
+		VALUES ($1, $2, NOW() + $3 * INTERVAL '1 second')`,
+		userID, hashToken(token), int(resetTokenTTL.Seconds()))
+	if err != nil {
+		log.Printf("Forgot password error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	appURL := os.Getenv("APP_URL")
+	if appURL == "" {
+		appURL = "http://localhost:5173"
+	}
+	body := fmt.Sprintf("Чтобы задать новый пароль, перейдите по ссылке (действует %d мин.):\n%s/reset-password?token=%s",
+		int(resetTokenTTL.Minutes()), strings.TrimRight(appURL, "/"), token)
+	if err := mailer.Send(email, "Восстановление пароля", body); err != nil {
+		log.Printf("Forgot password mail error: %v", err)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func resetPassword(c echo.Context) error {
+	var req ResetPasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if req.Token == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "token is required"})
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Reset password error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer tx.Rollback()
+
+	// Помечаем токен использованным тем же запросом, что и проверяем, — так его нельзя погасить дважды.
+	var userID string
+	err = tx.QueryRow(`
+		UPDATE password_reset_tokens SET used_at=NOW()
+		WHERE token_hash=$1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id`,
+		hashToken(req.Token)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid or expired reset token"})
+	}
+	if err != nil {
+		log.Printf("Reset password error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if _, err := tx.Exec(`UPDATE users SET password=$1, updated_at=NOW() WHERE id=$2`, string(hash), userID); err != nil {
+		log.Printf("Reset password error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if _, err := tx.Exec(
+		`UPDATE password_reset_tokens SET used_at=NOW() WHERE user_id=$1 AND used_at IS NULL`, userID); err != nil {
+		log.Printf("Reset password error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if err := revokeSessions(tx, `user_id=$1`, userID); err != nil {
+		log.Printf("Reset password error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if _, err := tx.Exec(`
+		DELETE FROM login_throttles
+		WHERE kind='username' AND key=(SELECT LOWER(username) FROM users WHERE id=$1)`, userID); err != nil {
+		log.Printf("Reset password error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Reset password commit error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "password has been reset"})
+}
+
+// ============ Группы ============
+
+func getGroups(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	rows, err := db.Query(`
+		SELECT g.id, g.title, g.user_id, CASE WHEN g.user_id=$1 THEN $2 ELSE m.role END
+		FROM groups g
+		LEFT JOIN group_members m ON m.group_id = g.id AND m.user_id = $1 AND m.status = 'accepted'
+		WHERE (g.user_id=$1 OR m.user_id IS NOT NULL) AND g.deleted_at IS NULL
+		ORDER BY g.created_at DESC`,
+		userID, groupRoleOwner)
+	if err != nil {
+		log.Printf("Get groups error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer rows.Close()
+
+	var groups []Group
+	for rows.Next() {
+		var g Group
+		if err := rows.Scan(&g.ID, &g.Title, &g.UserID, &g.Role); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		groups = append(groups, g)
+	}
+
+	if groups == nil {
+		groups = []Group{}
+	}
+	return c.JSON(http.StatusOK, groups)
+}
+
+func createGroup(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	var req CreateGroupRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+
+	if req.Title == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "title cannot be empty"})
+	}
+
+	var groupID string
+	err := db.QueryRow(
+		`INSERT INTO groups (title, user_id) VALUES ($1, $2) RETURNING id`,
+		req.Title, userID).Scan(&groupID)
+
+	if err != nil {
+		log.Printf("Create group error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"id":    groupID,
+		"title": req.Title,
+		"role":  groupRoleOwner,
+	})
+}
+
+func updateGroup(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	groupID := c.Param("id")
+
+	var req UpdateGroupRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+
+	if ok, err := requireGroupRole(c, groupID, userID, groupRoleOwner); !ok {
+		return err
+	}
+
+	result, err := db.Exec(`UPDATE groups SET title=$1 WHERE id=$2`, req.Title, groupID)
+
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "group not found"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "group updated"})
+}
+
+func deleteGroup(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	groupID := c.Param("id")
+
+	if ok, err := requireGroupRole(c, groupID, userID, groupRoleOwner); !ok {
+		return err
+	}
+
+	// Группа уходит в корзину вместе с задачами; окончательно её удалит runTrashPurge.
+	result, err := db.Exec(`UPDATE groups SET deleted_at=NOW() WHERE id=$1 AND deleted_at IS NULL`, groupID)
+	if err != nil {
+		log.Printf("Delete group error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "group not found"})
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// ============ Доступ к группам ============
+
+// Роли в группе по возрастанию прав: viewer читает задачи, editor меняет их,
+// owner (создатель группы или назначенный им участник) управляет группой и участниками.
+const (
+	groupRoleViewer = "viewer"
+	groupRoleEditor = "editor"
+	groupRoleOwner  = "owner"
+)
+
+var groupRoleRank = map[string]int{
+	groupRoleViewer: 1,
+	groupRoleEditor: 2,
+	groupRoleOwner:  3,
+}
+
+// groupRole возвращает роль пользователя в группе или "", если группа ему недоступна или удалена
+// (в том числе если её нет или id некорректен) — такие группы отдаются как 404.
+// Непринятые приглашения доступа не дают.
+func groupRole(q queryer, groupID, userID string) (string, error) {
+	var role string
+	err := q.QueryRow(`
+		SELECT CASE WHEN g.user_id=$2 THEN $3 ELSE m.role END
+		FROM groups g
+		LEFT JOIN group_members m ON m.group_id = g.id AND m.user_id = $2 AND m.status = 'accepted'
+		WHERE g.id=$1 AND (g.user_id=$2 OR m.user_id IS NOT NULL) AND g.deleted_at IS NULL`,
+		groupID, userID, groupRoleOwner).Scan(&role)
+	if err == sql.ErrNoRows || isInvalidInput(err) {
+		return "", nil
+	}
+	return role, err
+}
+
+// requireGroupRole проверяет, что у пользователя в группе роль не ниже minRole.
+// Если доступа нет, ответ с ошибкой уже отправлен: обработчик должен вернуть err
+// (обычно nil после успешной записи ответа) и ничего больше не делать.
+//
+//	if ok, err := requireGroupRole(c, groupID, userID, groupRoleEditor); !ok {
+//		return err
+//	}
+func requireGroupRole(c echo.Context, groupID, userID, minRole string) (bool, error) {
+	role, err := groupRole(db, groupID, userID)
+	if err != nil {
+		log.Printf("Group access error: %v", err)
+		return false, c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if role == "" {
+		return false, c.JSON(http.StatusNotFound, ErrorResponse{Error: "group not found"})
+	}
+	if groupRoleRank[role] < groupRoleRank[minRole] {
+		return false, c.JSON(http.StatusForbidden, ErrorResponse{Error: minRole + " role required"})
+	}
+	return true, nil
+}
+
+// taskGroupRole — то же, что groupRole, для группы, в которой лежит задача.
+func taskGroupRole(q queryer, taskID, userID string) (string, error) {
+	var groupID string
+	err := q.QueryRow(`SELECT group_id FROM tasks WHERE id=$1 AND deleted_at IS NULL`, taskID).Scan(&groupID)
+	if err == sql.ErrNoRows || isInvalidInput(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return groupRole(q, groupID, userID)
+}
+
+// requireTaskRole — аналог requireGroupRole для группы, в которой лежит задача.
+func requireTaskRole(c echo.Context, taskID, userID, minRole string) (bool, error) {
+	role, err := taskGroupRole(db, taskID, userID)
+	if err != nil {
+		log.Printf("Task access error: %v", err)
+		return false, c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if role == "" {
+		return false, c.JSON(http.StatusNotFound, ErrorResponse{Error: "task not found"})
+	}
+	if groupRoleRank[role] < groupRoleRank[minRole] {
+		return false, c.JSON(http.StatusForbidden, ErrorResponse{Error: minRole + " role required"})
+	}
+	return true, nil
+}
+
+func isValidGroupRole(role string) bool {
+	_, ok := groupRoleRank[role]
+	return ok
+}
+
+// ============ Участники групп ============
+
+func getGroupMembers(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	groupID := c.Param("id")
+
+	if ok, err := requireGroupRole(c, groupID, userID, groupRoleViewer); !ok {
+		return err
+	}
+
+	rows, err := db.Query(`
+		SELECT u.id, u.username, COALESCE(u.profile_tag, ''), $2, 'accepted', g.created_at
+		FROM groups g JOIN users u ON u.id = g.user_id
+		WHERE g.id=$1
+		UNION ALL
+		SELECT u.id, u.username, COALESCE(u.profile_tag, ''), m.role, m.status, m.created_at
+		FROM group_members m JOIN users u ON u.id = m.user_id
+		WHERE m.group_id=$1 AND m.status <> 'declined'
+		ORDER BY 6`,
+		groupID, groupRoleOwner)
+	if err != nil {
+		log.Printf("Get group members error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer rows.Close()
+
+	var members []GroupMember
+	for rows.Next() {
+		var m GroupMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.ProfileTag, &m.Role, &m.Status, &m.InvitedAt); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		members = append(members, m)
+	}
+	if members == nil {
+		members = []GroupMember{}
+	}
+	return c.JSON(http.StatusOK, members)
+}
+
+// inviteGroupMember приглашает пользователя (по username или profile_tag) в группу.
+// Доступ появляется после того, как приглашённый примет приглашение.
+func inviteGroupMember(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	groupID := c.Param("id")
+
+	var req InviteMemberRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	req.User = strings.TrimSpace(req.User)
+	if req.User == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "user cannot be empty"})
+	}
+	if !isValidGroupRole(req.Role) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "role must be one of: viewer, editor, owner"})
+	}
+
+	if ok, err := requireGroupRole(c, groupID, userID, groupRoleOwner); !ok {
+		return err
+	}
+
+	var inviteeID string
+	var isCreator bool
+	err := db.QueryRow(`
+		SELECT u.id, u.id = g.user_id
+		FROM users u, groups g
+		WHERE (u.username=$1 OR u.profile_tag=$1) AND u.deleted_at IS NULL AND g.id=$2
+		LIMIT 1`,
+		req.User, groupID).Scan(&inviteeID, &isCreator)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "user not found"})
+	}
+	if err != nil {
+		log.Printf("Invite member error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if isCreator {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "user already owns this group"})
+	}
+
+	// Отклонённое приглашение можно отправить повторно.
+	result, err := db.Exec(`
+		INSERT INTO group_members (group_id, user_id, role, status, invited_by)
+		VALUES ($1, $2, $3, 'pending', $4)
+		ON CONFLICT (group_id, user_id) DO UPDATE
+			SET role = EXCLUDED.role, status = 'pending', invited_by = EXCLUDED.invited_by,
+				created_at = NOW(), responded_at = NULL
+			WHERE group_members.status = 'declined'`,
+		groupID, inviteeID, req.Role, userID)
+	if err != nil {
+		log.Printf("Invite member error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "user is already a member or invited"})
+	}
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"user_id": inviteeID,
+		"role":    req.Role,
+		"status":  "pending",
+	})
+}
+
+func updateGroupMember(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	groupID := c.Param("id")
+	memberID := c.Param("userId")
+
+	var req UpdateMemberRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if !isValidGroupRole(req.Role) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "role must be one of: viewer, editor, owner"})
+	}
+
+	if ok, err := requireGroupRole(c, groupID, userID, groupRoleOwner); !ok {
+		return err
+	}
+
+	result, err := db.Exec(
+		`UPDATE group_members SET role=$1 WHERE group_id=$2 AND user_id=$3 AND status <> 'declined'`,
+		req.Role, groupID, memberID)
+	if err != nil && !isInvalidInput(err) {
+		log.Printf("Update member error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "member not found"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "member not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "member updated"})
+}
+
+// removeGroupMember — владелец исключает участника или участник сам выходит из группы.
+func removeGroupMember(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	groupID := c.Param("id")
+	memberID := c.Param("userId")
+
+	minRole := groupRoleOwner
+	if memberID == userID {
+		minRole = groupRoleViewer
+	}
+	if ok, err := requireGroupRole(c, groupID, userID, minRole); !ok {
+		return err
+	}
+
+	result, err := db.Exec(`DELETE FROM group_members WHERE group_id=$1 AND user_id=$2`, groupID, memberID)
+	if err != nil && !isInvalidInput(err) {
+		log.Printf("Remove member error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "member not found"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "member not found"})
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func getInvitations(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	rows, err := db.Query(`
+		SELECT g.id, g.title, m.role, COALESCE(u.username, ''), m.created_at
+		FROM group_members m
+		JOIN groups g ON g.id = m.group_id
+		LEFT JOIN users u ON u.id = m.invited_by
+		WHERE m.user_id=$1 AND m.status='pending' AND g.deleted_at IS NULL
+		ORDER BY m.created_at DESC`,
+		userID)
+	if err != nil {
+		log.Printf("Get invitations error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer rows.Close()
+
+	var invitations []GroupInvitation
+	for rows.Next() {
+		var inv GroupInvitation
+		if err := rows.Scan(&inv.GroupID, &inv.Title, &inv.Role, &inv.InvitedBy, &inv.InvitedAt); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		invitations = append(invitations, inv)
+	}
+	if invitations == nil {
+		invitations = []GroupInvitation{}
+	}
+	return c.JSON(http.StatusOK, invitations)
+}
+
+func acceptInvitation(c echo.Context) error {
+	return respondToInvitation(c, "accepted")
+}
+
+func declineInvitation(c echo.Context) error {
+	return respondToInvitation(c, "declined")
+}
+
+func respondToInvitation(c echo.Context, status string) error {
+	userID := c.Get("user_id").(string)
+	groupID := c.Param("groupId")
+
+	result, err := db.Exec(`
+		UPDATE group_members SET status=$1, responded_at=NOW()
+		WHERE group_id=$2 AND user_id=$3 AND status='pending'
+			AND group_id IN (SELECT id FROM groups WHERE deleted_at IS NULL)`,
+		status, groupID, userID)
+	if err != nil && !isInvalidInput(err) {
+		log.Printf("Respond invitation error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "invitation not found"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "invitation not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "invitation " + status})
+}
+
+// ============ Таски ============
+
+const (
+	taskPriorityLow    = "low"
+	taskPriorityNormal = "normal"
+	taskPriorityHigh   = "high"
+)
+
+func isValidTaskPriority(priority string) bool {
+	return priority == taskPriorityLow || priority == taskPriorityNormal || priority == taskPriorityHigh
+}
+
+const taskColumns = `t.id, t.title, COALESCE(t.description, ''), t.done, t.group_id, t.due_at,
+	t.priority, t.position, t.completed_at, t.created_at,
+	(SELECT COUNT(*) FROM task_items i WHERE i.task_id = t.id),
+	(SELECT COUNT(*) FROM task_items i WHERE i.task_id = t.id AND i.done),
+	t.recurrence, t.series_id, t.occurrence,
+	(SELECT COALESCE(json_agg(json_build_object('id', l.id, 'name', l.name, 'color', l.color) ORDER BY l.name), '[]')
+		FROM task_labels tl JOIN labels l ON l.id = tl.label_id WHERE tl.task_id = t.id)`
+
+// taskSearchVector — выражение полнотекстового индекса задач; должно совпадать с idx_tasks_search.
+const taskSearchVector = `to_tsvector('russian', t.title || ' ' || COALESCE(t.description, ''))`
+
+func scanTask(row interface{ Scan(...interface{}) error }, t *Task) error {
+	var labels []byte
+	err := row.Scan(&t.ID, &t.Title, &t.Description, &t.Done, &t.GroupID, &t.DueAt,
+		&t.Priority, &t.Position, &t.CompletedAt, &t.CreatedAt, &t.ItemsTotal, &t.ItemsDone,
+		&t.Recurrence, &t.SeriesID, &t.Occurrence, &labels)
+	if err != nil {
+		return err
+	}
+	t.Progress = taskProgress(t.Done, t.ItemsTotal, t.ItemsDone)
+	return json.Unmarshal(labels, &t.Labels)
+}
+
+// taskProgress — процент выполнения задачи: по пунктам чек-листа, а без них — по самой задаче.
+func taskProgress(done bool, total, completed int) int {
+	if total == 0 {
+		if done {
+			return 100
+		}
+		return 0
+	}
+	return completed * 100 / total
+}
+
+// taskSorts — допустимые значения ?sort= для списка задач.
+var taskSorts = map[string]string{
+	"position":   "t.position",
+	"due_at":     "t.due_at",
+	"priority":   "CASE t.priority WHEN 'high' THEN 3 WHEN 'normal' THEN 2 ELSE 1 END",
+	"created_at": "t.created_at",
+	"title":      "LOWER(t.title)",
+}
+
+// getTasksByGroup отдаёт задачи группы. Фильтры: ?done=true|false, ?overdue=true,
+// ?due_before=<RFC3339>; сортировка: ?sort=position|due_at|priority|created_at|title, ?order=asc|desc.
+func getTasksByGroup(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	groupID := c.Param("id")
+
+	if ok, err := requireGroupRole(c, groupID, userID, groupRoleViewer); !ok {
+		return err
+	}
+
+	where := []string{"t.group_id = $1", "t.deleted_at IS NULL"}
+	args := []interface{}{groupID}
+
+	if v := c.QueryParam("done"); v != "" {
+		done, err := strconv.ParseBool(v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "done must be true or false"})
+		}
+		args = append(args, done)
+		where = append(where, fmt.Sprintf("t.done = $%d", len(args)))
+	}
+	if c.QueryParam("overdue") == "true" {
+		where = append(where, "NOT t.done AND t.due_at < (NOW() AT TIME ZONE 'UTC')")
+	}
+	if v := c.QueryParam("due_before"); v != "" {
+		dueBefore, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "due_before must be in RFC3339 format"})
+		}
+		args = append(args, dueBefore.UTC())
+		where = append(where, fmt.Sprintf("t.due_at < $%d", len(args)))
+	}
+
+	sort := c.QueryParam("sort")
+	if sort == "" {
+		sort = "position"
+	}
+	sortExpr, ok := taskSorts[sort]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "sort must be one of: position, due_at, priority, created_at, title"})
+	}
+	order := strings.ToUpper(c.QueryParam("order"))
+	if order == "" {
+		order = "ASC"
+	}
+	if order != "ASC" && order != "DESC" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "order must be asc or desc"})
+	}
+
+	rows, err := db.Query(`
+		SELECT `+taskColumns+`
+		FROM tasks t
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY `+sortExpr+` `+order+` NULLS LAST, t.position, t.created_at`,
+		args...)
+	if err != nil {
+		log.Printf("Get tasks error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer rows.Close()
+
+	var tasks []Task
+	for rows.Next() {
+		var t Task
+		if err := scanTask(rows, &t); err != nil {
+			continue
+		}
+		tasks = append(tasks, t)
+	}
+
+	if tasks == nil {
+		tasks = []Task{}
+	}
+	return c.JSON(http.StatusOK, tasks)
+}
+
+func createTask(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	groupID := c.Param("id")
+
+	var req CreateTaskRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if req.Title == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "title cannot be empty"})
+	}
+	if req.Priority == "" {
+		req.Priority = taskPriorityNormal
+	}
+	if !isValidTaskPriority(req.Priority) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "priority must be one of: low, normal, high"})
+	}
+	if req.DueAt != nil {
+		t := req.DueAt.UTC()
+		req.DueAt = &t
+	}
+	var recurrence *string
+	if req.Recurrence != "" {
+		rule, err := parseRecurrence(req.Recurrence)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		}
+		if req.DueAt == nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "due_at is required for recurring tasks"})
+		}
+		normalized := rule.String()
+		recurrence = &normalized
+	}
+
+	if ok, err := requireGroupRole(c, groupID, userID, groupRoleEditor); !ok {
+		return err
+	}
+
+	// Новая задача добавляется в конец ручного порядка группы.
+	// Повторяющаяся задача становится первым вхождением своей серии (series_id = id).
+	var t Task
+	err := scanTask(db.QueryRow(`
+		WITH t AS (
+			INSERT INTO tasks (id, title, description, group_id, done, due_at, priority, position, recurrence, series_id)
+			SELECT n.id, $1, NULLIF($2, ''), $3, false, $4, $5,
+				(SELECT COALESCE(MAX(position), 0) + 1 FROM tasks WHERE group_id = $3),
+				$6::text, CASE WHEN $6::text IS NULL THEN NULL ELSE n.id END
+			FROM (SELECT gen_random_uuid() AS id) n
+			RETURNING *
+		)
+		SELECT `+taskColumns+` FROM t`,
+		req.Title, req.Description, groupID, req.DueAt, req.Priority, recurrence), &t)
+
+	if err != nil {
+		log.Printf("Create task error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	publishTaskEvent(db, groupID, t.ID, "created")
+	return c.JSON(http.StatusCreated, t)
+}
+
+func updateTask(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	taskID := c.Param("id")
+
+	var req UpdateTaskRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+
+	var sets []string
+	var args []interface{}
+	set := func(expr string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, strings.ReplaceAll(expr, "$?", fmt.Sprintf("$%d", len(args))))
+	}
+
+	if req.Title != nil {
+		if *req.Title == "" {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "title cannot be empty"})
+		}
+		set("title = $?", *req.Title)
+	}
+	if req.Description != nil {
+		set("description = NULLIF($?, '')", *req.Description)
+	}
+	if req.Priority != nil {
+		if !isValidTaskPriority(*req.Priority) {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "priority must be one of: low, normal, high"})
+		}
+		set("priority = $?", *req.Priority)
+	}
+	if req.DueAt != nil {
+		var dueAt *time.Time
+		if *req.DueAt != "" {
+			t, err := time.Parse(time.RFC3339, *req.DueAt)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "due_at must be in RFC3339 format"})
+			}
+			t = t.UTC()
+			dueAt = &t
+		}
+		// С новым сроком напоминание нужно отправить заново.
+		set("due_at = $?, reminded_at = NULL", dueAt)
+	}
+	var rule *recurrenceRule
+	if req.Recurrence != nil && *req.Recurrence != "" {
+		r, err := parseRecurrence(*req.Recurrence)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		}
+		rule = &r
+	}
+	if req.Done != nil {
+		// completed_at ставится только при переходе в done и сбрасывается при снятии отметки.
+		set(`completed_at = CASE
+			WHEN $?::boolean AND NOT done THEN NOW() AT TIME ZONE 'UTC'
+			WHEN NOT $?::boolean THEN NULL
+			ELSE completed_at END, done = $?`, *req.Done)
+	}
+
+	if len(sets) == 0 && req.Recurrence == nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "nothing to update"})
+	}
+
+	if ok, err := requireTaskRole(c, taskID, userID, groupRoleEditor); !ok {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Update task error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer tx.Rollback()
+
+	// Даже если меняется только recurrence, UPDATE выполняется: он проверяет,
+	// что задача существует, и возвращает её серию и срок.
+	if len(sets) == 0 {
+		sets = append(sets, "id = id")
+	}
+	args = append(args, taskID)
+	var groupID string
+	var seriesID *string
+	var dueAt *time.Time
+	err = tx.QueryRow(
+		fmt.Sprintf(`UPDATE tasks SET %s WHERE id=$%d RETURNING group_id, series_id, due_at`, strings.Join(sets, ", "), len(args)),
+		args...).Scan(&groupID, &seriesID, &dueAt)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "task not found"})
+	}
+	if err != nil {
+		log.Printf("Update task error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	// Правило повторения общее для всей серии.
+	if req.Recurrence != nil {
+		var recurrence *string
+		if rule != nil {
+			if dueAt == nil {
+				return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "due_at is required for recurring tasks"})
+			}
+			normalized := rule.String()
+			recurrence = &normalized
+		}
+		err := tx.QueryRow(`
+			UPDATE tasks SET recurrence=$1, series_id=COALESCE(series_id, id)
+			WHERE id=$2 OR (series_id IS NOT NULL AND series_id=(SELECT series_id FROM tasks WHERE id=$2))
+			RETURNING (SELECT series_id FROM tasks WHERE id=$2)`,
+			recurrence, taskID).Scan(&seriesID)
+		if err != nil {
+			log.Printf("Update task error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+		if seriesID == nil {
+			seriesID = &taskID
+		}
+	}
+
+	// Выполненное вхождение серии сразу порождает следующее.
+	if req.Done != nil && *req.Done && seriesID != nil {
+		if _, err := materializeSeries(tx, *seriesID, time.Now().UTC()); err != nil {
+			log.Printf("Update task recurrence error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+	}
+
+	publishTaskEvent(tx, groupID, taskID, "updated")
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Update task commit error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "task updated"})
+}
+
+// reorderTasks задаёт ручной порядок задач группы. В task_ids должны быть перечислены
+// все задачи группы ровно по одному разу.
+func reorderTasks(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	groupID := c.Param("id")
+
+	var req ReorderTasksRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+
+	if ok, err := requireGroupRole(c, groupID, userID, groupRoleEditor); !ok {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Reorder tasks error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer tx.Rollback()
+
+	var current []string
+	err = tx.QueryRow(`
+		SELECT COALESCE(array_agg(id::text), '{}') FROM (
+			SELECT id FROM tasks WHERE group_id=$1 AND deleted_at IS NULL FOR UPDATE
+		) t`, groupID).Scan(pq.Array(&current))
+	if err != nil {
+		log.Printf("Reorder tasks error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	inGroup := make(map[string]bool, len(current))
+	for _, id := range current {
+		inGroup[id] = true
+	}
+	if len(req.TaskIDs) != len(current) || len(uniqueStrings(req.TaskIDs)) != len(current) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "task_ids must list every task of the group exactly once"})
+	}
+	for _, id := range req.TaskIDs {
+		if !inGroup[id] {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "task_ids must list every task of the group exactly once"})
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE tasks t SET position = o.pos
+		FROM unnest($1::uuid[]) WITH ORDINALITY AS o(id, pos)
+		WHERE t.id = o.id AND t.group_id = $2`,
+		pq.Array(req.TaskIDs), groupID)
+	if err != nil {
+		log.Printf("Reorder tasks error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	publishTaskEvent(tx, groupID, "", "reordered")
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Reorder tasks commit error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "tasks reordered"})
+}
+
+func deleteTask(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	taskID := c.Param("id")
+
+	if ok, err := requireTaskRole(c, taskID, userID, groupRoleEditor); !ok {
+		return err
+	}
+
+	var groupID string
+	err := db.QueryRow(`UPDATE tasks SET deleted_at=NOW() WHERE id=$1 AND deleted_at IS NULL RETURNING group_id`,
+		taskID).Scan(&groupID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "task not found"})
+	}
+	if err != nil {
+		log.Printf("Delete task error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	publishTaskEvent(db, groupID, taskID, "deleted")
+	return c.NoContent(http.StatusOK)
+}
+
+// ============ Корзина ============
+
+// getTrash возвращает удалённые группы, которыми пользователь владеет, и удалённые задачи
+// из живых групп, где он может редактировать.
+func getTrash(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	rows, err := db.Query(`
+		SELECT 'group', g.id, g.title, NULL::uuid, g.deleted_at
+		FROM groups g
+		WHERE g.deleted_at IS NOT NULL AND (g.user_id = $1 OR EXISTS (
+			SELECT 1 FROM group_members m
+			WHERE m.group_id = g.id AND m.user_id = $1 AND m.status = 'accepted' AND m.role = $2))
+		UNION ALL
+		SELECT 'task', t.id, t.title, t.group_id, t.deleted_at
+		FROM tasks t
+		JOIN groups g ON g.id = t.group_id
+		LEFT JOIN group_members m ON m.group_id = g.id AND m.user_id = $1 AND m.status = 'accepted'
+		WHERE t.deleted_at IS NOT NULL AND g.deleted_at IS NULL
+			AND (g.user_id = $1 OR m.role IN ($2, $3))
+		ORDER BY 5 DESC`,
+		userID, groupRoleOwner, groupRoleEditor)
+	if err != nil {
+		log.Printf("Get trash error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer rows.Close()
+
+	retention := time.Duration(trashRetentionDays) * 24 * time.Hour
+	items := []TrashItem{}
+	for rows.Next() {
+		var item TrashItem
+		if err := rows.Scan(&item.Type, &item.ID, &item.Title, &item.GroupID, &item.DeletedAt); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		item.PurgeAt = item.DeletedAt.Add(retention)
+		items = append(items, item)
+	}
+	return c.JSON(http.StatusOK, items)
+}
+
+// restoreFromTrash восстанавливает группу (нужна роль owner) или задачу (editor в её группе).
+// Задачу из удалённой группы нельзя восстановить, пока не восстановлена сама группа.
+func restoreFromTrash(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	id := c.Param("id")
+
+	switch c.Param("type") {
+	case "group":
+		result, err := db.Exec(`
+			UPDATE groups g SET deleted_at = NULL
+			WHERE g.id = $1 AND g.deleted_at IS NOT NULL AND (g.user_id = $2 OR EXISTS (
+				SELECT 1 FROM group_members m
+				WHERE m.group_id = g.id AND m.user_id = $2 AND m.status = 'accepted' AND m.role = $3))`,
+			id, userID, groupRoleOwner)
+		if err != nil && !isInvalidInput(err) {
+			log.Printf("Restore group error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "group not found in trash"})
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "group not found in trash"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "group restored"})
+
+	case "task":
+		var groupID string
+		err := db.QueryRow(`SELECT group_id FROM tasks WHERE id=$1 AND deleted_at IS NOT NULL`, id).Scan(&groupID)
+		if err == sql.ErrNoRows || isInvalidInput(err) {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "task not found in trash"})
+		}
+		if err != nil {
+			log.Printf("Restore task error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+		if ok, err := requireGroupRole(c, groupID, userID, groupRoleEditor); !ok {
+			return err
+		}
+
+		// Задачу могли уже восстановить параллельно, пока проверялся доступ.
+		result, err := db.Exec(`UPDATE tasks SET deleted_at = NULL WHERE id=$1 AND deleted_at IS NOT NULL`, id)
+		if err != nil {
+			log.Printf("Restore task error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "task not found in trash"})
+		}
+		publishTaskEvent(db, groupID, id, "restored")
+		return c.JSON(http.StatusOK, map[string]string{"message": "task restored"})
+
+	default:
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "type must be group or task"})
+	}
+}
+
+// purgeTrash окончательно удаляет группы и задачи, пролежавшие в корзине дольше trashRetentionDays.
+// Задачи удалённых групп уходят вместе с группой по ON DELETE CASCADE.
+func purgeTrash() (groups, tasks int64, err error) {
+	result, err := db.Exec(`DELETE FROM tasks WHERE deleted_at < NOW() - $1 * INTERVAL '1 day'`, trashRetentionDays)
+	if err != nil {
+		return 0, 0, err
+	}
+	tasks, _ = result.RowsAffected()
+
+	result, err = db.Exec(`DELETE FROM groups WHERE deleted_at < NOW() - $1 * INTERVAL '1 day'`, trashRetentionDays)
+	if err != nil {
+		return 0, tasks, err
+	}
+	groups, _ = result.RowsAffected()
+	return groups, tasks, nil
+}
+
+// runTrashPurge раз в trashPurgeTick очищает корзину.
+func runTrashPurge() {
+	ticker := time.NewTicker(trashPurgeTick)
+	defer ticker.Stop()
+
+	for {
+		groups, tasks, err := purgeTrash()
+		if err != nil {
+			log.Printf("Trash purge error: %v", err)
+		} else if groups > 0 || tasks > 0 {
+			log.Printf("Trash purge: removed %d group(s) and %d task(s)", groups, tasks)
+		}
+		<-ticker.C
+	}
+}
+
+// ============ Повторяющиеся задачи ============
+
+// Поддерживаемое подмножество RFC 5545 RRULE:
+// FREQ=DAILY|WEEKLY|MONTHLY, INTERVAL, BYDAY (для WEEKLY), BYMONTHDAY (для MONTHLY), COUNT, UNTIL.
+// Вместо RRULE можно передать сокращения daily, weekly или monthly.
+
+const (
+	recurrenceTick    = time.Minute
+	recurrenceHorizon = 24 * time.Hour
+	// maxMaterialize ограничивает число вхождений, создаваемых за один проход по серии.
+	maxMaterialize = 100
+)
+
+var weekdayCodes = map[string]time.Weekday{
+	"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday,
+	"FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+type recurrenceRule struct {
+	Freq       string
+	Interval   int
+	ByDay      []time.Weekday
+	ByMonthDay int
+	Count      int
+	Until      *time.Time
+}
+
+func parseRecurrence(value string) (recurrenceRule, error) {
+	rule := recurrenceRule{Interval: 1}
+
+	value = strings.TrimPrefix(strings.TrimSpace(value), "RRULE:")
+	switch strings.ToLower(value) {
+	case "daily", "weekly", "monthly":
+		value = "FREQ=" + strings.ToUpper(value)
+	}
+
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return rule, fmt.Errorf("invalid recurrence rule part %q", part)
+		}
+		key, val := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+
+		switch key {
+		case "FREQ":
+			if val != "DAILY" && val != "WEEKLY" && val != "MONTHLY" {
+				return rule, fmt.Errorf("FREQ must be DAILY, WEEKLY or MONTHLY")
+			}
+			rule.Freq = val
+		case "INTERVAL":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 || n > 365 {
+				return rule, fmt.Errorf("INTERVAL must be between 1 and 365")
+			}
+			rule.Interval = n
+		case "BYDAY":
+			for _, code := range strings.Split(val, ",") {
+				day, ok := weekdayCodes[code]
+				if !ok {
+					return rule, fmt.Errorf("invalid BYDAY value %q", code)
+				}
+				rule.ByDay = append(rule.ByDay, day)
+			}
+		case "BYMONTHDAY":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 || n > 31 {
+				return rule, fmt.Errorf("BYMONTHDAY must be between 1 and 31")
+			}
+			rule.ByMonthDay = n
+		case "COUNT":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return rule, fmt.Errorf("COUNT must be a positive integer")
+			}
+			rule.Count = n
+		case "UNTIL":
+			until, err := time.Parse("20060102T150405Z", val)
+			if err != nil {
+				until, err = time.Parse("20060102", val)
+			}
+			if err != nil {
+				return rule, fmt.Errorf("UNTIL must be YYYYMMDD or YYYYMMDDTHHMMSSZ")
+			}
+			rule.Until = &until
+		default:
+			return rule, fmt.Errorf("unsupported recurrence rule part %s", key)
+		}
+	}
+
+	if rule.Freq == "" {
+		return rule, fmt.Errorf("FREQ is required")
+	}
+	if len(rule.ByDay) > 0 && rule.Freq != "WEEKLY" {
+		return rule, fmt.Errorf("BYDAY is supported only with FREQ=WEEKLY")
+	}
+	if rule.ByMonthDay > 0 && rule.Freq != "MONTHLY" {
+		return rule, fmt.Errorf("BYMONTHDAY is supported only with FREQ=MONTHLY")
+	}
+	if rule.Count > 0 && rule.Until != nil {
+		return rule, fmt.Errorf("COUNT and UNTIL cannot be used together")
+	}
+	return rule, nil
+}
+
+// String возвращает правило в каноническом виде RRULE, в котором оно хранится в БД.
+func (r recurrenceRule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, fmt.Sprintf("INTERVAL=%d", r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		var codes []string
+		for _, code := range []string{"MO", "TU", "WE", "TH", "FR", "SA", "SU"} {
+			for _, d := range r.ByDay {
+				if weekdayCodes[code] == d {
+					codes = append(codes, code)
+					break
+				}
+			}
+		}
+		parts = append(parts, "BYDAY="+strings.Join(codes, ","))
+	}
+	if r.ByMonthDay > 0 {
+		parts = append(parts, fmt.Sprintf("BYMONTHDAY=%d", r.ByMonthDay))
+	}
+	if r.Count > 0 {
+		parts = append(parts, fmt.Sprintf("COUNT=%d", r.Count))
+	}
+	if r.Until != nil {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// next возвращает вхождение, следующее за prev (вхождение номер occurrence).
+// false — серия закончилась по COUNT или UNTIL.
+func (r recurrenceRule) next(prev time.Time, occurrence int) (time.Time, bool) {
+	if r.Count > 0 && occurrence >= r.Count {
+		return time.Time{}, false
+	}
+
+	var next time.Time
+	switch r.Freq {
+	case "DAILY":
+		next = prev.AddDate(0, 0, r.Interval)
+	case "WEEKLY":
+		if len(r.ByDay) == 0 {
+			next = prev.AddDate(0, 0, 7*r.Interval)
+			break
+		}
+		// Неделя начинается с понедельника (WKST=MO): сначала ищем подходящий день
+		// до конца текущей недели, затем — в первой неделе следующего интервала.
+		offset := (int(prev.Weekday()) + 6) % 7
+		for d := 1; d < 7-offset; d++ {
+			if candidate := prev.AddDate(0, 0, d); r.hasDay(candidate.Weekday()) {
+				return r.checkUntil(candidate)
+			}
+		}
+		weekStart := prev.AddDate(0, 0, 7*r.Interval-offset)
+		for d := 0; d < 7; d++ {
+			if candidate := weekStart.AddDate(0, 0, d); r.hasDay(candidate.Weekday()) {
+				next = candidate
+				break
+			}
+		}
+	case "MONTHLY":
+		day := r.ByMonthDay
+		if day == 0 {
+			day = prev.Day()
+		}
+		// Месяцы, в которых нет такого числа, пропускаются, как в RFC 5545.
+		for k := 1; k <= 48; k++ {
+			first := time.Date(prev.Year(), prev.Month()+time.Month(k*r.Interval), 1,
+				prev.Hour(), prev.Minute(), prev.Second(), 0, prev.Location())
+			if day <= first.AddDate(0, 1, -1).Day() {
+				next = first.AddDate(0, 0, day-1)
+				break
+			}
+		}
+	}
+	if next.IsZero() {
+		return next, false
+	}
+	return r.checkUntil(next)
+}
+
+func (r recurrenceRule) hasDay(day time.Weekday) bool {
+	for _, d := range r.ByDay {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+func (r recurrenceRule) checkUntil(t time.Time) (time.Time, bool) {
+	if r.Until != nil && t.After(*r.Until) {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// firstDayOfWeek сообщает, что t — первый день из BYDAY в своей неделе (WKST=MO).
+func (r recurrenceRule) firstDayOfWeek(t time.Time) bool {
+	if !r.hasDay(t.Weekday()) {
+		return false
+	}
+	for d := (int(t.Weekday()) + 6) % 7; d > 0; d-- {
+		if r.hasDay(t.AddDate(0, 0, -d).Weekday()) {
+			return false
+		}
+	}
+	return true
+}
+
+// skipPast переносит prev на последнее вхождение раньше now и возвращает его номер. Пропущенные
+// периоды отсчитываются арифметикой, а не перебором, чтобы давно не открывавшаяся серия
+// не упиралась в maxMaterialize. COUNT и UNTIL дальше проверяет next.
+func (r recurrenceRule) skipPast(prev time.Time, occurrence int, now time.Time) (time.Time, int) {
+	// step сдвигает prev на одно вхождение, если оно ещё в прошлом.
+	step := func() bool {
+		next, ok := r.next(prev, occurrence)
+		if !ok || !next.Before(now) {
+			return false
+		}
+		prev, occurrence = next, occurrence+1
+		return true
+	}
+
+	switch r.Freq {
+	case "DAILY", "WEEKLY":
+		periodDays, perPeriod := r.Interval, 1
+		if r.Freq == "WEEKLY" {
+			periodDays = 7 * r.Interval
+			if len(r.ByDay) > 0 {
+				// Период начинается с понедельника, поэтому выравниваемся на первый день из BYDAY
+				// в неделе: от него каждый период содержит ровно len(ByDay) вхождений.
+				for !r.firstDayOfWeek(prev) {
+					if !step() {
+						return prev, occurrence
+					}
+				}
+				perPeriod = len(r.ByDay)
+			}
+		}
+		k := int(now.Sub(prev)/(24*time.Hour)) / periodDays
+		if k > 0 && !prev.AddDate(0, 0, k*periodDays).Before(now) {
+			k--
+		}
+		if k > 0 {
+			prev, occurrence = prev.AddDate(0, 0, k*periodDays), occurrence+k*perPeriod
+		}
+	case "MONTHLY":
+		day := r.ByMonthDay
+		if day == 0 {
+			day = prev.Day()
+		}
+		if day > 28 {
+			// Такого числа нет в коротких месяцах, и число вхождений за период непостоянно;
+			// вхождений не больше двенадцати в год, поэтому здесь перебор дешёвый.
+			for step() {
+			}
+			return prev, occurrence
+		}
+		if prev.Day() != day && !step() {
+			return prev, occurrence
+		}
+		months := (now.Year()-prev.Year())*12 + int(now.Month()) - int(prev.Month())
+		k := months / r.Interval
+		if k > 0 && !prev.AddDate(0, k*r.Interval, 0).Before(now) {
+			k--
+		}
+		if k > 0 {
+			prev, occurrence = prev.AddDate(0, k*r.Interval, 0), occurrence+k
+		}
+	}
+	// Добираем вхождения внутри последнего периода — их не больше len(ByDay).
+	for step() {
+	}
+	return prev, occurrence
+}
+
+// materializeSeries создаёт следующие вхождения серии: всегда, если открытых (невыполненных)
+// вхождений не осталось, и дополнительно все вхождения со сроком до horizon.
+// Пропущенные вхождения со сроком в прошлом не создаются, удалённое вхождение
+// считается пропущенным. Пункты чек-листа копируются
+// из последнего вхождения. Возвращает число созданных задач.
+func materializeSeries(q queryer, seriesID string, horizon time.Time) (int, error) {
+	var lastID string
+	var recurrence *string
+	var dueAt *time.Time
+	var occurrence, open int
+	err := q.QueryRow(`
+		SELECT id, recurrence, due_at, occurrence,
+			(SELECT COUNT(*) FROM tasks WHERE series_id=$1 AND NOT done AND deleted_at IS NULL)
+		FROM tasks WHERE series_id=$1
+		ORDER BY occurrence DESC LIMIT 1`,
+		seriesID).Scan(&lastID, &recurrence, &dueAt, &occurrence, &open)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if recurrence == nil || dueAt == nil {
+		return 0, nil
+	}
+
+	rule, err := parseRecurrence(*recurrence)
+	if err != nil {
+		return 0, fmt.Errorf("series %s: %v", seriesID, err)
+	}
+
+	now := time.Now().UTC()
+	created := 0
+	prev, occurrence := rule.skipPast(dueAt.UTC(), occurrence, now)
+	for i := 0; i < maxMaterialize; i++ {
+		next, ok := rule.next(prev, occurrence)
+		if !ok {
+			break
+		}
+		occurrence++
+		prev = next
+		if next.Before(now) {
+			continue
+		}
+		if open > 0 && next.After(horizon) {
+			break
+		}
+
+		var newID string
+		err := q.QueryRow(`
+			INSERT INTO tasks (title, description, group_id, done, due_at, priority, position, recurrence, series_id, occurrence)
+			SELECT title, description, group_id, false, $2, priority,
+				(SELECT COALESCE(MAX(position), 0) + 1 FROM tasks WHERE group_id = src.group_id),
+				recurrence, series_id, $3
+			FROM tasks src WHERE src.id = $1
+			ON CONFLICT (series_id, occurrence) DO NOTHING
+			RETURNING id`,
+			lastID, next, occurrence).Scan(&newID)
+		if err == sql.ErrNoRows {
+			// Вхождение уже создано параллельно (другим экземпляром сервера или запросом).
+			open++
+			continue
+		}
+		if err != nil {
+			return created, err
+		}
+
+		_, err = q.Exec(`
+			INSERT INTO task_items (task_id, title, done, position)
+			SELECT $1, title, false, position FROM task_items WHERE task_id = $2`,
+			newID, lastID)
+		if err != nil {
+			return created, err
+		}
+		open++
+		created++
+	}
+	return created, nil
+}
+
+// runRecurrenceScheduler раз в recurrenceTick создаёт вхождения серий на recurrenceHorizon вперёд.
+// Несколько экземпляров сервера могут работать одновременно: дубли отсекает уникальный индекс.
+func runRecurrenceScheduler() {
+	ticker := time.NewTicker(recurrenceTick)
+	defer ticker.Stop()
+
+	for {
+		rows, err := db.Query(`
+			SELECT DISTINCT t.series_id FROM tasks t JOIN groups g ON g.id = t.group_id
+			WHERE t.series_id IS NOT NULL AND t.recurrence IS NOT NULL
+				AND t.deleted_at IS NULL AND g.deleted_at IS NULL`)
+		if err != nil {
+			log.Printf("Recurrence scheduler error: %v", err)
+		} else {
+			var series []string
+			for rows.Next() {
+				var id string
+				if err := rows.Scan(&id); err == nil {
+					series = append(series, id)
+				}
+			}
+			rows.Close()
+
+			horizon := time.Now().UTC().Add(recurrenceHorizon)
+			for _, id := range series {
+				n, err := materializeSeries(db, id, horizon)
+				if err != nil {
+					log.Printf("Recurrence scheduler error: %v", err)
+					continue
+				}
+				if n > 0 {
+					log.Printf("Recurrence scheduler: created %d occurrence(s) of series %s", n, id)
+				}
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// ============ Чек-листы ============
+
+func getTaskItems(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	taskID := c.Param("id")
+
+	if ok, err := requireTaskRole(c, taskID, userID, groupRoleViewer); !ok {
+		return err
+	}
+
+	rows, err := db.Query(
+		`SELECT id, task_id, title, done, position FROM task_items WHERE task_id=$1 ORDER BY position, created_at`,
+		taskID)
+	if err != nil {
+		log.Printf("Get task items error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer rows.Close()
+
+	var items []TaskItem
+	for rows.Next() {
+		var item TaskItem
+		if err := rows.Scan(&item.ID, &item.TaskID, &item.Title, &item.Done, &item.Position); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		items = append(items, item)
+	}
+	if items == nil {
+		items = []TaskItem{}
+	}
+	return c.JSON(http.StatusOK, items)
+}
+
+func createTaskItem(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	taskID := c.Param("id")
+
+	var req TaskItemRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if req.Title == nil || strings.TrimSpace(*req.Title) == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "title cannot be empty"})
+	}
+
+	if ok, err := requireTaskRole(c, taskID, userID, groupRoleEditor); !ok {
+		return err
+	}
+
+	item := TaskItem{TaskID: taskID, Title: strings.TrimSpace(*req.Title)}
+	if req.Done != nil {
+		item.Done = *req.Done
+	}
+	err := db.QueryRow(`
+		INSERT INTO task_items (task_id, title, done, position)
+		VALUES ($1, $2, $3, (SELECT COALESCE(MAX(position), 0) + 1 FROM task_items WHERE task_id = $1))
+		RETURNING id, position`,
+		taskID, item.Title, item.Done).Scan(&item.ID, &item.Position)
+	if err != nil {
+		log.Printf("Create task item error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	return c.JSON(http.StatusCreated, item)
+}
+
+func updateTaskItem(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	taskID := c.Param("id")
+	itemID := c.Param("itemId")
+
+	var req TaskItemRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if req.Title == nil && req.Done == nil && req.Position == nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "nothing to update"})
+	}
+	if req.Title != nil && strings.TrimSpace(*req.Title) == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "title cannot be empty"})
+	}
+
+	if ok, err := requireTaskRole(c, taskID, userID, groupRoleEditor); !ok {
+		return err
+	}
+
+	var item TaskItem
+	err := db.QueryRow(`
+		UPDATE task_items SET
+			title = COALESCE(TRIM($1), title),
+			done = COALESCE($2, done),
+			position = COALESCE($3, position)
+		WHERE id=$4 AND task_id=$5
+		RETURNING id, task_id, title, done, position`,
+		req.Title, req.Done, req.Position, itemID, taskID).Scan(&item.ID, &item.TaskID, &item.Title, &item.Done, &item.Position)
+	if err == sql.ErrNoRows || isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "item not found"})
+	}
+	if err != nil {
+		log.Printf("Update task item error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	return c.JSON(http.StatusOK, item)
+}
+
+func deleteTaskItem(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	taskID := c.Param("id")
+	itemID := c.Param("itemId")
+
+	if ok, err := requireTaskRole(c, taskID, userID, groupRoleEditor); !ok {
+		return err
+	}
+
+	result, err := db.Exec(`DELETE FROM task_items WHERE id=$1 AND task_id=$2`, itemID, taskID)
+	if err != nil && !isInvalidInput(err) {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "item not found"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "item not found"})
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// ============ Метки и поиск задач ============
+
+// labelColorPattern — цвет метки в формате #rrggbb.
+var labelColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+const defaultLabelColor = "#6c757d"
+
+func validateLabel(req *LabelRequest) error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return fmt.Errorf("name cannot be empty")
+	}
+	if len(req.Name) > 50 {
+		return fmt.Errorf("name must be at most 50 characters")
+	}
+	if req.Color == "" {
+		req.Color = defaultLabelColor
+	}
+	if !labelColorPattern.MatchString(req.Color) {
+		return fmt.Errorf("color must be in #rrggbb format")
+	}
+	req.Color = strings.ToLower(req.Color)
+	return nil
+}
+
+func getLabels(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	rows, err := db.Query(`SELECT id, name, color FROM labels WHERE user_id=$1 ORDER BY name`, userID)
+	if err != nil {
+		log.Printf("Get labels error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer rows.Close()
+
+	labels := []Label{}
+	for rows.Next() {
+		var l Label
+		if err := rows.Scan(&l.ID, &l.Name, &l.Color); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		labels = append(labels, l)
+	}
+	return c.JSON(http.StatusOK, labels)
+}
+
+func createLabel(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	var req LabelRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if err := validateLabel(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	l := Label{Name: req.Name, Color: req.Color}
+	err := db.QueryRow(`INSERT INTO labels (user_id, name, color) VALUES ($1, $2, $3) RETURNING id`,
+		userID, l.Name, l.Color).Scan(&l.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return c.JSON(http.StatusConflict, ErrorResponse{Error: "label already exists"})
+		}
+		log.Printf("Create label error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.JSON(http.StatusCreated, l)
+}
+
+func updateLabel(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	labelID := c.Param("id")
+
+	var req LabelRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if err := validateLabel(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	l := Label{ID: labelID, Name: req.Name, Color: req.Color}
+	result, err := db.Exec(`UPDATE labels SET name=$1, color=$2 WHERE id=$3 AND user_id=$4`,
+		l.Name, l.Color, labelID, userID)
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return c.JSON(http.StatusConflict, ErrorResponse{Error: "label already exists"})
+		}
+		if isInvalidInput(err) {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "label not found"})
+		}
+		log.Printf("Update label error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "label not found"})
+	}
+	return c.JSON(http.StatusOK, l)
+}
+
+func deleteLabel(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	labelID := c.Param("id")
+
+	result, err := db.Exec(`DELETE FROM labels WHERE id=$1 AND user_id=$2`, labelID, userID)
+	if err != nil && !isInvalidInput(err) {
+		log.Printf("Delete label error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "label not found"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "label not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "label deleted"})
+}
+
+// addTaskLabel вешает на задачу метку текущего пользователя; нужна роль editor в группе задачи.
+func addTaskLabel(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	taskID := c.Param("id")
+	labelID := c.Param("labelId")
+
+	if ok, err := requireTaskRole(c, taskID, userID, groupRoleEditor); !ok {
+		return err
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO task_labels (task_id, label_id)
+		SELECT $1, id FROM labels WHERE id=$2 AND user_id=$3
+		ON CONFLICT DO NOTHING`,
+		taskID, labelID, userID)
+	if err != nil && !isInvalidInput(err) {
+		log.Printf("Add task label error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "label not found"})
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		var exists bool
+		if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM labels WHERE id=$1 AND user_id=$2)`,
+			labelID, userID).Scan(&exists); err != nil || !exists {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "label not found"})
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "label added"})
+}
+
+// removeTaskLabel снимает метку с задачи; редактор группы может снять и чужую метку.
+func removeTaskLabel(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	taskID := c.Param("id")
+	labelID := c.Param("labelId")
+
+	if ok, err := requireTaskRole(c, taskID, userID, groupRoleEditor); !ok {
+		return err
+	}
+
+	result, err := db.Exec(`DELETE FROM task_labels WHERE task_id=$1 AND label_id=$2`, taskID, labelID)
+	if err != nil && !isInvalidInput(err) {
+		log.Printf("Remove task label error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "label not found"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "label not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "label removed"})
+}
+
+// searchTasks ищет задачи во всех группах, доступных пользователю (своих и принятых приглашений).
+// q — полнотекстовый запрос по названию и описанию, label — имя метки (без учёта регистра).
+// При заданном q результаты упорядочены по релевантности, иначе — по сроку.
+func searchTasks(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	page, limit, err := parsePagination(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	where := []string{`t.deleted_at IS NULL`, `t.group_id IN (
+		SELECT g.id FROM groups g
+		LEFT JOIN group_members m ON m.group_id = g.id AND m.user_id = $1 AND m.status = 'accepted'
+		WHERE (g.user_id = $1 OR m.user_id IS NOT NULL) AND g.deleted_at IS NULL)`}
+	args := []interface{}{userID}
+	orderBy := "t.due_at ASC NULLS LAST, t.created_at DESC"
+
+	if q := strings.TrimSpace(c.QueryParam("q")); q != "" {
+		args = append(args, q)
+		n := len(args)
+		where = append(where, fmt.Sprintf("%s @@ websearch_to_tsquery('russian', $%d)", taskSearchVector, n))
+		orderBy = fmt.Sprintf("ts_rank(%s, websearch_to_tsquery('russian', $%d)) DESC, ", taskSearchVector, n) + orderBy
+	}
+	if v := strings.TrimSpace(c.QueryParam("label")); v != "" {
+		args = append(args, v)
+		where = append(where, fmt.Sprintf(`EXISTS (
+			SELECT 1 FROM task_labels tl JOIN labels l ON l.id = tl.label_id
+			WHERE tl.task_id = t.id AND LOWER(l.name) = LOWER($%d))`, len(args)))
+	}
+	if v := c.QueryParam("done"); v != "" {
+		done, err := strconv.ParseBool(v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "done must be true or false"})
+		}
+		args = append(args, done)
+		where = append(where, fmt.Sprintf("t.done = $%d", len(args)))
+	}
+	if v := c.QueryParam("due_before"); v != "" {
+		dueBefore, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "due_before must be in RFC3339 format"})
+		}
+		args = append(args, dueBefore.UTC())
+		where = append(where, fmt.Sprintf("t.due_at < $%d", len(args)))
+	}
+
+	filter := ` FROM tasks t WHERE ` + strings.Join(where, " AND ")
+
+	result := TaskSearchResult{Items: []Task{}, Page: page, Limit: limit}
+	if err := db.QueryRow(`SELECT COUNT(*)`+filter, args...).Scan(&result.Total); err != nil {
+		log.Printf("Search tasks error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	args = append(args, limit, (page-1)*limit)
+	rows, err := db.Query(`SELECT `+taskColumns+filter+`
+		ORDER BY `+orderBy+`, t.id
+		LIMIT $`+strconv.Itoa(len(args)-1)+` OFFSET $`+strconv.Itoa(len(args)),
+		args...)
+	if err != nil {
+		log.Printf("Search tasks error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Task
+		if err := scanTask(rows, &t); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		result.Items = append(result.Items, t)
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// ============ Уведомления ============
+
+// Уведомления проходят через транзакционный outbox: событие записывается в notification_outbox
+// в той же транзакции, что и изменение, которое его вызвало, по строке на каждый канал.
+// runNotificationDispatcher доставляет их и повторяет неудачные попытки с растущей задержкой.
+//
+// Диспетчер не держит транзакцию на время доставки: он захватывает пачку строк (locked_until),
+// отправляет их и отмечает результат каждой отдельным коротким запросом. Внешние каналы
+// доставляют «хотя бы один раз»: если сервер упал между отправкой и отметкой, строка
+// повторится после истечения захвата (получатель вебхука различает повторы по X-Notification-Id).
+
+const (
+	notifyChannelInApp   = "inapp"
+	notifyChannelEmail   = "email"
+	notifyChannelWebhook = "webhook"
+
+	notificationReviewApproved = "review_approved"
+	notificationOrderStatus    = "order_status"
+	notificationTaskDue        = "task_due"
+
+	notifyTick          = 5 * time.Second
+	notifyBatchSize     = 50
+	notifyClaimTimeout  = 10 * time.Minute
+	notifyMaxAttempts   = 8
+	notifyRetryBase     = 30 * time.Second
+	notifyMaxRetryDelay = 24 * time.Hour
+
+	taskReminderTick = time.Minute
+	taskReminderLead = time.Hour
+)
+
+// outboxMessage — одна доставка уведомления пользователю через конкретный канал.
+type outboxMessage struct {
+	ID       string `json:"id"`
+	UserID   string `json:"user_id"`
+	Channel  string `json:"-"`
+	Kind     string `json:"kind"`
+	Title    string `json:"title"`
+	Body     string `json:"body"`
+	Link     string `json:"link,omitempty"`
+	Attempts int    `json:"-"`
+}
+
+// NotificationChannel доставляет уведомление. Внешние каналы получают db и не должны
+// рассчитывать на транзакцию.
+type NotificationChannel interface {
+	Name() string
+	Deliver(q queryer, msg outboxMessage) error
+}
+
+// dbNotificationChannel — канал, который сам пишет в нашу БД. Его запись и отметка sent_at
+// фиксируются одной короткой транзакцией, поэтому такое уведомление не задвоится.
+type dbNotificationChannel interface {
+	NotificationChannel
+	writesToDB()
+}
+
+// inAppChannel кладёт уведомление во входящие пользователя.
+type inAppChannel struct{}
+
+func (inAppChannel) Name() string { return notifyChannelInApp }
+
+func (inAppChannel) writesToDB() {}
+
+func (inAppChannel) Deliver(q queryer, msg outboxMessage) error {
+	_, err := q.Exec(`
+		INSERT INTO notifications (user_id, kind, title, body, link)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''))`,
+		msg.UserID, msg.Kind, msg.Title, msg.Body, msg.Link)
+	return err
+}
+
+// emailChannel отправляет письмо через mailer; пользователи без email пропускаются.
+type emailChannel struct{}
+
+func (emailChannel) Name() string { return notifyChannelEmail }
+
+func (emailChannel) Deliver(q queryer, msg outboxMessage) error {
+	var email *string
+	err := q.QueryRow(`SELECT email FROM users WHERE id=$1 AND deleted_at IS NULL`, msg.UserID).Scan(&email)
+	if err == sql.ErrNoRows || (err == nil && email == nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	body := msg.Body
+	if msg.Link != "" {
+		body += "\n\n" + strings.TrimRight(os.Getenv("APP_URL"), "/") + msg.Link
+	}
+	return mailer.Send(*email, msg.Title, body)
+}
+
+// webhookChannel отправляет уведомление POST-запросом с JSON. Если задан Secret,
+// тело подписывается HMAC-SHA256 в заголовке X-Signature.
+type webhookChannel struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func (webhookChannel) Name() string { return notifyChannelWebhook }
+
+func (w webhookChannel) Deliver(q queryer, msg outboxMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Notification-Id", msg.ID)
+	if w.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.Secret))
+		mac.Write(payload)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// enqueueNotification записывает уведомление в outbox для всех настроенных каналов.
+// Вызывается в транзакции изменения, чтобы событие не потерялось и не ушло при откате.
+func enqueueNotification(q queryer, userID, kind, title, body, link string) error {
+	if len(notificationChannels) == 0 {
+		return nil
+	}
+	names := make([]string, len(notificationChannels))
+	for i, ch := range notificationChannels {
+		names[i] = ch.Name()
+	}
+
+	_, err := q.Exec(`
+		INSERT INTO notification_outbox (user_id, channel, kind, title, body, link)
+		SELECT $1, channel, $3, $4, $5, NULLIF($6, '') FROM unnest($2::text[]) AS channel`,
+		userID, pq.Array(names), kind, title, body, link)
+	return err
+}
+
+// notifyRetryDelay — задержка перед повторной попыткой: notifyRetryBase, удваиваясь,
+// но не больше notifyMaxRetryDelay.
+func notifyRetryDelay(attempts int) time.Duration {
+	delay := notifyRetryBase
+	for i := 1; i < attempts && delay < notifyMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > notifyMaxRetryDelay {
+		delay = notifyMaxRetryDelay
+	}
+	return delay
+}
+
+// claimNotifications захватывает пачку готовых к отправке сообщений на notifyClaimTimeout.
+// SKIP LOCKED и locked_until позволяют запускать несколько экземпляров сервера одновременно,
+// а захват упавшего экземпляра истекает сам.
+func claimNotifications() ([]outboxMessage, error) {
+	rows, err := db.Query(`
+		WITH claimed AS (
+			UPDATE notification_outbox o SET locked_until = NOW() + $2 * INTERVAL '1 second'
+			WHERE o.id IN (
+				SELECT id FROM notification_outbox
+				WHERE sent_at IS NULL AND failed_at IS NULL AND next_attempt_at <= NOW()
+					AND (locked_until IS NULL OR locked_until <= NOW())
+				ORDER BY created_at
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING o.id, o.user_id, o.channel, o.kind, o.title, o.body, COALESCE(o.link, '') AS link, o.attempts, o.created_at
+		)
+		SELECT id, user_id, channel, kind, title, body, link, attempts FROM claimed ORDER BY created_at`,
+		notifyBatchSize, int(notifyClaimTimeout.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []outboxMessage
+	for rows.Next() {
+		var m outboxMessage
+		if err := rows.Scan(&m.ID, &m.UserID, &m.Channel, &m.Kind, &m.Title, &m.Body, &m.Link, &m.Attempts); err != nil {
+			return nil, err
+		}
+		batch = append(batch, m)
+	}
+	return batch, rows.Err()
+}
+
+func markNotificationSent(q queryer, id string) error {
+	_, err := q.Exec(`
+		UPDATE notification_outbox SET sent_at=NOW(), attempts=attempts+1, locked_until=NULL
+		WHERE id=$1`, id)
+	return err
+}
+
+// deliverNotification отправляет одно сообщение. Только канал, пишущий в нашу БД,
+// работает в транзакции — вместе с отметкой о доставке.
+func deliverNotification(ch NotificationChannel, m outboxMessage) error {
+	if _, ok := ch.(dbNotificationChannel); !ok {
+		if err := ch.Deliver(db, m); err != nil {
+			return err
+		}
+		if err := markNotificationSent(db, m.ID); err != nil {
+			log.Printf("Notification %s was delivered but not marked as sent: %v", m.ID, err)
+		}
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := ch.Deliver(tx, m); err != nil {
+		return err
+	}
+	if err := markNotificationSent(tx, m.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// recordNotificationFailure откладывает следующую попытку или, после notifyMaxAttempts,
+// помечает сообщение как окончательно не доставленное (failed_at).
+func recordNotificationFailure(m outboxMessage, deliverErr error) error {
+	attempts := m.Attempts + 1
+	log.Printf("Notification %s via %s failed (attempt %d): %v", m.ID, m.Channel, attempts, deliverErr)
+	_, err := db.Exec(`
+		UPDATE notification_outbox
+		SET attempts=$2, last_error=$3, next_attempt_at=NOW() + $4 * INTERVAL '1 second',
+			failed_at=CASE WHEN $2 >= $5 THEN NOW() END, locked_until=NULL
+		WHERE id=$1`,
+		m.ID, attempts, deliverErr.Error(), int(notifyRetryDelay(attempts).Seconds()), notifyMaxAttempts)
+	return err
+}
+
+// dispatchNotifications доставляет одну пачку готовых к отправке сообщений outbox
+// и возвращает размер пачки.
+func dispatchNotifications() (int, error) {
+	batch, err := claimNotifications()
+	if err != nil {
+		return 0, err
+	}
+
+	channels := make(map[string]NotificationChannel, len(notificationChannels))
+	for _, ch := range notificationChannels {
+		channels[ch.Name()] = ch
+	}
+
+	for _, m := range batch {
+		deliverErr := fmt.Errorf("channel %s is not configured", m.Channel)
+		if ch, ok := channels[m.Channel]; ok {
+			deliverErr = deliverNotification(ch, m)
+		}
+		if deliverErr == nil {
+			continue
+		}
+		if err := recordNotificationFailure(m, deliverErr); err != nil {
+			return len(batch), err
+		}
+	}
+	return len(batch), nil
+}
+
+// runNotificationDispatcher раз в notifyTick разбирает outbox, пока в нём есть готовые сообщения.
+func runNotificationDispatcher() {
+	ticker := time.NewTicker(notifyTick)
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := dispatchNotifications()
+			if err != nil {
+				log.Printf("Notification dispatcher error: %v", err)
+				break
+			}
+			if n < notifyBatchSize {
+				break
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// sendTaskReminders уведомляет участников группы о задачах, срок которых наступит
+// в ближайший taskReminderLead. Напоминание отправляется один раз за срок (reminded_at).
+func sendTaskReminders() (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		UPDATE tasks t SET reminded_at = NOW() AT TIME ZONE 'UTC'
+		FROM groups g
+		WHERE g.id = t.group_id AND g.deleted_at IS NULL AND t.deleted_at IS NULL
+			AND NOT t.done AND t.reminded_at IS NULL
+			AND t.due_at > NOW() AT TIME ZONE 'UTC'
+			AND t.due_at <= NOW() AT TIME ZONE 'UTC' + $1 * INTERVAL '1 second'
+		RETURNING t.id, t.title, t.due_at, t.group_id`,
+		int(taskReminderLead.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+	type reminder struct {
+		TaskID, Title, GroupID string
+		DueAt                  time.Time
+	}
+	var reminders []reminder
+	for rows.Next() {
+		var r reminder
+		if err := rows.Scan(&r.TaskID, &r.Title, &r.DueAt, &r.GroupID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		reminders = append(reminders, r)
+	}
+	rows.Close()
+
+	for _, r := range reminders {
+		recipients, err := groupRecipients(tx, r.GroupID)
+		if err != nil {
+			return 0, err
+		}
+
+		body := fmt.Sprintf("Срок задачи «%s» — %s UTC.", r.Title, r.DueAt.Format("02.01.2006 15:04"))
+		for _, userID := range recipients {
+			if err := enqueueNotification(tx, userID, notificationTaskDue, "Скоро срок задачи", body, "/todo"); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return len(reminders), tx.Commit()
+}
+
+func runTaskReminders() {
+	ticker := time.NewTicker(taskReminderTick)
+	defer ticker.Stop()
+
+	for {
+		if _, err := sendTaskReminders(); err != nil {
+			log.Printf("Task reminders error: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+func getNotifications(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	page, limit, err := parsePagination(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+	unreadOnly := c.QueryParam("unread") == "true"
+
+	list := NotificationList{Items: []Notification{}, Page: page, Limit: limit}
+	err = db.QueryRow(`
+		SELECT COUNT(*) FILTER (WHERE NOT $2 OR read_at IS NULL), COUNT(*) FILTER (WHERE read_at IS NULL)
+		FROM notifications WHERE user_id=$1`,
+		userID, unreadOnly).Scan(&list.Total, &list.Unread)
+	if err != nil {
+		log.Printf("Get notifications error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	rows, err := db.Query(`
+		SELECT id, kind, title, body, COALESCE(link, ''), read_at, created_at
+		FROM notifications
+		WHERE user_id=$1 AND (NOT $2 OR read_at IS NULL)
+		ORDER BY created_at DESC, id
+		LIMIT $3 OFFSET $4`,
+		userID, unreadOnly, limit, (page-1)*limit)
+	if err != nil {
+		log.Printf("Get notifications error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Kind, &n.Title, &n.Body, &n.Link, &n.ReadAt, &n.CreatedAt); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		list.Items = append(list.Items, n)
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func getUnreadNotificationCount(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM notifications WHERE user_id=$1 AND read_at IS NULL`, userID).Scan(&count)
+	if err != nil {
+		log.Printf("Get unread notifications error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.JSON(http.StatusOK, map[string]int{"unread": count})
+}
+
+func markNotificationRead(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	notificationID := c.Param("id")
+
+	result, err := db.Exec(`
+		UPDATE notifications SET read_at=COALESCE(read_at, NOW())
+		WHERE id=$1 AND user_id=$2`,
+		notificationID, userID)
+	if err != nil && !isInvalidInput(err) {
+		log.Printf("Mark notification read error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "notification not found"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "notification not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "notification marked as read"})
+}
+
+func markAllNotificationsRead(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	result, err := db.Exec(`UPDATE notifications SET read_at=NOW() WHERE user_id=$1 AND read_at IS NULL`, userID)
+	if err != nil {
+		log.Printf("Mark notifications read error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	rows, _ := result.RowsAffected()
+	return c.JSON(http.StatusOK, map[string]int64{"marked": rows})
+}
+
+// ============ События реального времени ============
+
+// События рассылаются через PostgreSQL NOTIFY на канал eventsChannel: listenEvents каждого
+// экземпляра сервера получает их и раздаёт своим подписчикам. NOTIFY внутри транзакции
+// доставляется только после коммита, поэтому события откатившихся изменений не уходят.
+
+const (
+	eventsChannel = "app_events"
+
+	eventReviewCreated      = "review.created"
+	eventReviewModerated    = "review.moderated"
+	eventOrderStatusChanged = "order.status_changed"
+	eventTaskChanged        = "task.changed"
+
+	eventHeartbeat = 25 * time.Second
+	// eventSubscriberBuffer — сколько событий ждут медленного клиента, прежде чем новые начнут отбрасываться.
+	eventSubscriberBuffer = 32
+)
+
+// Event — событие для клиентов. Получатели — пользователи из UserIDs и все, у кого есть Permission.
+// Данные события минимальны (идентификаторы и статусы): клиент сам перезапрашивает нужное.
+type Event struct {
+	Type       string      `json:"type"`
+	Data       interface{} `json:"data"`
+	UserIDs    []string    `json:"user_ids,omitempty"`
+	Permission string      `json:"permission,omitempty"`
+}
+
+// eventMessage — событие, уже подготовленное к отправке клиенту.
+type eventMessage struct {
+	Type string
+	Data []byte
+}
+
+type eventSubscriber struct {
+	userID      string
+	permissions []string
+	ch          chan eventMessage
+}
+
+type eventHub struct {
+	mu   sync.RWMutex
+	subs map[*eventSubscriber]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[*eventSubscriber]struct{})}
+}
+
+func (h *eventHub) subscribe(userID string, permissions []string) *eventSubscriber {
+	sub := &eventSubscriber{userID: userID, permissions: permissions, ch: make(chan eventMessage, eventSubscriberBuffer)}
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *eventHub) unsubscribe(sub *eventSubscriber) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+}
+
+// broadcast отдаёт событие подходящим подписчикам; переполненным подписчикам событие не достаётся.
+func (h *eventHub) broadcast(ev Event) {
+	data, err := json.Marshal(map[string]interface{}{"type": ev.Type, "data": ev.Data})
+	if err != nil {
+		log.Printf("Event marshal error: %v", err)
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for sub := range h.subs {
+		if !ev.deliversTo(sub) {
+			continue
+		}
+		select {
+		case sub.ch <- eventMessage{Type: ev.Type, Data: data}:
+		default:
+		}
+	}
+}
+
+func (ev Event) deliversTo(sub *eventSubscriber) bool {
+	for _, id := range ev.UserIDs {
+		if id == sub.userID {
+			return true
+		}
+	}
+	return ev.Permission != "" && hasPermission(sub.permissions, ev.Permission)
+}
+
+// publishEvent отправляет событие всем экземплярам сервера. q — транзакция изменения
+// (тогда событие уйдёт после коммита) или db. Ошибка публикации не должна ломать запрос,
+// поэтому она только логируется.
+func publishEvent(q queryer, ev Event) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Event marshal error: %v", err)
+		return
+	}
+	if _, err := q.Exec(`SELECT pg_notify($1, $2)`, eventsChannel, string(payload)); err != nil {
+		log.Printf("Publish event error: %v", err)
+	}
+}
+
+// publishTaskEvent сообщает всем участникам группы об изменении задачи.
+func publishTaskEvent(q queryer, groupID, taskID, action string) {
+	recipients, err := groupRecipients(q, groupID)
+	if err != nil {
+		log.Printf("Publish task event error: %v", err)
+		return
+	}
+	publishEvent(q, Event{
+		Type:    eventTaskChanged,
+		Data:    map[string]string{"id": taskID, "group_id": groupID, "action": action},
+		UserIDs: recipients,
+	})
+}
+
+// groupRecipients возвращает владельца группы и всех принявших приглашение участников.
+func groupRecipients(q queryer, groupID string) ([]string, error) {
+	var recipients []string
+	err := q.QueryRow(`
+		SELECT COALESCE(array_agg(user_id::text), '{}') FROM (
+			SELECT user_id FROM groups WHERE id = $1
+			UNION SELECT user_id FROM group_members WHERE group_id = $1 AND status = 'accepted'
+		) u`, groupID).Scan(pq.Array(&recipients))
+	return recipients, err
+}
+
+// listenEvents слушает eventsChannel и раздаёт события локальному хабу.
+// pq.Listener сам переподключается при обрыве соединения.
+func listenEvents(dsn string) {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Event listener error: %v", err)
+		}
+	})
+	if err := listener.Listen(eventsChannel); err != nil {
+		log.Printf("Event listener error: %v", err)
+		return
+	}
+
+	for {
+		select {
+		case n := <-listener.Notify:
+			// nil приходит после переподключения: пропущенные за это время события потеряны.
+			if n == nil {
+				continue
+			}
+			var ev Event
+			if err := json.Unmarshal([]byte(n.Extra), &ev); err != nil {
+				log.Printf("Event decode error: %v", err)
+				continue
+			}
+			events.broadcast(ev)
+		case <-time.After(90 * time.Second):
+			go listener.Ping()
+		}
+	}
+}
+
+// eventTicketTTL — сколько живёт тикет на подключение к потоку событий.
+const eventTicketTTL = 30 * time.Second
+
+// createEventTicket выдаёт одноразовый тикет для GET /api/events?ticket=.
+// Тикет привязан к сессии, в базе хранится только его хэш.
+func createEventTicket(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	sessionID := c.Get("session_id").(string)
+
+	ticket, err := generateSecureToken()
+	if err != nil {
+		log.Printf("Create event ticket error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if _, err := db.Exec(`DELETE FROM event_tickets WHERE expires_at <= NOW()`); err != nil {
+		log.Printf("Create event ticket error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	_, err = db.Exec(`
+		INSERT INTO event_tickets (ticket_hash, user_id, session_id, expires_at)
+		VALUES ($1, $2, $3, NOW() + $4 * INTERVAL '1 second')`,
+		hashToken(ticket), userID, sessionID, int(eventTicketTTL.Seconds()))
+	if err != nil {
+		log.Printf("Create event ticket error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"ticket":     ticket,
+		"expires_in": int(eventTicketTTL.Seconds()),
+	})
+}
+
+// eventTicketAuth — аутентификация потока событий по тикету из query. Тикет гасится при первом
+// использовании, поэтому его попадание в журнал запросов ничего не раскрывает.
+func eventTicketAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ticket := c.QueryParam("ticket")
+		if ticket == "" {
+			return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "missing ticket"})
+		}
+
+		var userID, sessionID string
+		err := db.QueryRow(`
+			DELETE FROM event_tickets WHERE ticket_hash=$1 AND expires_at > NOW()
+			RETURNING user_id, session_id`,
+			hashToken(ticket)).Scan(&userID, &sessionID)
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "invalid or expired ticket"})
+		}
+		if err != nil {
+			log.Printf("Event ticket error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+
+		permissions, err := sessionPermissions(userID, sessionID)
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "session has been revoked"})
+		}
+		if err != nil {
+			log.Printf("Event ticket error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+
+		c.Set("user_id", userID)
+		c.Set("session_id", sessionID)
+		c.Set("permissions", permissions)
+		return next(c)
+	}
+}
+
+// streamEvents — поток Server-Sent Events для текущего пользователя. Поток закрывается
+// через accessTokenTTL: клиент переподключается с новым тикетом, так что отозванная
+// сессия или снятые права перестают получать события.
+func streamEvents(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	permissions, _ := c.Get("permissions").([]string)
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	w.Flush()
+
+	sub := events.subscribe(userID, permissions)
+	defer events.unsubscribe(sub)
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	expire := time.NewTimer(accessTokenTTL)
+	defer expire.Stop()
+
+	ctx := c.Request().Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-expire.C:
+			return nil
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case msg := <-sub.ch:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Type, msg.Data)
+		}
+		w.Flush()
+	}
+}
+
+// ============ Карты товаров ============
+
+func getCart(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	cart, err := loadCart(db, userID)
+	if err != nil {
+		log.Printf("Get cart error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.JSON(http.StatusOK, cart)
+}
+
+// loadCart собирает корзину пользователя вместе с суммами и применённым промокодом.
+func loadCart(q queryer, userID string) (Cart, error) {
+	items, err := loadCartItems(q, userID)
+	if err != nil {
+		return Cart{}, err
+	}
+
+	cart := Cart{Items: items}
+	var available []CartItem
+	for _, item := range items {
+		if item.Available {
+			cart.ItemCount += item.Quantity
+			cart.Subtotal += item.Subtotal
+			available = append(available, item)
+		} else {
+			cart.HasUnavailable = true
+		}
+	}
+
+	promo, err := loadCartPromo(q, userID)
+	if err != nil {
+		return Cart{}, err
+	}
+	if promo != nil {
+		usedTotal, usedByUser, err := promoUsage(q, promo.ID, userID)
+		if err != nil {
+			return Cart{}, err
+		}
+		discount, reason := evaluatePromo(*promo, available, cart.Subtotal, time.Now().UTC(), usedTotal, usedByUser)
+		cart.Promo = &CartPromo{
+			ID:       promo.ID,
+			Code:     promo.Code,
+			Kind:     promo.Kind,
+			Applied:  reason == "",
+			Reason:   reason,
+			Discount: discount,
+		}
+		cart.Discount = discount
+	}
+
+	cart.Total = cart.Subtotal - cart.Discount
+	cart.TotalKopecks = int64(cart.Total) * 100
+	return cart, nil
+}
+
+// loadCartItems возвращает строки корзины с ценой за единицу: базовая цена плюс надбавки
+// варианта и модификаторов. Строки удалённых товаров удаляются каскадом (cart_items_product_id_fkey).
+// Строка недоступна, если товар выключен, если выбранные опции выключены, удалены
+// или больше не проходят ограничения групп товара, а также если остатка не хватает.
+// Точная проверка остатков с блокировкой — при оформлении заказа (reserveStock).
+func loadCartItems(q queryer, userID string) ([]CartItem, error) {
+	rows, err := q.Query(`
+		SELECT c.id, c.product_id, c.variant_id, c.modifier_ids, COALESCE(c.quantity, 1),
+			p.name, COALESCE(p.image_url, ''),
+			p.price + COALESCE(v.price_delta, 0) + COALESCE(m.delta, 0), COALESCE(v.stock, p.stock),
+			p.is_active,
+			COALESCE(v.name, ''), COALESCE(m.names, '{}'),
+			COALESCE(v.is_active, c.variant_id IS NULL)
+			AND (c.variant_id IS NOT NULL OR NOT EXISTS (
+				SELECT 1 FROM product_variants pv WHERE pv.product_id = c.product_id AND pv.is_active))
+			AND m.found = cardinality(c.modifier_ids)
+			AND NOT EXISTS (
+				SELECT 1 FROM modifier_groups g
+				WHERE g.product_id = c.product_id
+				  AND (SELECT COUNT(*) FROM modifiers gm
+				       WHERE gm.group_id = g.id AND gm.is_active AND gm.id = ANY(c.modifier_ids))
+				      NOT BETWEEN g.min_select AND g.max_select)
+		FROM cart_items c
+		JOIN products p ON c.product_id = p.id
+		LEFT JOIN product_variants v ON v.id = c.variant_id
+		LEFT JOIN LATERAL (
+			SELECT SUM(md.price_delta) AS delta, COUNT(*) AS found,
+				array_agg(md.name ORDER BY g.sort_order, md.sort_order, md.name) AS names
+			FROM modifiers md
+			JOIN modifier_groups g ON g.id = md.group_id
+			WHERE md.id = ANY(c.modifier_ids) AND md.is_active AND g.product_id = c.product_id
+		) m ON true
+		WHERE c.user_id=$1
+		ORDER BY c.created_at`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []CartItem{}
+	for rows.Next() {
+		var item CartItem
+		var active, optionsValid bool
+		item.UserID = userID
+
+		if err := rows.Scan(&item.ID, &item.ProductID, &item.VariantID, pq.Array(&item.ModifierIDs), &item.Quantity,
+			&item.Name, &item.Image, &item.Price, &item.Stock, &active,
+			&item.VariantName, pq.Array(&item.Modifiers), &optionsValid); err != nil {
+			return nil, err
+		}
+		if item.ModifierIDs == nil {
+			item.ModifierIDs = []string{}
+		}
+		if item.Modifiers == nil {
+			item.Modifiers = []string{}
+		}
+		if item.Price < 0 {
+			item.Price = 0
+		}
+
+		switch {
+		case !active:
+			item.UnavailableReason = "inactive"
+		case !optionsValid:
+			item.UnavailableReason = "options_unavailable"
+		case item.Stock != nil && *item.Stock == 0:
+			item.UnavailableReason = "out_of_stock"
+		case item.Stock != nil && *item.Stock < item.Quantity:
+			item.UnavailableReason = "insufficient_stock"
+		default:
+			item.Available = true
+		}
+
+		item.Subtotal = item.Price * item.Quantity
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// cartLineName — название позиции для заказа вместе с вариантом и модификаторами,
+// например «Латте (M; овсяное молоко, доп. шот)».
+func cartLineName(item CartItem) string {
+	var options []string
+	if item.VariantName != "" {
+		options = append(options, item.VariantName)
+	}
+	if len(item.Modifiers) > 0 {
+		options = append(options, strings.Join(item.Modifiers, ", "))
+	}
+	if len(options) == 0 {
+		return item.Name
+	}
+	return item.Name + " (" + strings.Join(options, "; ") + ")"
+}
+
+func addToCart(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	var req AddToCartRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if req.ProductID == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid product id"})
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	if req.Quantity < 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "quantity must be > 0"})
+	}
+
+	var isActive bool
+	err := db.QueryRow(`SELECT is_active FROM products WHERE id=$1`, req.ProductID).Scan(&isActive)
+	if err == sql.ErrNoRows || isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "product not found"})
+	}
+	if err != nil {
+		log.Printf("Add to cart error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if !isActive {
+		return c.JSON(http.StatusUnprocessableEntity, ErrorResponse{Error: "product is not available"})
+	}
+
+	variantID, modifierIDs, msg, err := resolveProductOptions(db, req.ProductID, req.VariantID, req.ModifierIDs)
+	if err != nil {
+		log.Printf("Add to cart error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if msg != "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: msg})
+	}
+
+	var stock *int
+	err = db.QueryRow(`
+		SELECT COALESCE((SELECT stock FROM product_variants WHERE id = $2), p.stock)
+		FROM products p WHERE p.id = $1`, req.ProductID, variantID).Scan(&stock)
+	if err != nil {
+		log.Printf("Add to cart error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if stock != nil && *stock == 0 {
+		return c.JSON(http.StatusUnprocessableEntity, ErrorResponse{Error: "product is out of stock"})
+	}
+
+	// Одинаковый товар с одинаковым набором опций увеличивает количество в существующей строке.
+	var cartItemID string
+	var quantity int
+	err = db.QueryRow(
+		`INSERT INTO cart_items (user_id, product_id, variant_id, modifier_ids, quantity) 
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (user_id, product_id, COALESCE(variant_id, '00000000-0000-0000-0000-000000000000'::uuid), modifier_ids) 
+		 DO UPDATE SET quantity = cart_items.quantity + EXCLUDED.quantity
+		 RETURNING id, quantity`,
+		userID, req.ProductID, variantID, pq.Array(modifierIDs), req.Quantity).Scan(&cartItemID, &quantity)
+
+	if err != nil {
+		if strings.Contains(err.Error(), "foreign key") {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "product not found"})
+		}
+		log.Printf("Add to cart error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"id":       cartItemID,
+		"quantity": quantity,
+	})
+}
+
+func updateCartItem(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	itemID := c.Param("itemId")
+
+	var req UpdateCartItemRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if req.Quantity == nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "quantity is required"})
+	}
+	if *req.Quantity < 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "quantity must be >= 0"})
+	}
+
+	if *req.Quantity == 0 {
+		return deleteCartItem(c)
+	}
+
+	result, err := db.Exec(
+		`UPDATE cart_items SET quantity=$1 WHERE id=$2 AND user_id=$3`,
+		*req.Quantity, itemID, userID)
+	if isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "cart item not found"})
+	}
+	if err != nil {
+		log.Printf("Update cart item error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "cart item not found"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"id":       itemID,
+		"quantity": *req.Quantity,
+	})
+}
+
+func deleteCartItem(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	itemID := c.Param("itemId")
+
+	result, err := db.Exec(`DELETE FROM cart_items WHERE id=$1 AND user_id=$2`, itemID, userID)
+	if isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "cart item not found"})
+	}
+	if err != nil {
+		log.Printf("Delete cart item error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "cart item not found"})
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func clearCart(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	result, err := db.Exec(`DELETE FROM cart_items WHERE user_id=$1`, userID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	rows, _ := result.RowsAffected()
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message": "cart cleared",
+		"deleted": rows,
+	})
+}
+
+// ============ Промокоды ============
+
+const (
+	promoKindPercent = "percent"
+	promoKindFixed   = "fixed"
+	promoKindBuyNGet = "buy_n_get_one"
+)
+
+const promoColumns = `id, code, kind, value, product_id, buy_quantity, min_order_total,
+	starts_at, ends_at, max_uses, max_uses_per_user, is_active`
+
+func scanPromo(row interface{ Scan(...interface{}) error }, p *PromoCode) error {
+	return row.Scan(&p.ID, &p.Code, &p.Kind, &p.Value, &p.ProductID, &p.BuyQuantity, &p.MinOrderTotal,
+		&p.StartsAt, &p.EndsAt, &p.MaxUses, &p.MaxUsesPerUser, &p.IsActive)
+}
+
+// evaluatePromo считает скидку по промокоду для доступных позиций корзины.
+// Если промокод сейчас неприменим, скидка равна 0, а вторым значением возвращается причина.
+func evaluatePromo(p PromoCode, items []CartItem, subtotal int, now time.Time, usedTotal, usedByUser int) (int, string) {
+	if !p.IsActive {
+		return 0, "promo code is not active"
+	}
+	if p.StartsAt != nil && now.Before(*p.StartsAt) {
+		return 0, "promo code is not valid yet"
+	}
+	if p.EndsAt != nil && !now.Before(*p.EndsAt) {
+		return 0, "promo code has expired"
+	}
+	if p.MaxUses != nil && usedTotal >= *p.MaxUses {
+		return 0, "promo code usage limit reached"
+	}
+	if p.MaxUsesPerUser != nil && usedByUser >= *p.MaxUsesPerUser {
+		return 0, "you have already used this promo code"
+	}
+	if subtotal < p.MinOrderTotal {
+		return 0, fmt.Sprintf("order total must be at least %d", p.MinOrderTotal)
+	}
+
+	discount := 0
+	switch p.Kind {
+	case promoKindPercent:
+		discount = subtotal * p.Value / 100
+	case promoKindFixed:
+		discount = p.Value
+	case promoKindBuyNGet:
+		// За каждые buy_quantity оплаченных единиц товара следующая бесплатна. Единицы считаются
+		// по всем строкам товара вместе, бесплатными становятся самые дешёвые из них.
+		var eligible []CartItem
+		units := 0
+		for _, item := range items {
+			if p.ProductID != nil && item.ProductID == *p.ProductID {
+				eligible = append(eligible, item)
+				units += item.Quantity
+			}
+		}
+		sort.SliceStable(eligible, func(i, j int) bool { return eligible[i].Price < eligible[j].Price })
+		free := units / (p.BuyQuantity + 1)
+		for _, item := range eligible {
+			n := item.Quantity
+			if n > free {
+				n = free
+			}
+			discount += n * item.Price
+			free -= n
+		}
+		if discount == 0 {
+			return 0, "cart has no eligible products for this promo code"
+		}
+	default:
+		return 0, "unknown promo code kind"
+	}
+
+	if discount > subtotal {
+		discount = subtotal
+	}
+	return discount, ""
+}
+
+func loadCartPromo(q queryer, userID string) (*PromoCode, error) {
+	var p PromoCode
+	err := scanPromo(q.QueryRow(`
+		SELECT `+promoColumns+`
+		FROM promo_codes
+		WHERE id = (SELECT promo_id FROM cart_promos WHERE user_id=$1)`,
+		userID), &p)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func promoUsage(q queryer, promoID, userID string) (int, int, error) {
+	var total, byUser int
+	err := q.QueryRow(`
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE user_id=$2)
+		FROM promo_redemptions WHERE promo_id=$1`,
+		promoID, userID).Scan(&total, &byUser)
+	return total, byUser, err
+}
+
+func applyCartPromo(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	var req ApplyPromoRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	code := strings.TrimSpace(req.Code)
+	if code == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "code cannot be empty"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Apply promo error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer tx.Rollback()
+
+	var promoID string
+	err = tx.QueryRow(`SELECT id FROM promo_codes WHERE UPPER(code) = UPPER($1)`, code).Scan(&promoID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "promo code not found"})
+	}
+	if err != nil {
+		log.Printf("Apply promo error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO cart_promos (user_id, promo_id) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET promo_id = EXCLUDED.promo_id, applied_at = NOW()`,
+		userID, promoID)
+	if err != nil {
+		log.Printf("Apply promo error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	cart, err := loadCart(tx, userID)
+	if err != nil {
+		log.Printf("Apply promo error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if !cart.Promo.Applied {
+		return c.JSON(http.StatusUnprocessableEntity, ErrorResponse{Error: cart.Promo.Reason})
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Apply promo commit error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.JSON(http.StatusOK, cart)
+}
+
+func removeCartPromo(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	if _, err := db.Exec(`DELETE FROM cart_promos WHERE user_id=$1`, userID); err != nil {
+		log.Printf("Remove promo error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	cart, err := loadCart(db, userID)
+	if err != nil {
+		log.Printf("Remove promo error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.JSON(http.StatusOK, cart)
+}
+
+func getAdminPromos(c echo.Context) error {
+	rows, err := db.Query(`
+		SELECT ` + promoColumns + `,
+			(SELECT COUNT(*) FROM promo_redemptions r WHERE r.promo_id = promo_codes.id)
+		FROM promo_codes
+		ORDER BY created_at DESC`)
+	if err != nil {
+		log.Printf("Get promos error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer rows.Close()
+
+	var promos []PromoCode
+	for rows.Next() {
+		var p PromoCode
+		if err := rows.Scan(&p.ID, &p.Code, &p.Kind, &p.Value, &p.ProductID, &p.BuyQuantity, &p.MinOrderTotal,
+			&p.StartsAt, &p.EndsAt, &p.MaxUses, &p.MaxUsesPerUser, &p.IsActive, &p.UsedCount); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		promos = append(promos, p)
+	}
+	if promos == nil {
+		promos = []PromoCode{}
+	}
+	return c.JSON(http.StatusOK, promos)
+}
+
+func createPromo(c echo.Context) error {
+	var req PromoRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if err := validatePromoRequest(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	var promoID string
+	err := db.QueryRow(`
+		INSERT INTO promo_codes (code, kind, value, product_id, buy_quantity, min_order_total,
+			starts_at, ends_at, max_uses, max_uses_per_user, is_active)
+		VALUES ($1, $2, $3, NULLIF($4, '')::uuid, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
+		req.Code, req.Kind, req.Value, req.ProductID, req.BuyQuantity, req.MinOrderTotal,
+		req.StartsAt, req.EndsAt, req.MaxUses, req.MaxUsesPerUser, req.IsActive).Scan(&promoID)
+
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return c.JSON(http.StatusConflict, ErrorResponse{Error: "promo code already exists"})
+		}
+		if strings.Contains(err.Error(), "foreign key") {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "product not found"})
+		}
+		log.Printf("Create promo error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"id": promoID,
+	})
+}
+
+func updatePromo(c echo.Context) error {
+	promoID := c.Param("id")
+
+	var req PromoRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if err := validatePromoRequest(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	result, err := db.Exec(`
+		UPDATE promo_codes SET code=$1, kind=$2, value=$3, product_id=NULLIF($4, '')::uuid, buy_quantity=$5,
+			min_order_total=$6, starts_at=$7, ends_at=$8, max_uses=$9, max_uses_per_user=$10, is_active=$11,
+			updated_at=NOW()
+		WHERE id=$12`,
+		req.Code, req.Kind, req.Value, req.ProductID, req.BuyQuantity, req.MinOrderTotal,
+		req.StartsAt, req.EndsAt, req.MaxUses, req.MaxUsesPerUser, req.IsActive, promoID)
+
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return c.JSON(http.StatusConflict, ErrorResponse{Error: "promo code already exists"})
+		}
+		if strings.Contains(err.Error(), "foreign key") {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "product not found"})
+		}
+		log.Printf("Update promo error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "promo code not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "promo code updated"})
+}
+
+func deletePromo(c echo.Context) error {
+	promoID := c.Param("id")
+	result, err := db.Exec(`DELETE FROM promo_codes WHERE id=$1`, promoID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "promo code not found"})
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// validatePromoRequest проверяет параметры промокода и приводит даты к UTC,
+// так как в БД они хранятся как TIMESTAMP WITHOUT TIME ZONE.
+func validatePromoRequest(req *PromoRequest) error {
+	req.Code = strings.TrimSpace(req.Code)
+	if req.Code == "" || len(req.Code) > 50 {
+		return fmt.Errorf("code must be between 1 and 50 characters")
+	}
+
+	switch req.Kind {
+	case promoKindPercent:
+		if req.Value < 1 || req.Value > 100 {
+			return fmt.Errorf("percent value must be between 1 and 100")
+		}
+	case promoKindFixed:
+		if req.Value < 1 {
+			return fmt.Errorf("fixed value must be > 0")
+		}
+	case promoKindBuyNGet:
+		if req.ProductID == "" {
+			return fmt.Errorf("product_id is required for buy_n_get_one")
+		}
+		if req.BuyQuantity < 1 {
+			return fmt.Errorf("buy_quantity must be > 0")
+		}
+	default:
+		return fmt.Errorf("kind must be one of: percent, fixed, buy_n_get_one")
+	}
+
+	if req.MinOrderTotal < 0 {
+		return fmt.Errorf("min_order_total must be >= 0")
+	}
+	if req.MaxUses != nil && *req.MaxUses < 1 {
+		return fmt.Errorf("max_uses must be > 0")
+	}
+	if req.MaxUsesPerUser != nil && *req.MaxUsesPerUser < 1 {
+		return fmt.Errorf("max_uses_per_user must be > 0")
+	}
+	if req.StartsAt != nil {
+		t := req.StartsAt.UTC()
+		req.StartsAt = &t
+	}
+	if req.EndsAt != nil {
+		t := req.EndsAt.UTC()
+		req.EndsAt = &t
+	}
+	if req.StartsAt != nil && req.EndsAt != nil && !req.EndsAt.After(*req.StartsAt) {
+		return fmt.Errorf("ends_at must be after starts_at")
+	}
+	return nil
+}
+
+// ============ Заказы ============
+
+func createOrder(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Create order error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer tx.Rollback()
+
+	// Блокируем строки корзины и промокод, чтобы параллельный checkout не задвоил заказ
+	// и не превысил лимит использований промокода.
+	if _, err := tx.Exec(`SELECT id FROM cart_items WHERE user_id=$1 FOR UPDATE`, userID); err != nil {
+		log.Printf("Create order error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if _, err := tx.Exec(`
+		SELECT pc.id FROM cart_promos cp
+		JOIN promo_codes pc ON pc.id = cp.promo_id
+		WHERE cp.user_id=$1
+		FOR UPDATE OF pc`, userID); err != nil {
+		log.Printf("Create order error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	cart, err := loadCart(tx, userID)
+	if err != nil {
+		log.Printf("Create order error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if len(cart.Items) == 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "cart is empty"})
+	}
+	if cart.HasUnavailable {
+		return c.JSON(http.StatusUnprocessableEntity, ErrorResponse{Error: "cart contains unavailable products"})
+	}
+	if cart.Promo != nil && !cart.Promo.Applied {
+		return c.JSON(http.StatusUnprocessableEntity, ErrorResponse{Error: cart.Promo.Reason})
+	}
+
+	order := Order{
+		UserID:   userID,
+		Status:   "new",
+		Subtotal: cart.Subtotal,
+		Discount: cart.Discount,
+		Total:    cart.Total,
+	}
+	if cart.Promo != nil {
+		order.PromoCode = &cart.Promo.Code
+	}
+
+	err = tx.QueryRow(
+		`INSERT INTO orders (user_id, status, subtotal, discount, promo_code, total) 
+		 VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at`,
+		userID, order.Status, order.Subtotal, order.Discount, order.PromoCode, order.Total).Scan(&order.ID, &order.CreatedAt)
+	if err != nil {
+		log.Printf("Create order error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO order_status_history (order_id, from_status, to_status, changed_by) VALUES ($1, NULL, $2, $3)`,
+		order.ID, order.Status, userID)
+	if err != nil {
+		log.Printf("Create order history error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	items := make([]OrderItem, 0, len(cart.Items))
+	for _, line := range cart.Items {
+		productID := line.ProductID
+		item := OrderItem{ProductID: &productID, VariantID: line.VariantID, Name: cartLineName(line), Price: line.Price, Quantity: line.Quantity}
+		err := tx.QueryRow(
+			`INSERT INTO order_items (order_id, product_id, variant_id, name, price, quantity) 
+			 VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+			order.ID, item.ProductID, item.VariantID, item.Name, item.Price, item.Quantity).Scan(&item.ID)
+		if err != nil {
+			log.Printf("Create order item error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+		items = append(items, item)
+	}
+
+	msg, err := reserveStock(tx, order.ID, userID, cart.Items)
+	if err != nil {
+		log.Printf("Create order stock error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if msg != "" {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: msg})
+	}
+
+	if cart.Promo != nil {
+		if _, err := tx.Exec(
+			`INSERT INTO promo_redemptions (promo_id, user_id, order_id) VALUES ($1, $2, $3)`,
+			cart.Promo.ID, userID, order.ID); err != nil {
+			log.Printf("Create order promo error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM cart_items WHERE user_id=$1`, userID); err != nil {
+		log.Printf("Create order error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if _, err := tx.Exec(`DELETE FROM cart_promos WHERE user_id=$1`, userID); err != nil {
+		log.Printf("Create order error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Create order commit error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	order.Items = items
+	return c.JSON(http.StatusCreated, order)
+}
+
+func getOrders(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	rows, err := db.Query(
+		`SELECT id, status, subtotal, discount, promo_code, total, created_at FROM orders WHERE user_id=$1 ORDER BY created_at DESC`,
+		userID)
+	if err != nil {
+		log.Printf("Get orders error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer rows.Close()
+
+	var orders []Order
+	for rows.Next() {
+		var o Order
+		if err := rows.Scan(&o.ID, &o.Status, &o.Subtotal, &o.Discount, &o.PromoCode, &o.Total, &o.CreatedAt); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		o.UserID = userID
+		orders = append(orders, o)
+	}
+
+	if orders == nil {
+		orders = []Order{}
+	}
+	return c.JSON(http.StatusOK, orders)
+}
+
+func getOrder(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	orderID := c.Param("id")
+
+	var o Order
+	err := db.QueryRow(
+		`SELECT id, user_id, status, subtotal, discount, promo_code, total, created_at FROM orders WHERE id=$1 AND user_id=$2`,
+		orderID, userID).Scan(&o.ID, &o.UserID, &o.Status, &o.Subtotal, &o.Discount, &o.PromoCode, &o.Total, &o.CreatedAt)
+	if err == sql.ErrNoRows || isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "order not found"})
+	}
+	if err != nil {
+		log.Printf("Get order error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	o.Items, err = loadOrderItems(o.ID)
+	if err != nil {
+		log.Printf("Get order items error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	return c.JSON(http.StatusOK, o)
+}
+
+func loadOrderItems(orderID string) ([]OrderItem, error) {
+	rows, err := db.Query(
+		`SELECT id, product_id, variant_id, name, price, quantity FROM order_items WHERE order_id=$1 ORDER BY name`,
+		orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []OrderItem{}
+	for rows.Next() {
+		var item OrderItem
+		if err := rows.Scan(&item.ID, &item.ProductID, &item.VariantID, &item.Name, &item.Price, &item.Quantity); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// ============ Статусы заказов ============
+
+// orderTransitions описывает допустимые переходы между статусами заказа.
+var orderTransitions = map[string][]string{
+	"new":       {"accepted", "cancelled"},
+	"accepted":  {"preparing", "cancelled"},
+	"preparing": {"ready", "cancelled"},
+	"ready":     {"completed"},
+	"completed": {},
+	"cancelled": {},
+}
+
+// orderStatusNotifications — статусы, о переходе в которые уведомляем покупателя;
+// в Body подставляется начало номера заказа.
+var orderStatusNotifications = map[string]struct{ Title, Body string }{
+	"ready":     {"Ваш заказ готов", "Заказ №%s готов, его можно забирать."},
+	"cancelled": {"Ваш заказ отменён", "Заказ №%s отменён."},
+}
+
+func isValidOrderStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+func canTransitionOrder(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+func getAdminOrders(c echo.Context) error {
+	status := c.QueryParam("status")
+	if status != "" && !isValidOrderStatus(status) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid status"})
+	}
+
+	rows, err := db.Query(`
+		SELECT id, user_id, status, subtotal, discount, promo_code, total, created_at
+		FROM orders
+		WHERE $1 = '' OR status = $1
+		ORDER BY created_at DESC
+	`, status)
+	if err != nil {
+		log.Printf("Get admin orders error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer rows.Close()
+
+	var orders []Order
+	for rows.Next() {
+		var o Order
+		if err := rows.Scan(&o.ID, &o.UserID, &o.Status, &o.Subtotal, &o.Discount, &o.PromoCode, &o.Total, &o.CreatedAt); err != nil {
+			continue
+		}
+		orders = append(orders, o)
+	}
+	if orders == nil {
+		orders = []Order{}
+	}
+	return c.JSON(http.StatusOK, orders)
+}
+
+func getAdminOrder(c echo.Context) error {
+	orderID := c.Param("id")
+
+	var o Order
+	err := db.QueryRow(
+		`SELECT id, user_id, status, subtotal, discount, promo_code, total, created_at FROM orders WHERE id=$1`,
+		orderID).Scan(&o.ID, &o.UserID, &o.Status, &o.Subtotal, &o.Discount, &o.PromoCode, &o.Total, &o.CreatedAt)
+	if err == sql.ErrNoRows || isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "order not found"})
+	}
+	if err != nil {
+		log.Printf("Get admin order error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if o.Items, err = loadOrderItems(o.ID); err != nil {
+		log.Printf("Get order items error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if o.History, err = loadOrderHistory(o.ID); err != nil {
+		log.Printf("Get order history error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	return c.JSON(http.StatusOK, o)
+}
+
+func transitionOrder(c echo.Context) error {
+	adminID := c.Get("user_id").(string)
+	orderID := c.Param("id")
+
+	var req OrderTransitionRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if !isValidOrderStatus(req.Status) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid status"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Transition order error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer tx.Rollback()
+
+	var o Order
+	err = tx.QueryRow(
+		`SELECT id, user_id, status, subtotal, discount, promo_code, total, created_at FROM orders WHERE id=$1 FOR UPDATE`,
+		orderID).Scan(&o.ID, &o.UserID, &o.Status, &o.Subtotal, &o.Discount, &o.PromoCode, &o.Total, &o.CreatedAt)
+	if err == sql.ErrNoRows || isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "order not found"})
+	}
+	if err != nil {
+		log.Printf("Transition order error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if !canTransitionOrder(o.Status, req.Status) {
+		return c.JSON(http.StatusConflict, ErrorResponse{
+			Error: fmt.Sprintf("cannot move order from %s to %s", o.Status, req.Status),
+		})
+	}
+
+	if _, err := tx.Exec(
+		`UPDATE orders SET status=$1, updated_at=NOW() WHERE id=$2`,
+		req.Status, o.ID); err != nil {
+		log.Printf("Transition order error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if _, err := tx.Exec(
+		`INSERT INTO order_status_history (order_id, from_status, to_status, changed_by) VALUES ($1, $2, $3, $4)`,
+		o.ID, o.Status, req.Status, adminID); err != nil {
+		log.Printf("Transition order history error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if req.Status == "cancelled" {
+		if err := restockOrder(tx, o.ID, adminID); err != nil {
+			log.Printf("Transition order restock error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+	}
+
+	publishEvent(tx, Event{
+		Type:       eventOrderStatusChanged,
+		Data:       map[string]string{"id": o.ID, "from": o.Status, "status": req.Status},
+		UserIDs:    []string{o.UserID},
+		Permission: permOrdersManage,
+	})
+
+	if n, ok := orderStatusNotifications[req.Status]; ok {
+		body := fmt.Sprintf(n.Body, o.ID[:8])
+		if err := enqueueNotification(tx, o.UserID, notificationOrderStatus, n.Title, body, ""); err != nil {
+			log.Printf("Transition order notification error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Transition order commit error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	o.Status = req.Status
+	return c.JSON(http.StatusOK, o)
+}
+
+func loadOrderHistory(orderID string) ([]OrderStatusChange, error) {
+	rows, err := db.Query(
+		`SELECT from_status, to_status, changed_by, changed_at 
+		 FROM order_status_history WHERE order_id=$1 ORDER BY changed_at, id`,
+		orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []OrderStatusChange{}
+	for rows.Next() {
+		var h OrderStatusChange
+		if err := rows.Scan(&h.FromStatus, &h.ToStatus, &h.ChangedBy, &h.ChangedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, h)
+	}
+	return history, rows.Err()
+}
+
+// ============ Продукты ============
+
+// productColumns включает средний рейтинг и число одобренных отзывов товара
+// и используется вместе с productRatingJoin.
+const productColumns = `p.id, p.name, COALESCE(p.description, ''), p.price, COALESCE(p.image_url, ''), p.is_active,
+	ARRAY(SELECT pc.category_id::text FROM product_categories pc WHERE pc.product_id = p.id ORDER BY pc.category_id),
+	COALESCE(rs.avg_rating, 0), COALESCE(rs.review_count, 0), COALESCE(p.thumbnail_url, ''),
+	p.stock, ` + productInStock
+
+// productInStock — есть ли товар в наличии. У товара с вариантами должен быть в наличии хотя бы
+// один активный вариант; вариант без своего учёта берёт остаток товара, NULL означает «без учёта».
+const productInStock = `CASE
+		WHEN EXISTS(SELECT 1 FROM product_variants v WHERE v.product_id = p.id AND v.is_active)
+		THEN EXISTS(SELECT 1 FROM product_variants v WHERE v.product_id = p.id AND v.is_active AND COALESCE(v.stock, p.stock, 1) > 0)
+		ELSE COALESCE(p.stock, 1) > 0
+	END`
+
+const productRatingJoin = ` LEFT JOIN LATERAL (
+		SELECT ROUND(AVG(r.rating), 2)::float8 AS avg_rating, COUNT(*) AS review_count
+		FROM reviews r WHERE r.product_id = p.id AND r.status = 'approved'
+	) rs ON true`
+
+func scanProduct(row interface{ Scan(...interface{}) error }, p *Product, extra ...interface{}) error {
+	dest := []interface{}{&p.ID, &p.Name, &p.Description, &p.Price, &p.ImageURL, &p.IsActive,
+		pq.Array(&p.CategoryIDs), &p.AvgRating, &p.ReviewCount, &p.ThumbURL, &p.Stock, &p.InStock}
+	return row.Scan(append(dest, extra...)...)
+}
+
+// productSearchVector — выражение полнотекстового индекса товаров; должно совпадать с idx_products_search.
+const productSearchVector = `to_tsvector('russian', p.name || ' ' || COALESCE(p.description, ''))`
+
+// productSorts — допустимые сортировки списка товаров. Выражение приводится к Type
+// при сравнении с ключом курсора.
+var productSorts = map[string]struct {
+	Expr, Type, DefaultOrder string
+}{
+	"newest": {"p.created_at", "timestamp", "DESC"},
+	"price":  {"p.price", "integer", "ASC"},
+	"name":   {"p.name", "text", "ASC"},
+	"rating": {"COALESCE(rs.avg_rating, 0)", "float8", "DESC"},
+}
+
+// productCursor — позиция в списке товаров: значение ключа сортировки и id последнего товара страницы.
+type productCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   string `json:"id"`
+}
+
+func encodeProductCursor(cur productCursor) string {
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeProductCursor(value string) (productCursor, error) {
+	var cur productCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err == nil {
+		err = json.Unmarshal(data, &cur)
+	}
+	if err != nil || cur.ID == "" {
+		return cur, fmt.Errorf("invalid cursor")
+	}
+	return cur, nil
+}
+
+// getProducts — публичный каталог: только активные товары.
+func getProducts(c echo.Context) error {
+	return listProducts(c, false)
+}
+
+// getAdminProducts — все товары, с фильтром ?active=true|false.
+func getAdminProducts(c echo.Context) error {
+	return listProducts(c, true)
+}
+
+// listProducts отдаёт страницу товаров с фильтрами q (полнотекстовый поиск по названию и описанию),
+// category (slug, вместе с подкатегориями), min_price, max_price, in_stock и сортировкой sort/order.
+// Пагинация курсорная: next_cursor передаётся в ?cursor= для следующей страницы.
+func listProducts(c echo.Context, admin bool) error {
+	limit := 20
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "limit must be between 1 and 100"})
+		}
+		limit = n
+	}
+
+	var where []string
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if !admin {
+		where = append(where, "p.is_active = true")
+	} else if v := c.QueryParam("active"); v != "" {
+		active, err := strconv.ParseBool(v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "active must be true or false"})
+		}
+		where = append(where, "p.is_active = "+arg(active))
+	}
+
+	if q := strings.TrimSpace(c.QueryParam("q")); q != "" {
+		where = append(where, fmt.Sprintf("%s @@ websearch_to_tsquery('russian', %s)", productSearchVector, arg(q)))
+	}
+
+	if slug := c.QueryParam("category"); slug != "" {
+		var exists bool
+		err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM categories WHERE slug=$1 AND ($2 OR is_active))`, slug, admin).Scan(&exists)
+		if err != nil {
+			log.Printf("Get products error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+		if !exists {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "category not found"})
+		}
+		slugArg, adminArg := arg(slug), arg(admin)
+		where = append(where, `p.id IN (
+			WITH RECURSIVE tree AS (
+				SELECT id FROM categories WHERE slug = `+slugArg+`
+				UNION ALL
+				SELECT c.id FROM categories c JOIN tree ON c.parent_id = tree.id WHERE `+adminArg+` OR c.is_active
+			)
+			SELECT pc.product_id FROM product_categories pc JOIN tree ON tree.id = pc.category_id)`)
+	}
+
+	if v := c.QueryParam("in_stock"); v != "" {
+		inStock, err := strconv.ParseBool(v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "in_stock must be true or false"})
+		}
+		where = append(where, "("+productInStock+") = "+arg(inStock))
+	}
+
+	for _, bound := range []struct{ param, op string }{{"min_price", ">="}, {"max_price", "<="}} {
+		if v := c.QueryParam(bound.param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return c.JSON(http.StatusBadRequest, ErrorResponse{Error: bound.param + " must be a non-negative integer"})
+			}
+			where = append(where, fmt.Sprintf("p.price %s %s", bound.op, arg(n)))
+		}
+	}
+
+	sortName := c.QueryParam("sort")
+	if sortName == "" {
+		sortName = "newest"
+	}
+	sort, ok := productSorts[sortName]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "sort must be one of: newest, price, name, rating"})
+	}
+	order := strings.ToUpper(c.QueryParam("order"))
+	if order == "" {
+		order = sort.DefaultOrder
+	}
+	if order != "ASC" && order != "DESC" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "order must be asc or desc"})
+	}
+
+	filter := " FROM products p" + productRatingJoin
+	if len(where) > 0 {
+		filter += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	list := ProductList{Items: []Product{}, Limit: limit}
+	if err := db.QueryRow(`SELECT COUNT(*)`+filter, args...).Scan(&list.Total); err != nil {
+		log.Printf("Get products error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	// Курсор привязан к сортировке: при её смене клиент должен начать с первой страницы.
+	cursorSort := sortName + ":" + order
+	if v := c.QueryParam("cursor"); v != "" {
+		cur, err := decodeProductCursor(v)
+		if err != nil || cur.Sort != cursorSort {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid cursor"})
+		}
+		cmp := ">"
+		if order == "DESC" {
+			cmp = "<"
+		}
+		cond := fmt.Sprintf("(%s, p.id) %s (%s::%s, %s::uuid)", sort.Expr, cmp, arg(cur.Key), sort.Type, arg(cur.ID))
+		if len(where) > 0 {
+			filter += " AND " + cond
+		} else {
+			filter += " WHERE " + cond
+		}
+	}
+
+	rows, err := db.Query(`SELECT `+productColumns+`, (`+sort.Expr+`)::text`+filter+`
+		ORDER BY `+sort.Expr+` `+order+`, p.id `+order+`
+		LIMIT `+arg(limit+1), args...)
+	if err != nil {
+		if isInvalidInput(err) {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid cursor"})
+		}
+		log.Printf("Get products error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer rows.Close()
+
+	var lastKey string
+	for rows.Next() {
+		var p Product
+		var key string
+		if err := scanProduct(rows, &p, &key); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		if len(list.Items) == limit {
+			// Лишняя строка означает, что есть следующая страница.
+			last := list.Items[len(list.Items)-1]
+			next := encodeProductCursor(productCursor{Sort: cursorSort, Key: lastKey, ID: last.ID})
+			list.NextCursor = &next
+			break
+		}
+		list.Items = append(list.Items, p)
+		lastKey = key
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+// latestProductReviews — сколько последних отзывов отдаёт карточка товара.
+const latestProductReviews = 5
+
+// getProduct — карточка активного товара с агрегатами по одобренным отзывам.
+func getProduct(c echo.Context) error {
+	productID := c.Param("id")
+
+	var detail ProductDetail
+	err := scanProduct(db.QueryRow(`SELECT `+productColumns+` FROM products p`+productRatingJoin+`
+		WHERE p.id = $1 AND p.is_active = true`, productID), &detail.Product)
+	if err == sql.ErrNoRows || isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "product not found"})
+	}
+	if err != nil {
+		log.Printf("Get product error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	detail.RatingHistogram = map[int]int{1: 0, 2: 0, 3: 0, 4: 0, 5: 0}
+	rows, err := db.Query(`
+		SELECT rating, COUNT(*) FROM reviews
+		WHERE product_id = $1 AND status = 'approved'
+		GROUP BY rating`, productID)
+	if err != nil {
+		log.Printf("Get product rating error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	for rows.Next() {
+		var rating, count int
+		if err := rows.Scan(&rating, &count); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		detail.RatingHistogram[rating] = count
+	}
+	rows.Close()
+
+	rows, err = db.Query(`
+		SELECT r.id, r.user_id, u.username, r.product_id, r.rating, r.comment, r.status, r.created_at
+		FROM reviews r
+		JOIN users u ON r.user_id = u.id
+		WHERE r.product_id = $1 AND r.status = 'approved'
+		ORDER BY r.created_at DESC
+		LIMIT $2`, productID, latestProductReviews)
+	if err != nil {
+		log.Printf("Get product reviews error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer rows.Close()
+
+	detail.LatestReviews = []Review{}
+	for rows.Next() {
+		var rev Review
+		if err := rows.Scan(&rev.ID, &rev.UserID, &rev.Username, &rev.ProductID, &rev.Rating, &rev.Comment, &rev.Status, &rev.CreatedAt); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		detail.LatestReviews = append(detail.LatestReviews, rev)
+	}
+
+	detail.ProductOptions, err = loadProductOptions(db, productID, true)
+	if err != nil {
+		log.Printf("Get product options error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	return c.JSON(http.StatusOK, detail)
+}
+
+func createProduct(c echo.Context) error {
+	var req ProductRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+
+	if req.Name == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "name cannot be empty"})
+	}
+	if req.Price < 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "price must be >= 0"})
+	}
+	if req.LowStockThreshold != nil && *req.LowStockThreshold < 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "low_stock_threshold must be >= 0"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Create product error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer tx.Rollback()
+
+	var productID string
+	err = tx.QueryRow(
+		`INSERT INTO products (name, description, price, image_url, is_active, low_stock_threshold)
+		 VALUES ($1, $2, $3, $4, true, COALESCE($5, $6)) RETURNING id`,
+		req.Name, req.Description, req.Price, req.ImageURL, req.LowStockThreshold, defaultLowStockThreshold).Scan(&productID)
+
+	if err != nil {
+		log.Printf("Create product error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	if req.CategoryIDs != nil {
+		msg, err := setProductCategories(tx, productID, req.CategoryIDs)
+		if err != nil {
+			log.Printf("Create product categories error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+		if msg != "" {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: msg})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Create product commit error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"id": productID,
+	})
+}
+
+func updateProduct(c echo.Context) error {
+	productID := c.Param("id")
+	var req ProductRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if req.LowStockThreshold != nil && *req.LowStockThreshold < 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "low_stock_threshold must be >= 0"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Update product error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`UPDATE products SET name=$1, description=$2, price=$3, image_url=$4, is_active=$5,
+			low_stock_threshold=COALESCE($6, low_stock_threshold)
+		 WHERE id=$7`,
+		req.Name, req.Description, req.Price, req.ImageURL, req.IsActive, req.LowStockThreshold, productID)
+
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "product not found"})
+	}
+
+	if req.CategoryIDs != nil {
+		msg, err := setProductCategories(tx, productID, req.CategoryIDs)
+		if err != nil {
+			log.Printf("Update product categories error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+		if msg != "" {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: msg})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Update product commit error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "product updated"})
+}
+
+func deleteProduct(c echo.Context) error {
+	productID := c.Param("id")
+	var imageKeys []string
+	err := db.QueryRow(`DELETE FROM products WHERE id=$1 RETURNING image_keys`, productID).Scan(pq.Array(&imageKeys))
+	if err == sql.ErrNoRows || isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "product not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	deleteStoredFiles(imageKeys)
+	return c.NoContent(http.StatusOK)
+}
+
+// ============ Изображения товаров ============
+
+const (
+	maxImageSize      = 5 << 20
+	maxImageDimension = 6000
+	imageMediumSize   = 800
+	imageThumbSize    = 200
+	imageJPEGQuality  = 85
+)
+
+// allowedImageTypes — форматы, которые принимаются по сигнатуре файла, и расширения для оригинала.
+var allowedImageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// FileStorage хранит файлы по ключу вида products/<id>/<name>. Сейчас есть только
+// localFileStorage; S3-совместимое хранилище должно реализовать тот же интерфейс.
+type FileStorage interface {
+	Put(key string, data []byte, contentType string) error
+	Delete(key string) error
+	URL(key string) string
+}
+
+// localFileStorage складывает файлы в Dir; раздаются они статическим маршрутом /uploads.
+type localFileStorage struct {
+	Dir     string
+	BaseURL string
+}
+
+func (s localFileStorage) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || clean != "/"+key {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(clean)), nil
+}
+
+func (s localFileStorage) Put(key string, data []byte, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// Пишем во временный файл и переименовываем, чтобы статический маршрут не отдал недописанный файл.
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (s localFileStorage) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s localFileStorage) URL(key string) string {
+	return s.BaseURL + "/" + key
+}
+
+// deleteStoredFiles удаляет файлы, которые больше ни на что не ссылаются; ошибки только логируются.
+func deleteStoredFiles(keys []string) {
+	for _, key := range keys {
+		if err := storage.Delete(key); err != nil {
+			log.Printf("Delete stored file error: %v", err)
+		}
+	}
+}
+
+// resizeImage уменьшает изображение так, чтобы большая сторона была не больше maxSide,
+// усредняя пиксели исходника. Прозрачность заливается белым, так как результат сохраняется в JPEG.
+func resizeImage(src image.Image, maxSide int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if w > maxSide || h > maxSide {
+		if w >= h {
+			dw, dh = maxSide, max(1, h*maxSide/w)
+		} else {
+			dw, dh = max(1, w*maxSide/h), maxSide
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0 := b.Min.Y + y*h/dh
+		sy1 := max(sy0+1, b.Min.Y+(y+1)*h/dh)
+		for x := 0; x < dw; x++ {
+			sx0 := b.Min.X + x*w/dw
+			sx1 := max(sx0+1, b.Min.X+(x+1)*w/dw)
+
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			// Значения RGBA() премультиплицированы, поэтому наложение на белый — это r + (1 - a).
+			white := 0xffff - a/n
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8((r/n + white) >> 8),
+				G: uint8((g/n + white) >> 8),
+				B: uint8((bl/n + white) >> 8),
+				A: 0xff,
+			})
+		}
+	}
+	return dst
+}
+
+func encodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: imageJPEGQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeProductImage декодирует загруженное изображение. Размеры проверяются до полного
+// декодирования, чтобы не распаковывать в память огромные картинки.
+func decodeProductImage(data []byte) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("image is corrupted")
+	}
+	if cfg.Width > maxImageDimension || cfg.Height > maxImageDimension {
+		return nil, fmt.Errorf("image must be at most %dx%d pixels", maxImageDimension, maxImageDimension)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("image is corrupted")
+	}
+	return img, nil
+}
+
+// uploadProductImage принимает изображение товара в поле image (multipart/form-data).
+// Тип определяется по сигнатуре файла, а не по имени или заголовку. Сохраняются оригинал,
+// версия imageMediumSize (становится image_url) и миниатюра imageThumbSize (thumbnail_url).
+// Файл проверяется до обращения к базе.
+func uploadProductImage(c echo.Context) error {
+	productID := c.Param("id")
+
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, maxImageSize+1<<20)
+	fh, err := c.FormFile("image")
+	if err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			return c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{Error: "image must be at most 5 MB"})
+		}
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "image file is required"})
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "image file is required"})
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxImageSize+1))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "failed to read image"})
+	}
+	if len(data) > maxImageSize {
+		return c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{Error: "image must be at most 5 MB"})
+	}
+
+	contentType := http.DetectContentType(data)
+	ext, ok := allowedImageTypes[contentType]
+	if !ok {
+		return c.JSON(http.StatusUnsupportedMediaType, ErrorResponse{Error: "image must be JPEG, PNG or GIF"})
+	}
+
+	img, err := decodeProductImage(data)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	var exists bool
+	err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM products WHERE id=$1)`, productID).Scan(&exists)
+	if err != nil && !isInvalidInput(err) {
+		log.Printf("Upload product image error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if !exists {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "product not found"})
+	}
+
+	medium, err := encodeJPEG(resizeImage(img, imageMediumSize))
+	if err != nil {
+		log.Printf("Upload product image error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	thumb, err := encodeJPEG(resizeImage(img, imageThumbSize))
+	if err != nil {
+		log.Printf("Upload product image error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	name, err := generateSecureToken()
+	if err != nil {
+		log.Printf("Upload product image error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	base := "products/" + productID + "/" + name[:16]
+	files := []struct {
+		key, contentType string
+		data             []byte
+	}{
+		{base + ext, contentType, data},
+		{fmt.Sprintf("%s-%d.jpg", base, imageMediumSize), "image/jpeg", medium},
+		{fmt.Sprintf("%s-%d.jpg", base, imageThumbSize), "image/jpeg", thumb},
+	}
+
+	var keys []string
+	for _, file := range files {
+		if err := storage.Put(file.key, file.data, file.contentType); err != nil {
+			log.Printf("Upload product image error: %v", err)
+			deleteStoredFiles(keys)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+		keys = append(keys, file.key)
+	}
+
+	// Старые файлы удаляем только после того, как товар переключён на новые.
+	var oldKeys []string
+	imageURL, thumbURL := storage.URL(keys[1]), storage.URL(keys[2])
+	err = db.QueryRow(`
+		UPDATE products p SET image_url=$1, thumbnail_url=$2, image_keys=$3, updated_at=NOW()
+		FROM (SELECT id, image_keys FROM products WHERE id=$4 FOR UPDATE) old
+		WHERE p.id = old.id
+		RETURNING old.image_keys`,
+		imageURL, thumbURL, pq.Array(keys), productID).Scan(pq.Array(&oldKeys))
+	if err != nil {
+		deleteStoredFiles(keys)
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "product not found"})
+		}
+		log.Printf("Upload product image error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	deleteStoredFiles(oldKeys)
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"image_url":     imageURL,
+		"thumbnail_url": thumbURL,
+		"original_url":  storage.URL(keys[0]),
+	})
+}
+
+// ============ Варианты и модификаторы ============
+
+// loadProductOptions загружает варианты и группы модификаторов товара.
+// activeOnly скрывает выключенные варианты и модификаторы (для витрины и проверки корзины).
+func loadProductOptions(q queryer, productID string, activeOnly bool) (ProductOptions, error) {
+	opts := ProductOptions{Variants: []ProductVariant{}, ModifierGroups: []ModifierGroup{}}
+
+	rows, err := q.Query(`
+		SELECT id, product_id, name, price_delta, sort_order, is_default, is_active, stock
+		FROM product_variants
+		WHERE product_id = $1 AND (is_active OR NOT $2)
+		ORDER BY sort_order, name`, productID, activeOnly)
+	if err != nil {
+		return opts, err
+	}
+	for rows.Next() {
+		var v ProductVariant
+		if err := rows.Scan(&v.ID, &v.ProductID, &v.Name, &v.PriceDelta, &v.SortOrder, &v.IsDefault, &v.IsActive, &v.Stock); err != nil {
+			rows.Close()
+			return opts, err
+		}
+		opts.Variants = append(opts.Variants, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return opts, err
+	}
+
+	rows, err = q.Query(`
+		SELECT id, product_id, name, min_select, max_select, sort_order
+		FROM modifier_groups
+		WHERE product_id = $1
+		ORDER BY sort_order, name`, productID)
+	if err != nil {
+		return opts, err
+	}
+	groupIndex := map[string]int{}
+	for rows.Next() {
+		g := ModifierGroup{Modifiers: []Modifier{}}
+		if err := rows.Scan(&g.ID, &g.ProductID, &g.Name, &g.MinSelect, &g.MaxSelect, &g.SortOrder); err != nil {
+			rows.Close()
+			return opts, err
+		}
+		groupIndex[g.ID] = len(opts.ModifierGroups)
+		opts.ModifierGroups = append(opts.ModifierGroups, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return opts, err
+	}
+
+	rows, err = q.Query(`
+		SELECT m.id, m.group_id, m.name, m.price_delta, m.sort_order, m.is_active
+		FROM modifiers m
+		JOIN modifier_groups g ON g.id = m.group_id
+		WHERE g.product_id = $1 AND (m.is_active OR NOT $2)
+		ORDER BY m.sort_order, m.name`, productID, activeOnly)
+	if err != nil {
+		return opts, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m Modifier
+		if err := rows.Scan(&m.ID, &m.GroupID, &m.Name, &m.PriceDelta, &m.SortOrder, &m.IsActive); err != nil {
+			return opts, err
+		}
+		if i, ok := groupIndex[m.GroupID]; ok {
+			opts.ModifierGroups[i].Modifiers = append(opts.ModifierGroups[i].Modifiers, m)
+		}
+	}
+	return opts, rows.Err()
+}
+
+// resolveProductOptions проверяет выбор покупателя и приводит его к виду, в котором он хранится
+// в cart_items: без варианта подставляется вариант по умолчанию, модификаторы без повторов
+// и отсортированы. Непустой msg — ошибка выбора для ответа 400.
+func resolveProductOptions(q queryer, productID, variantID string, modifierIDs []string) (*string, []string, string, error) {
+	opts, err := loadProductOptions(q, productID, true)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	var variant *string
+	if variantID == "" {
+		for _, v := range opts.Variants {
+			if v.IsDefault {
+				id := v.ID
+				variant = &id
+			}
+		}
+		if variant == nil && len(opts.Variants) > 0 {
+			return nil, nil, "variant_id is required", nil
+		}
+	} else {
+		for _, v := range opts.Variants {
+			if v.ID == variantID {
+				id := v.ID
+				variant = &id
+			}
+		}
+		if variant == nil {
+			return nil, nil, "unknown variant", nil
+		}
+	}
+
+	modifierIDs = uniqueStrings(modifierIDs)
+	groupOf := map[string]string{}
+	for _, g := range opts.ModifierGroups {
+		for _, m := range g.Modifiers {
+			groupOf[m.ID] = g.ID
+		}
+	}
+	selected := map[string]int{}
+	for _, id := range modifierIDs {
+		groupID, ok := groupOf[id]
+		if !ok {
+			return nil, nil, "unknown modifier", nil
+		}
+		selected[groupID]++
+	}
+	for _, g := range opts.ModifierGroups {
+		if n := selected[g.ID]; n < g.MinSelect {
+			return nil, nil, fmt.Sprintf("select at least %d in %q", g.MinSelect, g.Name), nil
+		} else if n > g.MaxSelect {
+			return nil, nil, fmt.Sprintf("select at most %d in %q", g.MaxSelect, g.Name), nil
+		}
+	}
+
+	if modifierIDs == nil {
+		modifierIDs = []string{}
+	}
+	sort.Strings(modifierIDs)
+	return variant, modifierIDs, "", nil
+}
+
+// optionWriteError переводит ошибки записи вариантов и модификаторов в ответы API.
+// parent — сущность, к которой привязывается запись (товар или группа).
+func optionWriteError(c echo.Context, err error, parent string) error {
+	switch {
+	case strings.Contains(err.Error(), "duplicate key"):
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "name is already taken"})
+	case strings.Contains(err.Error(), "foreign key"), isInvalidInput(err):
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: parent + " not found"})
+	}
+	log.Printf("Save product option error: %v", err)
+	return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+}
+
+func getAdminProductOptions(c echo.Context) error {
+	productID := c.Param("id")
+
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM products WHERE id=$1)`, productID).Scan(&exists)
+	if err != nil && !isInvalidInput(err) {
+		log.Printf("Get product options error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if !exists {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "product not found"})
+	}
+
+	opts, err := loadProductOptions(db, productID, false)
+	if err != nil {
+		log.Printf("Get product options error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.JSON(http.StatusOK, opts)
+}
+
+// saveVariant создаёт (variantID == "") или обновляет вариант. Вариант по умолчанию у товара
+// один: при is_default=true флаг снимается с остальных вариантов в той же транзакции.
+func saveVariant(c echo.Context, productID, variantID string) error {
+	var req VariantRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "name cannot be empty"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Save variant error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	defer tx.Rollback()
+
+	if variantID != "" {
+		err := tx.QueryRow(`SELECT product_id FROM product_variants WHERE id=$1 FOR UPDATE`, variantID).Scan(&productID)
+		if err == sql.ErrNoRows || isInvalidInput(err) {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "variant not found"})
+		}
+		if err != nil {
+			log.Printf("Save variant error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+	}
+
+	if req.IsDefault {
+		_, err := tx.Exec(`UPDATE product_variants SET is_default=false WHERE product_id=$1 AND is_default`, productID)
+		if err != nil {
+			return optionWriteError(c, err, "product")
+		}
+	}
+
+	v := ProductVariant{ProductID: productID, Name: req.Name, PriceDelta: req.PriceDelta, SortOrder: req.SortOrder, IsDefault: req.IsDefault}
+	status := http.StatusOK
+	if variantID == "" {
+		status = http.StatusCreated
+		v.IsActive = true
+		if req.IsActive != nil {
+			v.IsActive = *req.IsActive
+		}
+		err = tx.QueryRow(`
+			INSERT INTO product_variants (product_id, name, price_delta, sort_order, is_default, is_active)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+			productID, v.Name, v.PriceDelta, v.SortOrder, v.IsDefault, v.IsActive).Scan(&v.ID)
+	} else {
+		err = tx.QueryRow(`
+			UPDATE product_variants
+			SET name=$1, price_delta=$2, sort_order=$3, is_default=$4, is_active=COALESCE($5, is_active)
+			WHERE id=$6
+			RETURNING id, is_active, stock`,
+			v.Name, v.PriceDelta, v.SortOrder, v.IsDefault, req.IsActive, variantID).Scan(&v.ID, &v.IsActive, &v.Stock)
+	}
+	if err != nil {
+		return optionWriteError(c, err, "product")
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Save variant commit error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	return c.JSON(status, v)
+}
+
+func createVariant(c echo.Context) error {
+	return saveVariant(c, c.Param("id"), "")
+}
+
+func updateVariant(c echo.Context) error {
+	return saveVariant(c, "", c.Param("id"))
+}
+
+// deleteVariant удаляет вариант; строки корзин с этим вариантом удаляются каскадом.
+// Чтобы временно убрать размер из продажи, его достаточно выключить через is_active.
+func deleteVariant(c echo.Context) error {
+	result, err := db.Exec(`DELETE FROM product_variants WHERE id=$1`, c.Param("id"))
+	if err != nil && !isInvalidInput(err) {
+		log.Printf("Delete variant error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "variant not found"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "variant not found"})
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func validateModifierGroup(req *ModifierGroupRequest) error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return fmt.Errorf("name cannot be empty")
+	}
+	if req.MinSelect < 0 {
+		return fmt.Errorf("min_select must be >= 0")
+	}
+	if req.MaxSelect < 1 || req.MaxSelect < req.MinSelect {
+		return fmt.Errorf("max_select must be >= 1 and >= min_select")
+	}
+	return nil
+}
+
+func createModifierGroup(c echo.Context) error {
+	var req ModifierGroupRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if err := validateModifierGroup(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	g := ModifierGroup{ProductID: c.Param("id"), Name: req.Name, MinSelect: req.MinSelect, MaxSelect: req.MaxSelect, SortOrder: req.SortOrder, Modifiers: []Modifier{}}
+	err := db.QueryRow(`
+		INSERT INTO modifier_groups (product_id, name, min_select, max_select, sort_order)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		g.ProductID, g.Name, g.MinSelect, g.MaxSelect, g.SortOrder).Scan(&g.ID)
+	if err != nil {
+		return optionWriteError(c, err, "product")
+	}
+	return c.JSON(http.StatusCreated, g)
+}
+
+func updateModifierGroup(c echo.Context) error {
+	groupID := c.Param("id")
+
+	var req ModifierGroupRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	}
+	if err := validateModifierGroup(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	g := ModifierGroup{Name: req.Name, MinSelect: req.MinSelect, MaxSelect: req.MaxSelect, SortOrder: req.SortOrder}
+	err := db.QueryRow(`
+		UPDATE modifier_groups SET name=$1, min_select=$2, max_select=$3, sort_order=$4
+		WHERE id=$5
+		RETURNING id, product_id`,
+		g.Name, g.MinSelect, g.MaxSelect, g.SortOrder, groupID).Scan(&g.ID, &g.ProductID)
+	if err == sql.ErrNoRows || (err != nil && isInvalidInput(err)) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "modifier group not found"})
+	}
+	if err != nil {
+		return optionWriteError(c, err, "product")
+	}
+
+	opts, err := loadProductOptions(db, g.ProductID, false)
+	if err != nil {
+		log.Printf("Update modifier group error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	g.Modifiers = []Modifier{}
+	for _, og := range opts.ModifierGroups {
+		if og.ID == g.ID {
+			g.Modifiers = og.Modifiers
+		}
+	}
+	return c.JSON(http.StatusOK, g)
+}
+
+func deleteModifierGroup(c echo.Context) error {
+	result, err := db.Exec(`DELETE FROM modifier_groups WHERE id=$1`, c.Param("id"))
+	if err != nil && !isInvalidInput(err) {
+		log.Printf("Delete modifier group error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "modifier group not found"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "modifier group not found"})
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func bindModifier(c echo.Context) (ModifierRequest, error) {
+	var req ModifierRequest
+	if err := c.Bind(&req); err != nil {
+		return req, fmt.Errorf("invalid request format")
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return req, fmt.Errorf("name cannot be empty")
+	}
+	return req, nil
+}
+
+func createModifier(c echo.Context) error {
+	req, err := bindModifier(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	m := Modifier{GroupID: c.Param("id"), Name: req.Name, PriceDelta: req.PriceDelta, SortOrder: req.SortOrder, IsActive: true}
+	if req.IsActive != nil {
+		m.IsActive = *req.IsActive
+	}
+	err = db.QueryRow(`
+		INSERT INTO modifiers (group_id, name, price_delta, sort_order, is_active)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		m.GroupID, m.Name, m.PriceDelta, m.SortOrder, m.IsActive).Scan(&m.ID)
+	if err != nil {
+		return optionWriteError(c, err, "modifier group")
+	}
+	return c.JSON(http.StatusCreated, m)
+}
+
+func updateModifier(c echo.Context) error {
+	req, err := bindModifier(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	m := Modifier{Name: req.Name, PriceDelta: req.PriceDelta, SortOrder: req.SortOrder}
+	err = db.QueryRow(`
+		UPDATE modifiers SET name=$1, price_delta=$2, sort_order=$3, is_active=COALESCE($4, is_active)
+		WHERE id=$5
+		RETURNING id, group_id, is_active`,
+		m.Name, m.PriceDelta, m.SortOrder, req.IsActive, c.Param("id")).Scan(&m.ID, &m.GroupID, &m.IsActive)
+	if err == sql.ErrNoRows || (err != nil && isInvalidInput(err)) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "modifier not found"})
+	}
+	if err != nil {
+		return optionWriteError(c, err, "modifier group")
+	}
+	return c.JSON(http.StatusOK, m)
+}
+
+// deleteModifier удаляет модификатор. Строки корзин, где он был выбран, становятся недоступными
+// (options_unavailable), чтобы цена не изменилась у покупателя незаметно.
+func deleteModifier(c echo.Context) error {
+	result, err := db.Exec(`DELETE FROM modifiers WHERE id=$1`, c.Param("id"))
+	if err != nil && !isInvalidInput(err) {
+		log.Printf("Delete modifier error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "modifier not found"})
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "modifier not found"})
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// ============ Склад ============
+
+// defaultLowStockThreshold — порог низкого остатка для новых товаров, если он не передан явно.
+const defaultLowStockThreshold = 5
+
+// Причины движения остатков в stock_movements.
+const (
+	stockReasonOrder      = "order"
+	stockReasonCancelled  = "order_cancelled"
+	stockReasonAdjustment = "adjustment"
+)
+
+// recordStockMovement пишет движение в журнал и заполняет m.ID и m.CreatedAt.
+func recordStockMovement(q queryer, m *StockMovement) error {
+	return q.QueryRow(`
+		INSERT INTO stock_movements (product_id, variant_id, delta, balance, reason, note, order_id, user_id)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8)
+		RETURNING id, created_at`,
+		m.ProductID, m.VariantID, m.Delta, m.Balance, m.Reason, m.Note, m.OrderID, m.UserID).Scan(&m.ID, &m.CreatedAt)
+}
+
+// stockTarget — строка, с которой списывается остаток: вариант со своим учётом или товар.
+type stockTarget struct {
+	productID string
+	variantID string
+}
+
+// reserveStock списывает остатки по строкам корзины в транзакции заказа. Строки товаров
+// и вариантов блокируются FOR UPDATE в порядке id, поэтому параллельные заказы не уводят
+// остаток в минус. Вариант без своего учёта списывается с остатка товара, товар без учёта
+// не ограничен. Непустой msg — нехватка остатка для ответа 409.
+func reserveStock(tx *sql.Tx, orderID, userID string, items []CartItem) (string, error) {
+	var productIDs, variantIDs []string
+	for _, item := range items {
+		productIDs = append(productIDs, item.ProductID)
+		if item.VariantID != nil {
+			variantIDs = append(variantIDs, *item.VariantID)
+		}
+	}
+
+	productStock := map[string]*int{}
+	rows, err := tx.Query(`SELECT id, stock FROM products WHERE id = ANY($1::uuid[]) ORDER BY id FOR UPDATE`, pq.Array(productIDs))
+	if err != nil {
+		return "", err
+	}
+	for rows.Next() {
+		var id string
+		var stock *int
+		if err := rows.Scan(&id, &stock); err != nil {
+			rows.Close()
+			return "", err
+		}
+		productStock[id] = stock
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	variantStock := map[string]*int{}
+	rows, err = tx.Query(`SELECT id, stock FROM product_variants WHERE id = ANY($1::uuid[]) ORDER BY id FOR UPDATE`, pq.Array(variantIDs))
+	if err != nil {
+		return "", err
+	}
+	for rows.Next() {
+		var id string
+		var stock *int
+		if err := rows.Scan(&id, &stock); err != nil {
+			rows.Close()
+			return "", err
+		}
+		variantStock[id] = stock
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
 
-	result, err := db.Exec(`DELETE FROM groups WHERE id=$1 AND user_id=$2`, groupID, userID)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	// Несколько строк корзины (разные модификаторы) могут списываться с одного остатка.
+	need := map[stockTarget]int{}
+	var order []stockTarget
+	names := map[stockTarget]string{}
+	for _, item := range items {
+		var target stockTarget
+		switch {
+		case item.VariantID != nil && variantStock[*item.VariantID] != nil:
+			target = stockTarget{productID: item.ProductID, variantID: *item.VariantID}
+			names[target] = item.Name + " (" + item.VariantName + ")"
+		case productStock[item.ProductID] != nil:
+			target = stockTarget{productID: item.ProductID}
+			names[target] = item.Name
+		default:
+			continue
+		}
+		if _, ok := need[target]; !ok {
+			order = append(order, target)
+		}
+		need[target] += item.Quantity
 	}
 
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "group not found"})
+	for _, target := range order {
+		stock := productStock[target.productID]
+		if target.variantID != "" {
+			stock = variantStock[target.variantID]
+		}
+		if *stock < need[target] {
+			return fmt.Sprintf("not enough stock for %q: %d left", names[target], *stock), nil
+		}
 	}
 
-	return c.NoContent(http.StatusOK)
+	for _, target := range order {
+		m := StockMovement{ProductID: target.productID, Delta: -need[target], Reason: stockReasonOrder, OrderID: &orderID, UserID: &userID}
+		if target.variantID != "" {
+			m.VariantID = &target.variantID
+			err = tx.QueryRow(`UPDATE product_variants SET stock = stock - $1 WHERE id=$2 RETURNING stock`,
+				need[target], target.variantID).Scan(&m.Balance)
+		} else {
+			err = tx.QueryRow(`UPDATE products SET stock = stock - $1 WHERE id=$2 RETURNING stock`,
+				need[target], target.productID).Scan(&m.Balance)
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := recordStockMovement(tx, &m); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
 }
 
-// ============ Таски ============
-
-func getTasksByGroup(c echo.Context) error {
-	groupID := c.Param("id")
-
-	rows, err := db.Query(
-		`SELECT id, title, done FROM tasks WHERE group_id=$1 ORDER BY created_at DESC`,
-		groupID)
+// restockOrder возвращает на склад всё, что было списано по заказу. Возврат считается по журналу
+// движений, поэтому не зависит от того, как с тех пор настроен учёт, и не повторяется дважды.
+func restockOrder(tx *sql.Tx, orderID, userID string) error {
+	rows, err := tx.Query(`
+		SELECT product_id, variant_id, -SUM(delta)::int
+		FROM stock_movements
+		WHERE order_id = $1 AND reason IN ($2, $3)
+		GROUP BY product_id, variant_id
+		HAVING SUM(delta) < 0
+		ORDER BY variant_id IS NOT NULL, COALESCE(variant_id, product_id)`,
+		orderID, stockReasonOrder, stockReasonCancelled)
 	if err != nil {
-		log.Printf("Get tasks error: %v", err)
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		return err
 	}
-	defer rows.Close()
-
-	var tasks []Task
+	var returns []StockMovement
 	for rows.Next() {
-		var t Task
-		if err := rows.Scan(&t.ID, &t.Title, &t.Done); err != nil {
-			continue
+		m := StockMovement{Reason: stockReasonCancelled, OrderID: &orderID, UserID: &userID}
+		if err := rows.Scan(&m.ProductID, &m.VariantID, &m.Delta); err != nil {
+			rows.Close()
+			return err
 		}
-		t.GroupID = groupID
-		tasks = append(tasks, t)
+		returns = append(returns, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	if tasks == nil {
-		tasks = []Task{}
+	for _, m := range returns {
+		if m.VariantID != nil {
+			err = tx.QueryRow(`UPDATE product_variants SET stock = stock + $1 WHERE id=$2 AND stock IS NOT NULL RETURNING stock`,
+				m.Delta, *m.VariantID).Scan(&m.Balance)
+		} else {
+			err = tx.QueryRow(`UPDATE products SET stock = stock + $1 WHERE id=$2 AND stock IS NOT NULL RETURNING stock`,
+				m.Delta, m.ProductID).Scan(&m.Balance)
+		}
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := recordStockMovement(tx, &m); err != nil {
+			return err
+		}
 	}
-	return c.JSON(http.StatusOK, tasks)
+	return nil
 }
 
-func createTask(c echo.Context) error {
-	groupID := c.Param("id")
+// adjustStock — ручная корректировка остатка товара или его варианта с записью в журнал.
+func adjustStock(c echo.Context) error {
+	adminID := c.Get("user_id").(string)
+	productID := c.Param("id")
 
-	var req CreateTaskRequest
+	var req StockAdjustRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
 	}
-	if req.Title == "" {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "title cannot be empty"})
+	if (req.Delta == nil) == (req.Quantity == nil) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "exactly one of delta or quantity is required"})
+	}
+	if req.Quantity != nil && *req.Quantity < 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "quantity must be >= 0"})
+	}
+	if req.Delta != nil && *req.Delta == 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "delta must not be zero"})
 	}
 
-	var taskID string
-	err := db.QueryRow(
-		`INSERT INTO tasks (title, group_id, done) VALUES ($1, $2, false) RETURNING id`,
-		req.Title, groupID).Scan(&taskID)
-
+	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("Create task error: %v", err)
+		log.Printf("Adjust stock error: %v", err)
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
+	defer tx.Rollback()
 
-	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"id":       taskID,
-		"title":    req.Title,
-		"done":     false,
-		"group_id": groupID,
-	})
-}
-
-func updateTask(c echo.Context) error {
-	taskID := c.Param("id")
-
-	var req UpdateTaskRequest
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+	var current *int
+	err = tx.QueryRow(`SELECT stock FROM products WHERE id=$1 FOR UPDATE`, productID).Scan(&current)
+	if err == sql.ErrNoRows || isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "product not found"})
 	}
-
-	if req.Title == nil && req.Done == nil {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "nothing to update"})
+	if err != nil {
+		log.Printf("Adjust stock error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
 
-	var query string
-	var args []interface{}
+	m := StockMovement{ProductID: productID, Reason: stockReasonAdjustment, Note: strings.TrimSpace(req.Note), UserID: &adminID}
+	if req.VariantID != "" {
+		m.VariantID = &req.VariantID
+		err = tx.QueryRow(`SELECT stock FROM product_variants WHERE id=$1 AND product_id=$2 FOR UPDATE`,
+			req.VariantID, productID).Scan(&current)
+		if err == sql.ErrNoRows || isInvalidInput(err) {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "variant not found"})
+		}
+		if err != nil {
+			log.Printf("Adjust stock error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+	}
 
-	if req.Title != nil && req.Done != nil {
-		query = `UPDATE tasks SET title=$1, done=$2 WHERE id=$3`
-		args = []interface{}{*req.Title, *req.Done, taskID}
-	} else if req.Title != nil {
-		query = `UPDATE tasks SET title=$1 WHERE id=$2`
-		args = []interface{}{*req.Title, taskID}
+	if req.Quantity != nil {
+		m.Balance = *req.Quantity
+		m.Delta = m.Balance
+		if current != nil {
+			m.Delta = m.Balance - *current
+		}
 	} else {
-		query = `UPDATE tasks SET done=$1 WHERE id=$2`
-		args = []interface{}{*req.Done, taskID}
+		if current == nil {
+			return c.JSON(http.StatusConflict, ErrorResponse{Error: "stock is not tracked, set quantity first"})
+		}
+		m.Delta = *req.Delta
+		m.Balance = *current + m.Delta
+		if m.Balance < 0 {
+			return c.JSON(http.StatusConflict, ErrorResponse{Error: "stock cannot go below zero"})
+		}
 	}
 
-	result, err := db.Exec(query, args...)
+	if m.VariantID != nil {
+		_, err = tx.Exec(`UPDATE product_variants SET stock=$1 WHERE id=$2`, m.Balance, *m.VariantID)
+	} else {
+		_, err = tx.Exec(`UPDATE products SET stock=$1 WHERE id=$2`, m.Balance, productID)
+	}
 	if err != nil {
-		log.Printf("Update task error: %v", err)
+		log.Printf("Adjust stock error: %v", err)
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
 
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "task not found"})
+	if err := recordStockMovement(tx, &m); err != nil {
+		log.Printf("Adjust stock error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "task updated"})
-}
-
-func deleteTask(c echo.Context) error {
-	taskID := c.Param("id")
-	result, err := db.Exec(`DELETE FROM tasks WHERE id=$1`, taskID)
-	if err != nil {
+	if err := tx.Commit(); err != nil {
+		log.Printf("Adjust stock commit error: %v", err)
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "task not found"})
-	}
-	return c.NoContent(http.StatusOK)
+	return c.JSON(http.StatusCreated, m)
 }
 
-// ============ Карты товаров ============
+// getStockMovements — журнал движений остатков товара, новые сверху.
+func getStockMovements(c echo.Context) error {
+	productID := c.Param("id")
+	page, limit, err := parsePagination(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
 
-func getCart(c echo.Context) error {
-	userID := c.Get("user_id").(string)
+	list := StockMovementList{Items: []StockMovement{}, Page: page, Limit: limit}
+	err = db.QueryRow(`SELECT COUNT(*) FROM stock_movements WHERE product_id=$1`, productID).Scan(&list.Total)
+	if isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "product not found"})
+	}
+	if err != nil {
+		log.Printf("Get stock movements error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
 
 	rows, err := db.Query(`
-		SELECT c.id, c.product_id, c.quantity, p.name, p.image_url, p.price 
-		FROM cart_items c
-		JOIN products p ON c.product_id = p.id
-		WHERE c.user_id=$1`,
-		userID)
+		SELECT id, product_id, variant_id, delta, balance, reason, COALESCE(note, ''), order_id, user_id, created_at
+		FROM stock_movements
+		WHERE product_id=$1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3`,
+		productID, limit, (page-1)*limit)
 	if err != nil {
-		log.Printf("Get cart error: %v", err)
+		log.Printf("Get stock movements error: %v", err)
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
 	defer rows.Close()
 
-	var cart []CartItem
 	for rows.Next() {
-		var item CartItem
-		item.UserID = userID
-
-		if err := rows.Scan(&item.ID, &item.ProductID, &item.Quantity, &item.Name, &item.Image, &item.Price); err != nil {
+		var m StockMovement
+		if err := rows.Scan(&m.ID, &m.ProductID, &m.VariantID, &m.Delta, &m.Balance, &m.Reason, &m.Note, &m.OrderID, &m.UserID, &m.CreatedAt); err != nil {
 			log.Printf("Scan error: %v", err)
 			continue
 		}
-		cart = append(cart, item)
+		list.Items = append(list.Items, m)
 	}
+	return c.JSON(http.StatusOK, list)
+}
 
-	if cart == nil {
-		cart = []CartItem{}
+// getLowStock — активные товары и варианты с учитываемым остатком не выше порога товара,
+// самые дефицитные первыми.
+func getLowStock(c echo.Context) error {
+	rows, err := db.Query(`
+		SELECT p.id, p.name, NULL::uuid, '', p.stock, p.low_stock_threshold
+		FROM products p
+		WHERE p.is_active AND p.stock IS NOT NULL AND p.stock <= p.low_stock_threshold
+		UNION ALL
+		SELECT p.id, p.name, v.id, v.name, v.stock, p.low_stock_threshold
+		FROM product_variants v
+		JOIN products p ON p.id = v.product_id
+		WHERE p.is_active AND v.is_active AND v.stock IS NOT NULL AND v.stock <= p.low_stock_threshold
+		ORDER BY 5, 2, 4`)
+	if err != nil {
+		log.Printf("Get low stock error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
-	return c.JSON(http.StatusOK, cart)
+	defer rows.Close()
+
+	items := []LowStockItem{}
+	for rows.Next() {
+		var item LowStockItem
+		if err := rows.Scan(&item.ProductID, &item.ProductName, &item.VariantID, &item.VariantName, &item.Stock, &item.Threshold); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		items = append(items, item)
+	}
+	return c.JSON(http.StatusOK, items)
 }
 
-func addToCart(c echo.Context) error {
-	userID := c.Get("user_id").(string)
+// ============ Категории ============
 
-	var req AddToCartRequest
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
-	}
-	if req.ProductID == "" {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid product id"})
-	}
+var categorySlugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
 
-	var cartItemID string
-	err := db.QueryRow(
-		`INSERT INTO cart_items (user_id, product_id, quantity) 
-		 VALUES ($1, $2, 1) RETURNING id`,
-		userID, req.ProductID).Scan(&cartItemID)
+// setProductCategories заменяет категории товара. Непустой msg — ошибка запроса для ответа 400;
+// вызывающий откатывает транзакцию и сам отправляет ответ.
+func setProductCategories(q queryer, productID string, categoryIDs []string) (string, error) {
+	categoryIDs = uniqueStrings(categoryIDs)
 
+	var found int
+	err := q.QueryRow(`SELECT COUNT(*) FROM categories WHERE id = ANY($1::uuid[])`, pq.Array(categoryIDs)).Scan(&found)
+	if isInvalidInput(err) {
+		return "unknown category in category_ids", nil
+	}
 	if err != nil {
-		log.Printf("Add to cart error: %v", err)
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		return "", err
+	}
+	if found != len(categoryIDs) {
+		return "unknown category in category_ids", nil
 	}
 
-	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"id": cartItemID,
-	})
-}
-
-func clearCart(c echo.Context) error {
-	userID := c.Get("user_id").(string)
-	result, err := db.Exec(`DELETE FROM cart_items WHERE user_id=$1`, userID)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	if _, err := q.Exec(`DELETE FROM product_categories WHERE product_id=$1`, productID); err != nil {
+		return "", err
 	}
-	rows, _ := result.RowsAffected()
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"message": "cart cleared",
-		"deleted": rows,
-	})
+	_, err = q.Exec(`
+		INSERT INTO product_categories (product_id, category_id)
+		SELECT $1, unnest($2::uuid[])`,
+		productID, pq.Array(categoryIDs))
+	return "", err
 }
 
-// ============ Продукты ============
-
-func getProducts(c echo.Context) error {
-	rows, err := db.Query(
-		`SELECT id, name, description, price, image_url, is_active FROM products WHERE is_active = true ORDER BY created_at DESC`)
+// getCategories возвращает дерево активных категорий. product_count — число активных товаров
+// в категории вместе с подкатегориями; подкатегории неактивного раздела не показываются.
+func getCategories(c echo.Context) error {
+	rows, err := db.Query(`
+		WITH RECURSIVE tree AS (
+			SELECT id AS root, id FROM categories WHERE is_active
+			UNION ALL
+			SELECT tree.root, c.id FROM categories c JOIN tree ON c.parent_id = tree.id WHERE c.is_active
+		)
+		SELECT c.id, c.parent_id, c.name, c.slug, c.sort_order, c.is_active,
+			(SELECT COUNT(DISTINCT pc.product_id)
+			 FROM tree
+			 JOIN product_categories pc ON pc.category_id = tree.id
+			 JOIN products p ON p.id = pc.product_id AND p.is_active
+			 WHERE tree.root = c.id)
+		FROM categories c
+		WHERE c.is_active
+		ORDER BY c.sort_order, c.name`)
 	if err != nil {
-		log.Printf("Get products error: %v", err)
+		log.Printf("Get categories error: %v", err)
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
 	defer rows.Close()
 
-	var products []Product
+	var all []*Category
 	for rows.Next() {
-		var p Product
-		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.ImageURL, &p.IsActive); err != nil {
+		var cat Category
+		if err := rows.Scan(&cat.ID, &cat.ParentID, &cat.Name, &cat.Slug, &cat.SortOrder, &cat.IsActive, &cat.ProductCount); err != nil {
+			log.Printf("Scan error: %v", err)
 			continue
 		}
-		products = append(products, p)
+		all = append(all, &cat)
+	}
+
+	byID := make(map[string]*Category, len(all))
+	for _, cat := range all {
+		byID[cat.ID] = cat
 	}
-	if products == nil {
-		products = []Product{}
+	roots := []*Category{}
+	for _, cat := range all {
+		if cat.ParentID == nil {
+			roots = append(roots, cat)
+		} else if parent, ok := byID[*cat.ParentID]; ok {
+			parent.Children = append(parent.Children, cat)
+		}
 	}
-	return c.JSON(http.StatusOK, products)
+	return c.JSON(http.StatusOK, roots)
 }
 
-func getAdminProducts(c echo.Context) error {
-	rows, err := db.Query(
-		`SELECT id, name, description, price, image_url, is_active FROM products ORDER BY created_at DESC`)
+func getAdminCategories(c echo.Context) error {
+	rows, err := db.Query(`
+		SELECT c.id, c.parent_id, c.name, c.slug, c.sort_order, c.is_active,
+			(SELECT COUNT(*) FROM product_categories pc WHERE pc.category_id = c.id)
+		FROM categories c
+		ORDER BY c.sort_order, c.name`)
 	if err != nil {
+		log.Printf("Get admin categories error: %v", err)
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
 	defer rows.Close()
 
-	var products []Product
+	categories := []Category{}
 	for rows.Next() {
-		var p Product
-		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.ImageURL, &p.IsActive); err != nil {
+		var cat Category
+		if err := rows.Scan(&cat.ID, &cat.ParentID, &cat.Name, &cat.Slug, &cat.SortOrder, &cat.IsActive, &cat.ProductCount); err != nil {
+			log.Printf("Scan error: %v", err)
 			continue
 		}
-		products = append(products, p)
+		categories = append(categories, cat)
+	}
+	return c.JSON(http.StatusOK, categories)
+}
+
+func validateCategory(req *CategoryRequest) error {
+	req.Name = strings.TrimSpace(req.Name)
+	req.Slug = strings.TrimSpace(req.Slug)
+	if req.Name == "" {
+		return fmt.Errorf("name cannot be empty")
+	}
+	if !categorySlugPattern.MatchString(req.Slug) {
+		return fmt.Errorf("slug must contain only lowercase latin letters, digits and hyphens")
 	}
-	if products == nil {
-		products = []Product{}
+	if req.ParentID != nil && *req.ParentID == "" {
+		req.ParentID = nil
 	}
-	return c.JSON(http.StatusOK, products)
+	return nil
 }
 
-func createProduct(c echo.Context) error {
-	var req ProductRequest
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
+// categoryWriteError переводит ошибки записи категории в ответы API.
+func categoryWriteError(c echo.Context, err error) error {
+	switch {
+	case strings.Contains(err.Error(), "duplicate key"):
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "slug is already taken"})
+	case strings.Contains(err.Error(), "categories_parent_id_fkey"), isInvalidInput(err):
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "parent category not found"})
 	}
+	log.Printf("Save category error: %v", err)
+	return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+}
 
-	if req.Name == "" {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "name cannot be empty"})
+func createCategory(c echo.Context) error {
+	var req CategoryRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
 	}
-	if req.Price < 0 {
-		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "price must be >= 0"})
+	if err := validateCategory(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
 	}
 
-	var productID string
-	err := db.QueryRow(
-		`INSERT INTO products (name, description, price, image_url, is_active) VALUES ($1, $2, $3, $4, true) RETURNING id`,
-		req.Name, req.Description, req.Price, req.ImageURL).Scan(&productID)
-
+	cat := Category{ParentID: req.ParentID, Name: req.Name, Slug: req.Slug, SortOrder: req.SortOrder, IsActive: true}
+	if req.IsActive != nil {
+		cat.IsActive = *req.IsActive
+	}
+	err := db.QueryRow(`
+		INSERT INTO categories (parent_id, name, slug, sort_order, is_active)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		cat.ParentID, cat.Name, cat.Slug, cat.SortOrder, cat.IsActive).Scan(&cat.ID)
 	if err != nil {
-		log.Printf("Create product error: %v", err)
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		return categoryWriteError(c, err)
 	}
-
-	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"id": productID,
-	})
+	return c.JSON(http.StatusCreated, cat)
 }
 
-func updateProduct(c echo.Context) error {
-	productID := c.Param("id")
-	var req ProductRequest
+func updateCategory(c echo.Context) error {
+	categoryID := c.Param("id")
+
+	var req CategoryRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request format"})
 	}
+	if err := validateCategory(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
 
-	result, err := db.Exec(
-		`UPDATE products SET name=$1, description=$2, price=$3, image_url=$4, is_active=$5 WHERE id=$6`,
-		req.Name, req.Description, req.Price, req.ImageURL, req.IsActive, productID)
+	// Родителем не может быть сама категория или её потомок, иначе дерево зациклится.
+	if req.ParentID != nil {
+		var cycle bool
+		err := db.QueryRow(`
+			WITH RECURSIVE tree AS (
+				SELECT id FROM categories WHERE id = $1
+				UNION ALL
+				SELECT c.id FROM categories c JOIN tree ON c.parent_id = tree.id
+			)
+			SELECT EXISTS(SELECT 1 FROM tree WHERE id = $2)`,
+			categoryID, *req.ParentID).Scan(&cycle)
+		if err != nil && !isInvalidInput(err) {
+			log.Printf("Update category error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "category not found"})
+		}
+		if cycle {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "category cannot be nested inside itself"})
+		}
+	}
 
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	var cat Category
+	err := db.QueryRow(`
+		UPDATE categories
+		SET parent_id=$1, name=$2, slug=$3, sort_order=$4, is_active=COALESCE($5, is_active)
+		WHERE id=$6
+		RETURNING id, parent_id, name, slug, sort_order, is_active`,
+		req.ParentID, req.Name, req.Slug, req.SortOrder, req.IsActive, categoryID).
+		Scan(&cat.ID, &cat.ParentID, &cat.Name, &cat.Slug, &cat.SortOrder, &cat.IsActive)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "category not found"})
 	}
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "product not found"})
+	if err != nil {
+		return categoryWriteError(c, err)
 	}
-	return c.JSON(http.StatusOK, map[string]string{"message": "product updated"})
+	return c.JSON(http.StatusOK, cat)
 }
 
-func deleteProduct(c echo.Context) error {
-	productID := c.Param("id")
-	result, err := db.Exec(`DELETE FROM products WHERE id=$1`, productID)
+// deleteCategory удаляет пустой раздел: подкатегории нужно сначала перенести или удалить.
+// Товары остаются в каталоге, теряя только привязку к категории.
+func deleteCategory(c echo.Context) error {
+	categoryID := c.Param("id")
+
+	result, err := db.Exec(`DELETE FROM categories WHERE id=$1`, categoryID)
 	if err != nil {
+		if strings.Contains(err.Error(), "categories_parent_id_fkey") {
+			return c.JSON(http.StatusConflict, ErrorResponse{Error: "category has subcategories"})
+		}
+		if isInvalidInput(err) {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: "category not found"})
+		}
+		log.Printf("Delete category error: %v", err)
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
 	rows, _ := result.RowsAffected()
 	if rows == 0 {
-		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "product not found"})
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "category not found"})
 	}
 	return c.NoContent(http.StatusOK)
 }
@@ -916,6 +7603,12 @@ func createReview(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
 
+	publishEvent(db, Event{
+		Type:       eventReviewCreated,
+		Data:       map[string]string{"id": reviewID, "status": "pending"},
+		Permission: permReviewsModerate,
+	})
+
 	return c.JSON(http.StatusCreated, map[string]interface{}{
 		"id": reviewID,
 	})
@@ -958,17 +7651,48 @@ func approveReview(c echo.Context) error {
 	adminID := c.Get("user_id").(string)
 	reviewID := c.Param("id")
 
-	result, err := db.Exec(
-		`UPDATE reviews SET status='approved', moderated_by=$1, moderated_at=NOW() WHERE id=$2`,
-		adminID, reviewID)
-
+	tx, err := db.Begin()
 	if err != nil {
+		log.Printf("Approve review error: %v", err)
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
+	defer tx.Rollback()
+
+	var authorID, previous string
+	err = tx.QueryRow(`
+		UPDATE reviews r SET status='approved', moderated_by=$1, moderated_at=NOW()
+		FROM (SELECT id, status FROM reviews WHERE id=$2 FOR UPDATE) old
+		WHERE r.id = old.id
+		RETURNING r.user_id, old.status`,
+		adminID, reviewID).Scan(&authorID, &previous)
+	if err == sql.ErrNoRows || isInvalidInput(err) {
 		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "review not found"})
 	}
+	if err != nil {
+		log.Printf("Approve review error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
+
+	publishEvent(tx, Event{
+		Type:       eventReviewModerated,
+		Data:       map[string]string{"id": reviewID, "status": "approved"},
+		UserIDs:    []string{authorID},
+		Permission: permReviewsModerate,
+	})
+
+	if previous != "approved" {
+		err := enqueueNotification(tx, authorID, notificationReviewApproved,
+			"Ваш отзыв опубликован", "Спасибо! Ваш отзыв прошёл модерацию и виден всем покупателям.", "/rate")
+		if err != nil {
+			log.Printf("Approve review notification error: %v", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Approve review commit error: %v", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
+	}
 	return c.JSON(http.StatusOK, map[string]string{"message": "review approved"})
 }
 
@@ -976,17 +7700,23 @@ func rejectReview(c echo.Context) error {
 	adminID := c.Get("user_id").(string)
 	reviewID := c.Param("id")
 
-	result, err := db.Exec(
-		`UPDATE reviews SET status='rejected', moderated_by=$1, moderated_at=NOW() WHERE id=$2`,
-		adminID, reviewID)
-
+	var authorID string
+	err := db.QueryRow(
+		`UPDATE reviews SET status='rejected', moderated_by=$1, moderated_at=NOW() WHERE id=$2 RETURNING user_id`,
+		adminID, reviewID).Scan(&authorID)
+	if err == sql.ErrNoRows || isInvalidInput(err) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "review not found"})
+	}
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error"})
 	}
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "review not found"})
-	}
+
+	publishEvent(db, Event{
+		Type:       eventReviewModerated,
+		Data:       map[string]string{"id": reviewID, "status": "rejected"},
+		UserIDs:    []string{authorID},
+		Permission: permReviewsModerate,
+	})
 	return c.NoContent(http.StatusOK)
 }
 
@@ -1022,6 +7752,11 @@ func validatePassword(password string) error {
 	return nil
 }
 
+// isInvalidInput — ошибка PostgreSQL о некорректном значении параметра (например, не UUID).
+func isInvalidInput(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "invalid input syntax")
+}
+
 func generateProfileTag() string {
 	return fmt.Sprintf("User%d", time.Now().UnixNano())
 }
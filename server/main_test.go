@@ -0,0 +1,1956 @@
+package main
+
+// Интеграционные тесты обработчиков поверх настоящей PostgreSQL. База задаётся переменной
+// TEST_DATABASE_URL, схема накатывается из schema_final.sql. Без TEST_DATABASE_URL тесты пропускаются:
+//
+//	TEST_DATABASE_URL=postgres://localhost/todolist_test?sslmode=disable go test ./...
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// init() в main.go требует JWT_SECRET, а переменные пакета инициализируются раньше init.
+var _ = setenvDefault("JWT_SECRET", "test-secret")
+
+func setenvDefault(key, value string) bool {
+	if os.Getenv(key) == "" {
+		os.Setenv(key, value)
+	}
+	return true
+}
+
+var testServer *echo.Echo
+
+func TestMain(m *testing.M) {
+	if dsn := os.Getenv("TEST_DATABASE_URL"); dsn != "" {
+		var err error
+		if db, err = sql.Open("postgres", dsn); err != nil {
+			log.Fatalf("Failed to open test database: %v", err)
+		}
+		schema, err := os.ReadFile("schema_final.sql")
+		if err != nil {
+			log.Fatalf("Failed to read schema: %v", err)
+		}
+		if _, err := db.Exec(string(schema)); err != nil {
+			log.Fatalf("Failed to apply schema: %v", err)
+		}
+		testServer = newServer()
+	}
+	os.Exit(m.Run())
+}
+
+func requireTestDB(t *testing.T) {
+	t.Helper()
+	if testServer == nil {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+}
+
+type testUser struct {
+	ID       string
+	Username string
+	Token    string
+}
+
+// apiRequest выполняет запрос к серверу от имени пользователя (token может быть пустым).
+func apiRequest(t *testing.T, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &payload)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	testServer.ServeHTTP(rec, req)
+	return rec
+}
+
+// mustRequest — apiRequest, который валит тест при неожиданном статусе и разбирает ответ в out.
+func mustRequest(t *testing.T, method, path, token string, body interface{}, status int, out interface{}) {
+	t.Helper()
+	rec := apiRequest(t, method, path, token, body)
+	if rec.Code != status {
+		t.Fatalf("%s %s: status %d, want %d: %s", method, path, rec.Code, status, rec.Body.String())
+	}
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decode response: %v", method, path, err)
+		}
+	}
+}
+
+func newTestUser(t *testing.T) testUser {
+	t.Helper()
+	u := testUser{Username: fmt.Sprintf("t%d", time.Now().UnixNano())}
+	creds := map[string]string{"username": u.Username, "password": "test-password-1"}
+
+	var registered struct{ ID string }
+	mustRequest(t, http.MethodPost, "/api/register", "", creds, http.StatusCreated, &registered)
+	var tokens struct{ Token string }
+	mustRequest(t, http.MethodPost, "/api/login", "", creds, http.StatusOK, &tokens)
+
+	u.ID, u.Token = registered.ID, tokens.Token
+	return u
+}
+
+// newTestAdmin — newTestUser с ролью admin; права проверяются на каждом запросе, поэтому токен не меняется.
+func newTestAdmin(t *testing.T) testUser {
+	t.Helper()
+	u := newTestUser(t)
+	if _, err := db.Exec(`INSERT INTO user_roles (user_id, role_id) SELECT $1, id FROM roles WHERE name=$2`,
+		u.ID, adminRoleName); err != nil {
+		t.Fatalf("grant admin: %v", err)
+	}
+	return u
+}
+
+// createTestProduct добавляет активный товар напрямую в базу: админские маршруты здесь не проверяются.
+func createTestProduct(t *testing.T, name string, price int) string {
+	t.Helper()
+	var id string
+	if err := db.QueryRow(`INSERT INTO products (name, price) VALUES ($1, $2) RETURNING id`, name, price).Scan(&id); err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+	return id
+}
+
+type testOrder struct {
+	ID     string
+	Status string
+	Total  int
+	Items  []struct {
+		Name     string
+		Price    int
+		Quantity int
+	}
+}
+
+// placeTestOrder кладёт товар в корзину и оформляет заказ.
+func placeTestOrder(t *testing.T, user testUser, productID string) testOrder {
+	t.Helper()
+	mustRequest(t, http.MethodPost, "/api/cart", user.Token, map[string]string{"product_id": productID}, http.StatusCreated, nil)
+	var order testOrder
+	mustRequest(t, http.MethodPost, "/api/orders", user.Token, nil, http.StatusCreated, &order)
+	return order
+}
+
+func TestCheckoutSnapshotsPrices(t *testing.T) {
+	requireTestDB(t)
+	alice := newTestUser(t)
+	productID := createTestProduct(t, "Капучино", 150)
+
+	mustRequest(t, http.MethodPost, "/api/orders", alice.Token, nil, http.StatusBadRequest, nil)
+
+	created := placeTestOrder(t, alice, productID)
+	if created.Total != 150 || len(created.Items) != 1 {
+		t.Fatalf("created order = %+v, want one line totalling 150", created)
+	}
+
+	var left int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM cart_items WHERE user_id=$1`, alice.ID).Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("cart has %d lines after checkout, want 0", left)
+	}
+
+	if _, err := db.Exec(`UPDATE products SET name='Латте', price=990 WHERE id=$1`, productID); err != nil {
+		t.Fatal(err)
+	}
+	var order testOrder
+	mustRequest(t, http.MethodGet, "/api/orders/"+created.ID, alice.Token, nil, http.StatusOK, &order)
+	if order.Total != 150 || len(order.Items) != 1 || order.Items[0].Name != "Капучино" || order.Items[0].Price != 150 {
+		t.Errorf("order after price change = %+v, want the checkout snapshot", order)
+	}
+
+	bob := newTestUser(t)
+	mustRequest(t, http.MethodGet, "/api/orders/"+created.ID, bob.Token, nil, http.StatusNotFound, nil)
+	mustRequest(t, http.MethodGet, "/api/orders/not-a-uuid", alice.Token, nil, http.StatusNotFound, nil)
+}
+
+func TestMalformedShopIDsAreNotFound(t *testing.T) {
+	requireTestDB(t)
+	alice := newTestUser(t)
+
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodPost, "/api/cart"},
+		{http.MethodPatch, "/api/cart/not-a-uuid"},
+		{http.MethodDelete, "/api/cart/not-a-uuid"},
+		{http.MethodGet, "/api/orders/not-a-uuid"},
+	} {
+		body := map[string]interface{}{"product_id": "not-a-uuid", "quantity": 1}
+		if rec := apiRequest(t, tc.method, tc.path, alice.Token, body); rec.Code != http.StatusNotFound {
+			t.Errorf("%s %s: status %d, want 404: %s", tc.method, tc.path, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestOrderTransitions(t *testing.T) {
+	requireTestDB(t)
+	alice, admin := newTestUser(t), newTestAdmin(t)
+	order := placeTestOrder(t, alice, createTestProduct(t, "Эспрессо", 120))
+	transition := "/api/admin/orders/" + order.ID + "/transition"
+
+	mustRequest(t, http.MethodPost, transition, alice.Token, map[string]string{"status": "accepted"}, http.StatusForbidden, nil)
+	mustRequest(t, http.MethodPost, transition, admin.Token, map[string]string{"status": "bogus"}, http.StatusBadRequest, nil)
+	mustRequest(t, http.MethodPost, transition, admin.Token, map[string]string{"status": "ready"}, http.StatusConflict, nil)
+	mustRequest(t, http.MethodPost, transition, admin.Token, map[string]string{"status": "accepted"}, http.StatusOK, nil)
+	mustRequest(t, http.MethodPost, transition, admin.Token, map[string]string{"status": "completed"}, http.StatusConflict, nil)
+	mustRequest(t, http.MethodPost, transition, admin.Token, map[string]string{"status": "cancelled"}, http.StatusOK, nil)
+	mustRequest(t, http.MethodPost, transition, admin.Token, map[string]string{"status": "accepted"}, http.StatusConflict, nil)
+	mustRequest(t, http.MethodPost, "/api/admin/orders/not-a-uuid/transition", admin.Token,
+		map[string]string{"status": "accepted"}, http.StatusNotFound, nil)
+
+	var got struct {
+		Status  string
+		History []struct {
+			FromStatus *string `json:"from_status"`
+			ToStatus   string  `json:"to_status"`
+		}
+	}
+	mustRequest(t, http.MethodGet, "/api/admin/orders/"+order.ID, admin.Token, nil, http.StatusOK, &got)
+	if got.Status != "cancelled" || len(got.History) != 3 {
+		t.Fatalf("order = %+v, want cancelled with three history entries", got)
+	}
+	if got.History[0].FromStatus != nil || got.History[1].ToStatus != "accepted" || got.History[2].ToStatus != "cancelled" {
+		t.Errorf("history = %+v, want new -> accepted -> cancelled", got.History)
+	}
+	mustRequest(t, http.MethodGet, "/api/admin/orders/not-a-uuid", admin.Token, nil, http.StatusNotFound, nil)
+}
+
+// cartQuantities возвращает количество по строкам корзины пользователя.
+func cartQuantities(t *testing.T, userID string) map[string]int {
+	t.Helper()
+	rows, err := db.Query(`SELECT id, quantity FROM cart_items WHERE user_id=$1`, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	lines := map[string]int{}
+	for rows.Next() {
+		var id string
+		var quantity int
+		if err := rows.Scan(&id, &quantity); err != nil {
+			t.Fatal(err)
+		}
+		lines[id] = quantity
+	}
+	return lines
+}
+
+func TestCartLineQuantities(t *testing.T) {
+	requireTestDB(t)
+	alice, bob := newTestUser(t), newTestUser(t)
+	latte := createTestProduct(t, "Латте", 200)
+	tea := createTestProduct(t, "Чай", 90)
+
+	var first, second struct {
+		ID       string
+		Quantity int
+	}
+	mustRequest(t, http.MethodPost, "/api/cart", alice.Token, map[string]interface{}{"product_id": latte}, http.StatusCreated, &first)
+	mustRequest(t, http.MethodPost, "/api/cart", alice.Token, map[string]interface{}{"product_id": latte, "quantity": 2}, http.StatusCreated, &second)
+	if second.ID != first.ID || second.Quantity != 3 {
+		t.Fatalf("second add = %+v, want line %s with quantity 3", second, first.ID)
+	}
+	var teaLine struct{ ID string }
+	mustRequest(t, http.MethodPost, "/api/cart", alice.Token, map[string]interface{}{"product_id": tea}, http.StatusCreated, &teaLine)
+	mustRequest(t, http.MethodPost, "/api/cart", alice.Token, map[string]interface{}{"product_id": tea, "quantity": -1}, http.StatusBadRequest, nil)
+	mustRequest(t, http.MethodPost, "/api/cart", alice.Token, map[string]interface{}{"product_id": "not-a-uuid"}, http.StatusNotFound, nil)
+
+	line := "/api/cart/" + first.ID
+	mustRequest(t, http.MethodPatch, line, bob.Token, map[string]int{"quantity": 9}, http.StatusNotFound, nil)
+	mustRequest(t, http.MethodDelete, line, bob.Token, nil, http.StatusNotFound, nil)
+	mustRequest(t, http.MethodPatch, line, alice.Token, map[string]int{"quantity": -1}, http.StatusBadRequest, nil)
+	mustRequest(t, http.MethodPatch, "/api/cart/not-a-uuid", alice.Token, map[string]int{"quantity": 1}, http.StatusNotFound, nil)
+	mustRequest(t, http.MethodDelete, "/api/cart/not-a-uuid", alice.Token, nil, http.StatusNotFound, nil)
+	mustRequest(t, http.MethodPatch, line, alice.Token, map[string]int{"quantity": 5}, http.StatusOK, nil)
+	if got := cartQuantities(t, alice.ID); got[first.ID] != 5 || got[teaLine.ID] != 1 {
+		t.Fatalf("cart = %v, want latte x5 and tea x1", got)
+	}
+
+	mustRequest(t, http.MethodPatch, line, alice.Token, map[string]int{"quantity": 0}, http.StatusOK, nil)
+	if got := cartQuantities(t, alice.ID); len(got) != 1 || got[teaLine.ID] != 1 {
+		t.Fatalf("cart after quantity 0 = %v, want only the tea line", got)
+	}
+	mustRequest(t, http.MethodDelete, "/api/cart/"+teaLine.ID, alice.Token, nil, http.StatusOK, nil)
+	mustRequest(t, http.MethodDelete, "/api/cart/"+teaLine.ID, alice.Token, nil, http.StatusNotFound, nil)
+	if got := cartQuantities(t, alice.ID); len(got) != 0 {
+		t.Errorf("cart after removal = %v, want empty", got)
+	}
+}
+
+type testCart struct {
+	Items []struct {
+		ProductID         string `json:"product_id"`
+		Subtotal          int
+		Available         bool
+		UnavailableReason string `json:"unavailable_reason"`
+	}
+	ItemCount      int   `json:"item_count"`
+	Total          int   `json:"total"`
+	TotalKopecks   int64 `json:"total_kopecks"`
+	HasUnavailable bool  `json:"has_unavailable"`
+}
+
+func TestCartTotalsExcludeInactiveProducts(t *testing.T) {
+	requireTestDB(t)
+	alice := newTestUser(t)
+	latte := createTestProduct(t, "Латте", 200)
+	tea := createTestProduct(t, "Чай", 90)
+	mustRequest(t, http.MethodPost, "/api/cart", alice.Token, map[string]interface{}{"product_id": latte, "quantity": 2}, http.StatusCreated, nil)
+	mustRequest(t, http.MethodPost, "/api/cart", alice.Token, map[string]interface{}{"product_id": tea}, http.StatusCreated, nil)
+	mustRequest(t, http.MethodPost, "/api/cart", alice.Token,
+		map[string]interface{}{"product_id": "00000000-0000-0000-0000-000000000000"}, http.StatusNotFound, nil)
+
+	var cart testCart
+	mustRequest(t, http.MethodGet, "/api/cart", alice.Token, nil, http.StatusOK, &cart)
+	if cart.Total != 490 || cart.TotalKopecks != 49000 || cart.ItemCount != 3 || cart.HasUnavailable {
+		t.Fatalf("cart = %+v, want 490 for three available items", cart)
+	}
+
+	if _, err := db.Exec(`UPDATE products SET is_active=false WHERE id=$1`, tea); err != nil {
+		t.Fatal(err)
+	}
+	mustRequest(t, http.MethodPost, "/api/cart", alice.Token, map[string]interface{}{"product_id": tea}, http.StatusUnprocessableEntity, nil)
+
+	mustRequest(t, http.MethodGet, "/api/cart", alice.Token, nil, http.StatusOK, &cart)
+	if cart.Total != 400 || cart.ItemCount != 2 || !cart.HasUnavailable || len(cart.Items) != 2 {
+		t.Fatalf("cart = %+v, want 400 with the tea line unavailable", cart)
+	}
+	for _, item := range cart.Items {
+		if item.ProductID == tea && (item.Available || item.UnavailableReason != "inactive") {
+			t.Errorf("tea line = %+v, want unavailable as inactive", item)
+		}
+	}
+	mustRequest(t, http.MethodPost, "/api/orders", alice.Token, nil, http.StatusUnprocessableEntity, nil)
+}
+
+type testTokens struct {
+	Token        string
+	RefreshToken string `json:"refresh_token"`
+}
+
+// loginTestUser открывает новую сессию пользователя (отдельную цепочку refresh-токенов).
+func loginTestUser(t *testing.T, u testUser) testTokens {
+	t.Helper()
+	var tokens testTokens
+	mustRequest(t, http.MethodPost, "/api/login", "",
+		map[string]string{"username": u.Username, "password": "test-password-1"}, http.StatusOK, &tokens)
+	return tokens
+}
+
+func refreshTestTokens(t *testing.T, refresh string, status int) testTokens {
+	t.Helper()
+	var tokens testTokens
+	var out interface{}
+	if status == http.StatusOK {
+		out = &tokens
+	}
+	mustRequest(t, http.MethodPost, "/api/token/refresh", "", map[string]string{"refresh_token": refresh}, status, out)
+	return tokens
+}
+
+func TestRefreshTokenRotationAndReuse(t *testing.T) {
+	requireTestDB(t)
+	alice := newTestUser(t)
+	laptop, phone := loginTestUser(t, alice), loginTestUser(t, alice)
+
+	second := refreshTestTokens(t, laptop.RefreshToken, http.StatusOK)
+	if second.RefreshToken == "" || second.RefreshToken == laptop.RefreshToken {
+		t.Fatalf("refresh did not rotate the token: %+v", second)
+	}
+	third := refreshTestTokens(t, second.RefreshToken, http.StatusOK)
+	mustRequest(t, http.MethodGet, "/api/profile", third.Token, nil, http.StatusOK, nil)
+
+	// Повторное предъявление уже использованного токена отзывает всю цепочку.
+	refreshTestTokens(t, laptop.RefreshToken, http.StatusUnauthorized)
+	refreshTestTokens(t, third.RefreshToken, http.StatusUnauthorized)
+	mustRequest(t, http.MethodGet, "/api/profile", third.Token, nil, http.StatusUnauthorized, nil)
+
+	// Другая сессия того же пользователя не затронута.
+	mustRequest(t, http.MethodGet, "/api/profile", phone.Token, nil, http.StatusOK, nil)
+	phone = refreshTestTokens(t, phone.RefreshToken, http.StatusOK)
+
+	mustRequest(t, http.MethodPost, "/api/logout", phone.Token, nil, http.StatusOK, nil)
+	refreshTestTokens(t, phone.RefreshToken, http.StatusUnauthorized)
+	mustRequest(t, http.MethodGet, "/api/profile", phone.Token, nil, http.StatusUnauthorized, nil)
+	refreshTestTokens(t, "not-a-token", http.StatusUnauthorized)
+}
+
+func TestExpiredRefreshTokenIsRejected(t *testing.T) {
+	requireTestDB(t)
+	alice := newTestUser(t)
+	tokens := loginTestUser(t, alice)
+	if _, err := db.Exec(`UPDATE sessions SET expires_at = NOW() - INTERVAL '1 minute' WHERE token_hash=$1`,
+		hashToken(tokens.RefreshToken)); err != nil {
+		t.Fatal(err)
+	}
+	refreshTestTokens(t, tokens.RefreshToken, http.StatusUnauthorized)
+	mustRequest(t, http.MethodGet, "/api/profile", tokens.Token, nil, http.StatusUnauthorized, nil)
+}
+
+// captureMailer запоминает отправленные письма вместо отправки.
+type captureMailer struct {
+	bodies []string
+}
+
+func (m *captureMailer) Send(to, subject, body string) error {
+	m.bodies = append(m.bodies, body)
+	return nil
+}
+
+var resetLinkToken = regexp.MustCompile(`reset-password\?token=(\S+)`)
+
+// requestPasswordReset запрашивает письмо для сброса пароля и достаёт токен из ссылки.
+func requestPasswordReset(t *testing.T, u testUser) string {
+	t.Helper()
+	sent := &captureMailer{}
+	prev := mailer
+	mailer = sent
+	defer func() { mailer = prev }()
+
+	mustRequest(t, http.MethodPost, "/api/password/forgot", "", map[string]string{"username": u.Username}, http.StatusOK, nil)
+	if len(sent.bodies) != 1 {
+		t.Fatalf("sent %d reset mails, want 1", len(sent.bodies))
+	}
+	m := resetLinkToken.FindStringSubmatch(sent.bodies[0])
+	if m == nil {
+		t.Fatalf("no reset link in mail: %s", sent.bodies[0])
+	}
+	return m[1]
+}
+
+func TestPasswordResetTokenIsSingleUse(t *testing.T) {
+	requireTestDB(t)
+	alice := newTestUser(t)
+	if _, err := db.Exec(`UPDATE users SET email=$1 WHERE id=$2`, alice.Username+"@example.com", alice.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := requestPasswordReset(t, alice), requestPasswordReset(t, alice)
+	reset := func(token, password string, status int) {
+		t.Helper()
+		mustRequest(t, http.MethodPost, "/api/password/reset", "",
+			map[string]string{"token": token, "new_password": password}, status, nil)
+	}
+	reset(first, "short", http.StatusBadRequest)
+	reset(first, "new-password-2", http.StatusOK)
+	reset(first, "new-password-3", http.StatusBadRequest)
+	// Остальные выданные токены гаснут вместе с использованным.
+	reset(second, "new-password-3", http.StatusBadRequest)
+
+	// Сброс пароля завершает все сессии.
+	mustRequest(t, http.MethodGet, "/api/profile", alice.Token, nil, http.StatusUnauthorized, nil)
+	// Неудачный вход идёт с отдельного адреса, чтобы не копить неудачи на общем IP тестов.
+	resetLoginThrottle(t, "ip", "203.0.113.1")
+	login := func(password string, status int) {
+		t.Helper()
+		if rec := loginFrom(t, "203.0.113.1", alice.Username, password); rec.Code != status {
+			t.Fatalf("login: status %d, want %d: %s", rec.Code, status, rec.Body.String())
+		}
+	}
+	login("test-password-1", http.StatusUnauthorized)
+	login("new-password-2", http.StatusOK)
+
+	expired := requestPasswordReset(t, alice)
+	if _, err := db.Exec(`UPDATE password_reset_tokens SET expires_at = NOW() - INTERVAL '1 minute' WHERE token_hash=$1`,
+		hashToken(expired)); err != nil {
+		t.Fatal(err)
+	}
+	reset(expired, "new-password-4", http.StatusBadRequest)
+	login("new-password-2", http.StatusOK)
+}
+
+func TestPasswordResetForUnknownUserSendsNothing(t *testing.T) {
+	requireTestDB(t)
+	sent := &captureMailer{}
+	prev := mailer
+	mailer = sent
+	defer func() { mailer = prev }()
+
+	mustRequest(t, http.MethodPost, "/api/password/forgot", "", map[string]string{"username": "nobody-here"}, http.StatusOK, nil)
+	// Пользователь без email получает тот же ответ, но письмо не уходит.
+	mustRequest(t, http.MethodPost, "/api/password/forgot", "", map[string]string{"username": newTestUser(t).Username}, http.StatusOK, nil)
+	if len(sent.bodies) != 0 {
+		t.Errorf("sent %d mails, want none", len(sent.bodies))
+	}
+}
+
+func TestEvaluatePromo(t *testing.T) {
+	now := time.Date(2026, time.March, 4, 12, 0, 0, 0, time.UTC)
+	before, after := now.Add(-time.Hour), now.Add(time.Hour)
+	latte, tea := "latte", "tea"
+	limit := func(n int) *int { return &n }
+	line := func(productID string, price, quantity int) CartItem {
+		return CartItem{ProductID: productID, Price: price, Quantity: quantity, Subtotal: price * quantity, Available: true}
+	}
+	cart := []CartItem{line(latte, 200, 3), line(tea, 90, 1)}
+	// Один товар в трёх строках с разными опциями и ценами.
+	variants := []CartItem{line(latte, 250, 3), line(latte, 200, 1), line(tea, 90, 1)}
+
+	tests := []struct {
+		name         string
+		promo        PromoCode
+		items        []CartItem
+		inactive     bool
+		usedTotal    int
+		usedByUser   int
+		wantDiscount int
+		wantReason   string
+	}{
+		{name: "percent", promo: PromoCode{Kind: promoKindPercent, Value: 10}, items: cart, wantDiscount: 69},
+		{name: "fixed", promo: PromoCode{Kind: promoKindFixed, Value: 100}, items: cart, wantDiscount: 100},
+		{name: "fixed is capped by subtotal", promo: PromoCode{Kind: promoKindFixed, Value: 5000}, items: cart, wantDiscount: 690},
+		{name: "buy two get one", promo: PromoCode{Kind: promoKindBuyNGet, ProductID: &latte, BuyQuantity: 2}, items: cart, wantDiscount: 200},
+		{name: "buy one get one pools lines and frees the cheapest units",
+			promo: PromoCode{Kind: promoKindBuyNGet, ProductID: &latte, BuyQuantity: 1}, items: variants, wantDiscount: 200 + 250},
+		{name: "buy three get one across lines",
+			promo: PromoCode{Kind: promoKindBuyNGet, ProductID: &latte, BuyQuantity: 3}, items: variants, wantDiscount: 200},
+		{name: "buy-n without enough units", promo: PromoCode{Kind: promoKindBuyNGet, ProductID: &tea, BuyQuantity: 1}, items: cart,
+			wantReason: "cart has no eligible products for this promo code"},
+		{name: "min order total reached", promo: PromoCode{Kind: promoKindFixed, Value: 50, MinOrderTotal: 690}, items: cart, wantDiscount: 50},
+		{name: "min order total not reached", promo: PromoCode{Kind: promoKindFixed, Value: 50, MinOrderTotal: 691}, items: cart,
+			wantReason: "order total must be at least 691"},
+		{name: "inside validity window", promo: PromoCode{Kind: promoKindFixed, Value: 50, StartsAt: &before, EndsAt: &after}, items: cart,
+			wantDiscount: 50},
+		{name: "not started", promo: PromoCode{Kind: promoKindFixed, Value: 50, StartsAt: &after}, items: cart,
+			wantReason: "promo code is not valid yet"},
+		{name: "ends exactly now", promo: PromoCode{Kind: promoKindFixed, Value: 50, EndsAt: &now}, items: cart,
+			wantReason: "promo code has expired"},
+		{name: "inactive", promo: PromoCode{Kind: promoKindFixed, Value: 50}, items: cart, inactive: true,
+			wantReason: "promo code is not active"},
+		{name: "under the usage limits", promo: PromoCode{Kind: promoKindFixed, Value: 50, MaxUses: limit(5), MaxUsesPerUser: limit(1)}, items: cart,
+			usedTotal: 4, wantDiscount: 50},
+		{name: "total usage limit", promo: PromoCode{Kind: promoKindFixed, Value: 50, MaxUses: limit(5)}, items: cart,
+			usedTotal: 5, wantReason: "promo code usage limit reached"},
+		{name: "per-user usage limit", promo: PromoCode{Kind: promoKindFixed, Value: 50, MaxUsesPerUser: limit(1)}, items: cart,
+			usedTotal: 1, usedByUser: 1, wantReason: "you have already used this promo code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.promo.IsActive = !tt.inactive
+			subtotal := 0
+			for _, item := range tt.items {
+				subtotal += item.Subtotal
+			}
+			discount, reason := evaluatePromo(tt.promo, tt.items, subtotal, now, tt.usedTotal, tt.usedByUser)
+			if discount != tt.wantDiscount || reason != tt.wantReason {
+				t.Errorf("evaluatePromo = %d, %q; want %d, %q", discount, reason, tt.wantDiscount, tt.wantReason)
+			}
+		})
+	}
+}
+
+// loginFrom выполняет вход с указанного адреса клиента (X-Real-IP).
+func loginFrom(t *testing.T, ip, username, password string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/login", bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderXRealIP, ip)
+	rec := httptest.NewRecorder()
+	testServer.ServeHTTP(rec, req)
+	return rec
+}
+
+// resetLoginThrottle снимает неудачи, оставшиеся от прошлых запусков на фиксированном ключе.
+func resetLoginThrottle(t *testing.T, kind, key string) {
+	t.Helper()
+	if err := clearLoginFailures(kind, key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loginFailures(t *testing.T, kind, key string) int {
+	t.Helper()
+	var failures int
+	err := db.QueryRow(`SELECT failures FROM login_throttles WHERE kind=$1 AND key=$2`, kind, key).Scan(&failures)
+	if err == sql.ErrNoRows {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return failures
+}
+
+// extendLoginLock продлевает текущую блокировку, чтобы проверки 429 не зависели от скорости тестов.
+func extendLoginLock(t *testing.T, kind, key string, d time.Duration) {
+	t.Helper()
+	_, err := db.Exec(`UPDATE login_throttles SET locked_until = NOW() + $3 * INTERVAL '1 second' WHERE kind=$1 AND key=$2`,
+		kind, key, int(d.Seconds()))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	cases := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{9, 32 * time.Second},
+		{10, loginLockout},
+		{25, loginLockout},
+	}
+	for _, tc := range cases {
+		if got := loginBackoff(tc.failures); got != tc.want {
+			t.Errorf("loginBackoff(%d) = %v, want %v", tc.failures, got, tc.want)
+		}
+	}
+}
+
+func TestLoginBackoffByUsername(t *testing.T) {
+	requireTestDB(t)
+	const ip = "203.0.113.10"
+	resetLoginThrottle(t, "ip", ip)
+	alice := newTestUser(t)
+
+	for i := 0; i < 4; i++ {
+		if rec := loginFrom(t, ip, alice.Username, "wrong-password"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status %d, want 401", i+1, rec.Code)
+		}
+	}
+	// Первые три неудачи бесплатны, четвёртая блокирует вход на loginBackoffBase.
+	var delay float64
+	err := db.QueryRow(`
+		SELECT EXTRACT(EPOCH FROM locked_until - last_failure_at)
+		FROM login_throttles WHERE kind='username' AND key=$1 AND failures=4`,
+		alice.Username).Scan(&delay)
+	if err != nil {
+		t.Fatalf("username throttle after 4 failures: %v", err)
+	}
+	if delay < 0.5 || delay > 1.5 {
+		t.Errorf("backoff after 4 failures = %.1fs, want 1s", delay)
+	}
+
+	extendLoginLock(t, "username", alice.Username, 30*time.Second)
+	rec := loginFrom(t, ip, alice.Username, "test-password-1")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("login during backoff: status %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+	// Пока вход заблокирован, попытки не проверяются и не считаются.
+	loginFrom(t, ip, alice.Username, "wrong-password")
+	if got := loginFailures(t, "username", alice.Username); got != 4 {
+		t.Errorf("failures = %d, want 4", got)
+	}
+
+	// Успешный вход после блокировки сбрасывает счётчик имени пользователя.
+	extendLoginLock(t, "username", alice.Username, 0)
+	if rec := loginFrom(t, ip, alice.Username, "test-password-1"); rec.Code != http.StatusOK {
+		t.Fatalf("login after backoff: status %d, want 200", rec.Code)
+	}
+	if got := loginFailures(t, "username", alice.Username); got != 0 {
+		t.Errorf("failures after successful login = %d, want 0", got)
+	}
+}
+
+func TestLoginBackoffByIP(t *testing.T) {
+	requireTestDB(t)
+	const ip, otherIP = "203.0.113.11", "203.0.113.12"
+	resetLoginThrottle(t, "ip", ip)
+	resetLoginThrottle(t, "ip", otherIP)
+	alice := newTestUser(t)
+
+	// Перебор разных имён с одного адреса упирается в ограничение по IP.
+	for i := 0; i < 4; i++ {
+		loginFrom(t, ip, fmt.Sprintf("nobody-%d-%d", time.Now().UnixNano(), i), "wrong-password")
+	}
+	if got := loginFailures(t, "ip", ip); got != 4 {
+		t.Fatalf("ip failures = %d, want 4", got)
+	}
+
+	extendLoginLock(t, "ip", ip, 30*time.Second)
+	if rec := loginFrom(t, ip, alice.Username, "test-password-1"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("login from throttled ip: status %d, want 429", rec.Code)
+	}
+	if rec := loginFrom(t, otherIP, alice.Username, "test-password-1"); rec.Code != http.StatusOK {
+		t.Fatalf("login from another ip: status %d, want 200", rec.Code)
+	}
+}
+
+func TestLoginLockoutAndAdminClear(t *testing.T) {
+	requireTestDB(t)
+	const ip = "203.0.113.13"
+	resetLoginThrottle(t, "ip", ip)
+	alice, admin := newTestUser(t), newTestAdmin(t)
+
+	if _, err := db.Exec(`INSERT INTO login_throttles (kind, key, failures) VALUES ('username', $1, $2)`,
+		alice.Username, loginMaxFailures-1); err != nil {
+		t.Fatal(err)
+	}
+	if rec := loginFrom(t, ip, alice.Username, "wrong-password"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("last allowed attempt: status %d, want 401", rec.Code)
+	}
+	rec := loginFrom(t, ip, alice.Username, "test-password-1")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("login after lockout: status %d, want 429", rec.Code)
+	}
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil || retryAfter < int(loginLockout.Seconds())-60 || retryAfter > int(loginLockout.Seconds()) {
+		t.Errorf("Retry-After = %q, want about %v", rec.Header().Get("Retry-After"), loginLockout)
+	}
+
+	mustRequest(t, http.MethodGet, "/api/admin/lockouts", alice.Token, nil, http.StatusForbidden, nil)
+	var lockouts []LoginThrottle
+	mustRequest(t, http.MethodGet, "/api/admin/lockouts", admin.Token, nil, http.StatusOK, &lockouts)
+	var lockoutID string
+	for _, l := range lockouts {
+		if l.Kind == "username" && l.Key == alice.Username {
+			if !l.Locked || l.Failures != loginMaxFailures {
+				t.Errorf("lockout = %+v, want locked with %d failures", l, loginMaxFailures)
+			}
+			lockoutID = l.ID
+		}
+	}
+	if lockoutID == "" {
+		t.Fatalf("lockout for %s not listed", alice.Username)
+	}
+
+	mustRequest(t, http.MethodDelete, "/api/admin/lockouts/not-a-uuid", admin.Token, nil, http.StatusNotFound, nil)
+	mustRequest(t, http.MethodDelete, "/api/admin/lockouts/"+lockoutID, admin.Token, nil, http.StatusOK, nil)
+	mustRequest(t, http.MethodDelete, "/api/admin/lockouts/"+lockoutID, admin.Token, nil, http.StatusNotFound, nil)
+	if rec := loginFrom(t, ip, alice.Username, "test-password-1"); rec.Code != http.StatusOK {
+		t.Fatalf("login after clear: status %d, want 200", rec.Code)
+	}
+}
+
+func TestUserRolesGrantPermissions(t *testing.T) {
+	requireTestDB(t)
+	admin, alice := newTestAdmin(t), newTestUser(t)
+	rolesPath := "/api/admin/users/" + alice.ID + "/roles"
+
+	mustRequest(t, http.MethodGet, "/api/admin/reviews", alice.Token, nil, http.StatusForbidden, nil)
+	mustRequest(t, http.MethodGet, rolesPath, alice.Token, nil, http.StatusForbidden, nil)
+
+	mustRequest(t, http.MethodPut, rolesPath, admin.Token, map[string][]string{"roles": {"moderator", "no-such-role"}},
+		http.StatusBadRequest, nil)
+	mustRequest(t, http.MethodPut, rolesPath, admin.Token, map[string][]string{"roles": {"moderator"}}, http.StatusOK, nil)
+
+	var granted struct {
+		Roles       []string
+		Permissions []string
+	}
+	mustRequest(t, http.MethodGet, rolesPath, admin.Token, nil, http.StatusOK, &granted)
+	if len(granted.Roles) != 1 || granted.Roles[0] != "moderator" ||
+		len(granted.Permissions) != 1 || granted.Permissions[0] != permReviewsModerate {
+		t.Errorf("roles = %+v, want moderator with %s", granted, permReviewsModerate)
+	}
+
+	// Права проверяются на каждом запросе: уже выданный токен получает новую роль сразу.
+	mustRequest(t, http.MethodGet, "/api/admin/reviews", alice.Token, nil, http.StatusOK, nil)
+	mustRequest(t, http.MethodGet, "/api/admin/products", alice.Token, nil, http.StatusForbidden, nil)
+
+	mustRequest(t, http.MethodPut, rolesPath, admin.Token, map[string][]string{"roles": {}}, http.StatusOK, nil)
+	mustRequest(t, http.MethodGet, "/api/admin/reviews", alice.Token, nil, http.StatusForbidden, nil)
+
+	for _, path := range []string{"/api/admin/users/not-a-uuid/roles", "/api/admin/users/00000000-0000-0000-0000-000000000000/roles"} {
+		mustRequest(t, http.MethodGet, path, admin.Token, nil, http.StatusNotFound, nil)
+		mustRequest(t, http.MethodPut, path, admin.Token, map[string][]string{"roles": {"moderator"}}, http.StatusNotFound, nil)
+	}
+}
+
+func TestAdminBlockAndDeleteUser(t *testing.T) {
+	requireTestDB(t)
+	const ip = "203.0.113.20"
+	resetLoginThrottle(t, "ip", ip)
+	admin, alice := newTestAdmin(t), newTestUser(t)
+	userPath := "/api/admin/users/" + alice.ID
+
+	var listed AdminUser
+	mustRequest(t, http.MethodGet, userPath, admin.Token, nil, http.StatusOK, &listed)
+	if listed.ActiveSessions == nil || *listed.ActiveSessions != 1 {
+		t.Errorf("active sessions = %v, want 1", listed.ActiveSessions)
+	}
+
+	// Блокировка сразу обрывает сессии и не даёт войти снова.
+	mustRequest(t, http.MethodPatch, userPath, admin.Token, map[string]bool{"is_blocked": true}, http.StatusOK, nil)
+	mustRequest(t, http.MethodGet, "/api/profile", alice.Token, nil, http.StatusUnauthorized, nil)
+	if rec := loginFrom(t, ip, alice.Username, "test-password-1"); rec.Code != http.StatusForbidden {
+		t.Fatalf("login while blocked: status %d, want 403", rec.Code)
+	}
+	mustRequest(t, http.MethodPatch, userPath, admin.Token, map[string]bool{"is_blocked": false}, http.StatusOK, nil)
+	alice.Token = loginTestUser(t, alice).Token
+
+	mustRequest(t, http.MethodPost, userPath+"/logout", admin.Token, nil, http.StatusOK, nil)
+	mustRequest(t, http.MethodGet, "/api/profile", alice.Token, nil, http.StatusUnauthorized, nil)
+
+	mustRequest(t, http.MethodPatch, "/api/admin/users/"+admin.ID, admin.Token, map[string]bool{"is_blocked": true},
+		http.StatusConflict, nil)
+	mustRequest(t, http.MethodDelete, userPath, admin.Token, nil, http.StatusOK, nil)
+	mustRequest(t, http.MethodDelete, userPath, admin.Token, nil, http.StatusNotFound, nil)
+	if rec := loginFrom(t, ip, alice.Username, "test-password-1"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("login after delete: status %d, want 401", rec.Code)
+	}
+	mustRequest(t, http.MethodPatch, userPath, admin.Token, map[string]bool{"is_blocked": false}, http.StatusNotFound, nil)
+}
+
+func TestMalformedUserIDsAreNotFound(t *testing.T) {
+	requireTestDB(t)
+	admin := newTestAdmin(t)
+	for _, id := range []string{"not-a-uuid", "00000000-0000-0000-0000-000000000000"} {
+		path := "/api/admin/users/" + id
+		mustRequest(t, http.MethodGet, path, admin.Token, nil, http.StatusNotFound, nil)
+		mustRequest(t, http.MethodPatch, path, admin.Token, map[string]bool{"is_blocked": true}, http.StatusNotFound, nil)
+		mustRequest(t, http.MethodPost, path+"/logout", admin.Token, nil, http.StatusNotFound, nil)
+		mustRequest(t, http.MethodDelete, path, admin.Token, nil, http.StatusNotFound, nil)
+	}
+}
+
+func createTestGroup(t *testing.T, owner testUser) string {
+	t.Helper()
+	var group struct{ ID string }
+	mustRequest(t, http.MethodPost, "/api/groups", owner.Token, map[string]string{"title": "Группа"}, http.StatusCreated, &group)
+	return group.ID
+}
+
+func createTestTask(t *testing.T, owner testUser, groupID string) string {
+	t.Helper()
+	var task struct{ ID string }
+	mustRequest(t, http.MethodPost, "/api/groups/"+groupID+"/tasks", owner.Token,
+		map[string]string{"title": "Задача"}, http.StatusCreated, &task)
+	return task.ID
+}
+
+// addGroupMember приглашает пользователя в группу с ролью role и принимает приглашение от его имени.
+func addGroupMember(t *testing.T, owner, member testUser, groupID, role string) {
+	t.Helper()
+	mustRequest(t, http.MethodPost, "/api/groups/"+groupID+"/members", owner.Token,
+		map[string]string{"user": member.Username, "role": role}, http.StatusCreated, nil)
+	mustRequest(t, http.MethodPost, "/api/invitations/"+groupID+"/accept", member.Token, nil, http.StatusOK, nil)
+}
+
+// groupState — то, что чужой пользователь не должен суметь изменить в группе и её задачах.
+type groupState struct {
+	Title        string
+	Deleted      bool
+	TaskCount    int
+	TaskTitles   string
+	TaskDone     int
+	DeletedTasks int
+	Members      string
+	Positions    string
+	Items        string
+	Labels       string
+}
+
+func loadGroupState(t *testing.T, groupID string) groupState {
+	t.Helper()
+	var s groupState
+	err := db.QueryRow(`
+		SELECT g.title, g.deleted_at IS NOT NULL,
+			(SELECT COUNT(*) FROM tasks WHERE group_id = g.id),
+			(SELECT COALESCE(string_agg(title, ',' ORDER BY id), '') FROM tasks WHERE group_id = g.id),
+			(SELECT COUNT(*) FROM tasks WHERE group_id = g.id AND done),
+			(SELECT COUNT(*) FROM tasks WHERE group_id = g.id AND deleted_at IS NOT NULL),
+			(SELECT COALESCE(string_agg(user_id || ':' || role || ':' || status, ',' ORDER BY user_id), '')
+			 FROM group_members WHERE group_id = g.id),
+			(SELECT COALESCE(string_agg(id || ':' || position, ',' ORDER BY id), '') FROM tasks WHERE group_id = g.id),
+			(SELECT COALESCE(string_agg(i.id || ':' || i.title || ':' || i.done || ':' || i.position, ',' ORDER BY i.id), '')
+			 FROM task_items i JOIN tasks t ON t.id = i.task_id WHERE t.group_id = g.id),
+			(SELECT COALESCE(string_agg(tl.task_id || ':' || tl.label_id, ',' ORDER BY tl.task_id, tl.label_id), '')
+			 FROM task_labels tl JOIN tasks t ON t.id = tl.task_id WHERE t.group_id = g.id)
+		FROM groups g WHERE g.id = $1`, groupID).
+		Scan(&s.Title, &s.Deleted, &s.TaskCount, &s.TaskTitles, &s.TaskDone, &s.DeletedTasks, &s.Members, &s.Positions, &s.Items, &s.Labels)
+	if err != nil {
+		t.Fatalf("load group state: %v", err)
+	}
+	return s
+}
+
+type accessCase struct {
+	method, path string
+	body         interface{}
+}
+
+// assertDenied проверяет, что каждый запрос отклонён со статусом status и не изменил группу.
+func assertDenied(t *testing.T, user testUser, groupID string, status int, cases []accessCase) {
+	t.Helper()
+	before := loadGroupState(t, groupID)
+	for _, tc := range cases {
+		if rec := apiRequest(t, tc.method, tc.path, user.Token, tc.body); rec.Code != status {
+			t.Errorf("%s %s: status %d, want %d: %s", tc.method, tc.path, rec.Code, status, rec.Body.String())
+		}
+	}
+	if after := loadGroupState(t, groupID); after != before {
+		t.Errorf("group changed by denied requests: before %+v, after %+v", before, after)
+	}
+}
+
+func TestForeignGroupAccessIsDenied(t *testing.T) {
+	requireTestDB(t)
+	alice, bob := newTestUser(t), newTestUser(t)
+	groupID := createTestGroup(t, alice)
+	taskID := createTestTask(t, alice, groupID)
+
+	rec := apiRequest(t, http.MethodGet, "/api/groups/"+groupID+"/tasks", bob.Token, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("GET foreign tasks: status %d, want 404: %s", rec.Code, rec.Body.String())
+	}
+	if bytes.Contains(rec.Body.Bytes(), []byte(taskID)) {
+		t.Fatalf("GET foreign tasks leaked the task list: %s", rec.Body.String())
+	}
+
+	done := true
+	assertDenied(t, bob, groupID, http.StatusNotFound, []accessCase{
+		{http.MethodPost, "/api/groups/" + groupID + "/tasks", map[string]string{"title": "Чужая"}},
+		{http.MethodPut, "/api/tasks/" + taskID, map[string]interface{}{"title": "Взлом", "done": &done}},
+		{http.MethodDelete, "/api/tasks/" + taskID, nil},
+		{http.MethodPut, "/api/groups/" + groupID, map[string]string{"title": "Взлом"}},
+		{http.MethodDelete, "/api/groups/" + groupID, nil},
+		{http.MethodGet, "/api/groups/" + groupID + "/members", nil},
+		{http.MethodPost, "/api/groups/" + groupID + "/members", map[string]string{"user": bob.Username, "role": groupRoleOwner}},
+	})
+
+	// Некорректный id отдаётся как отсутствующая группа или задача, а не как ошибка сервера.
+	mustRequest(t, http.MethodGet, "/api/groups/not-a-uuid/tasks", alice.Token, nil, http.StatusNotFound, nil)
+	mustRequest(t, http.MethodPut, "/api/tasks/not-a-uuid", alice.Token, map[string]string{"title": "Нет"}, http.StatusNotFound, nil)
+	mustRequest(t, http.MethodDelete, "/api/tasks/not-a-uuid", alice.Token, nil, http.StatusNotFound, nil)
+}
+
+func TestViewerCannotModifyGroup(t *testing.T) {
+	requireTestDB(t)
+	alice, bob := newTestUser(t), newTestUser(t)
+	groupID := createTestGroup(t, alice)
+	taskID := createTestTask(t, alice, groupID)
+	addGroupMember(t, alice, bob, groupID, groupRoleViewer)
+
+	mustRequest(t, http.MethodGet, "/api/groups/"+groupID+"/tasks", bob.Token, nil, http.StatusOK, nil)
+
+	done := true
+	assertDenied(t, bob, groupID, http.StatusForbidden, []accessCase{
+		{http.MethodPost, "/api/groups/" + groupID + "/tasks", map[string]string{"title": "Чужая"}},
+		{http.MethodPut, "/api/tasks/" + taskID, map[string]interface{}{"title": "Взлом", "done": &done}},
+		{http.MethodDelete, "/api/tasks/" + taskID, nil},
+		{http.MethodPut, "/api/groups/" + groupID, map[string]string{"title": "Взлом"}},
+		{http.MethodDelete, "/api/groups/" + groupID, nil},
+		{http.MethodPut, "/api/groups/" + groupID + "/members/" + bob.ID, map[string]string{"role": groupRoleOwner}},
+	})
+}
+
+func TestForeignTaskReorderIsDenied(t *testing.T) {
+	requireTestDB(t)
+	alice, bob, carol := newTestUser(t), newTestUser(t), newTestUser(t)
+	groupID := createTestGroup(t, alice)
+	first, second := createTestTask(t, alice, groupID), createTestTask(t, alice, groupID)
+	addGroupMember(t, alice, carol, groupID, groupRoleViewer)
+
+	path := "/api/groups/" + groupID + "/tasks/reorder"
+	reorder := []accessCase{{http.MethodPost, path, map[string][]string{"task_ids": {second, first}}}}
+	assertDenied(t, bob, groupID, http.StatusNotFound, reorder)
+	assertDenied(t, carol, groupID, http.StatusForbidden, reorder)
+
+	mustRequest(t, http.MethodPost, path, alice.Token, map[string][]string{"task_ids": {first}}, http.StatusBadRequest, nil)
+	mustRequest(t, http.MethodPost, path, alice.Token, map[string][]string{"task_ids": {second, first}}, http.StatusOK, nil)
+	var tasks []Task
+	mustRequest(t, http.MethodGet, "/api/groups/"+groupID+"/tasks", carol.Token, nil, http.StatusOK, &tasks)
+	if len(tasks) != 2 || tasks[0].ID != second || tasks[1].ID != first {
+		t.Errorf("tasks after reorder = %+v, want %s then %s", tasks, second, first)
+	}
+}
+
+func TestForeignChecklistIsDenied(t *testing.T) {
+	requireTestDB(t)
+	alice, bob, carol := newTestUser(t), newTestUser(t), newTestUser(t)
+	groupID := createTestGroup(t, alice)
+	taskID := createTestTask(t, alice, groupID)
+	var item TaskItem
+	mustRequest(t, http.MethodPost, "/api/tasks/"+taskID+"/items", alice.Token,
+		map[string]string{"title": "Пункт"}, http.StatusCreated, &item)
+	addGroupMember(t, alice, carol, groupID, groupRoleViewer)
+
+	done := true
+	cases := []accessCase{
+		{http.MethodPost, "/api/tasks/" + taskID + "/items", map[string]string{"title": "Чужой пункт"}},
+		{http.MethodPut, "/api/tasks/" + taskID + "/items/" + item.ID, map[string]interface{}{"title": "Взлом", "done": &done}},
+		{http.MethodDelete, "/api/tasks/" + taskID + "/items/" + item.ID, nil},
+	}
+	assertDenied(t, bob, groupID, http.StatusNotFound,
+		append(cases, accessCase{http.MethodGet, "/api/tasks/" + taskID + "/items", nil}))
+
+	// Пункт чужой задачи не достать и через собственную задачу.
+	bobTask := createTestTask(t, bob, createTestGroup(t, bob))
+	assertDenied(t, bob, groupID, http.StatusNotFound, []accessCase{
+		{http.MethodPut, "/api/tasks/" + bobTask + "/items/" + item.ID, map[string]interface{}{"done": &done}},
+		{http.MethodDelete, "/api/tasks/" + bobTask + "/items/" + item.ID, nil},
+	})
+
+	mustRequest(t, http.MethodGet, "/api/tasks/"+taskID+"/items", carol.Token, nil, http.StatusOK, nil)
+	assertDenied(t, carol, groupID, http.StatusForbidden, cases)
+}
+
+func createTestLabel(t *testing.T, owner testUser) string {
+	t.Helper()
+	var label struct{ ID string }
+	mustRequest(t, http.MethodPost, "/api/labels", owner.Token, map[string]string{"name": "Метка"}, http.StatusCreated, &label)
+	return label.ID
+}
+
+func TestForeignTaskLabelsAreDenied(t *testing.T) {
+	requireTestDB(t)
+	alice, bob, carol := newTestUser(t), newTestUser(t), newTestUser(t)
+	groupID := createTestGroup(t, alice)
+	taskID := createTestTask(t, alice, groupID)
+	aliceLabel := createTestLabel(t, alice)
+	mustRequest(t, http.MethodPost, "/api/tasks/"+taskID+"/labels/"+aliceLabel, alice.Token, nil, http.StatusOK, nil)
+	addGroupMember(t, alice, carol, groupID, groupRoleViewer)
+
+	labelCases := func(own string) []accessCase {
+		return []accessCase{
+			{http.MethodPost, "/api/tasks/" + taskID + "/labels/" + own, nil},
+			{http.MethodDelete, "/api/tasks/" + taskID + "/labels/" + aliceLabel, nil},
+		}
+	}
+	assertDenied(t, bob, groupID, http.StatusNotFound, labelCases(createTestLabel(t, bob)))
+	assertDenied(t, carol, groupID, http.StatusForbidden, labelCases(createTestLabel(t, carol)))
+}
+
+func TestValidateLabel(t *testing.T) {
+	cases := []struct {
+		name, color string
+		wantColor   string
+		wantErr     bool
+	}{
+		{"  Работа ", "", defaultLabelColor, false},
+		{"Дом", "#A1B2C3", "#a1b2c3", false},
+		{"   ", "#ffffff", "", true},
+		{strings.Repeat("x", 51), "", "", true},
+		{"Дом", "red", "", true},
+		{"Дом", "#12345", "", true},
+	}
+	for _, tc := range cases {
+		req := LabelRequest{Name: tc.name, Color: tc.color}
+		err := validateLabel(&req)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("validateLabel(%q, %q) error = %v, want error %t", tc.name, tc.color, err, tc.wantErr)
+			continue
+		}
+		if err == nil && (req.Color != tc.wantColor || req.Name != strings.TrimSpace(tc.name)) {
+			t.Errorf("validateLabel(%q, %q) = %q %q", tc.name, tc.color, req.Name, req.Color)
+		}
+	}
+}
+
+func TestForeignTrashRestoreIsDenied(t *testing.T) {
+	requireTestDB(t)
+	alice, bob, carol := newTestUser(t), newTestUser(t), newTestUser(t)
+	groupID := createTestGroup(t, alice)
+	taskID := createTestTask(t, alice, groupID)
+	addGroupMember(t, alice, carol, groupID, groupRoleViewer)
+	mustRequest(t, http.MethodDelete, "/api/tasks/"+taskID, alice.Token, nil, http.StatusOK, nil)
+
+	restore := []accessCase{{http.MethodPost, "/api/trash/task/" + taskID + "/restore", nil}}
+	assertDenied(t, bob, groupID, http.StatusNotFound, restore)
+	assertDenied(t, carol, groupID, http.StatusForbidden, restore)
+
+	mustRequest(t, http.MethodPost, "/api/trash/task/"+taskID+"/restore", alice.Token, nil, http.StatusOK, nil)
+	mustRequest(t, http.MethodPost, "/api/trash/task/"+taskID+"/restore", alice.Token, nil, http.StatusNotFound, nil)
+
+	mustRequest(t, http.MethodDelete, "/api/groups/"+groupID, alice.Token, nil, http.StatusOK, nil)
+	assertDenied(t, bob, groupID, http.StatusNotFound,
+		[]accessCase{{http.MethodPost, "/api/trash/group/" + groupID + "/restore", nil}})
+}
+
+// flakyChannel — внешний канал уведомлений, который отказывает failures раз подряд.
+type flakyChannel struct {
+	failures  int
+	attempts  int
+	delivered []string
+}
+
+const flakyChannelName = "test-flaky"
+
+func (*flakyChannel) Name() string { return flakyChannelName }
+
+func (c *flakyChannel) Deliver(q queryer, msg outboxMessage) error {
+	c.attempts++
+	if c.failures > 0 {
+		c.failures--
+		return fmt.Errorf("channel unavailable")
+	}
+	c.delivered = append(c.delivered, msg.ID)
+	return nil
+}
+
+// useFlakyChannel подключает flakyChannel рядом с входящими и убирает строки прошлых запусков.
+func useFlakyChannel(t *testing.T, failures int) *flakyChannel {
+	t.Helper()
+	if _, err := db.Exec(`DELETE FROM notification_outbox WHERE channel=$1`, flakyChannelName); err != nil {
+		t.Fatal(err)
+	}
+	ch := &flakyChannel{failures: failures}
+	prev := notificationChannels
+	notificationChannels = []NotificationChannel{inAppChannel{}, ch}
+	t.Cleanup(func() { notificationChannels = prev })
+	return ch
+}
+
+type outboxState struct {
+	ID        string
+	Attempts  int
+	LastError string
+	RetryIn   float64
+	Locked    bool
+	Sent      bool
+	Failed    bool
+}
+
+func loadOutboxState(t *testing.T, userID, channel string) outboxState {
+	t.Helper()
+	var s outboxState
+	err := db.QueryRow(`
+		SELECT id, attempts, COALESCE(last_error, ''), EXTRACT(EPOCH FROM next_attempt_at - NOW()),
+			locked_until IS NOT NULL, sent_at IS NOT NULL, failed_at IS NOT NULL
+		FROM notification_outbox WHERE user_id=$1 AND channel=$2`,
+		userID, channel).Scan(&s.ID, &s.Attempts, &s.LastError, &s.RetryIn, &s.Locked, &s.Sent, &s.Failed)
+	if err != nil {
+		t.Fatalf("load outbox %s: %v", channel, err)
+	}
+	return s
+}
+
+func dispatchTestNotifications(t *testing.T) {
+	t.Helper()
+	for {
+		n, err := dispatchNotifications()
+		if err != nil {
+			t.Fatalf("dispatch notifications: %v", err)
+		}
+		if n < notifyBatchSize {
+			return
+		}
+	}
+}
+
+func makeOutboxDue(t *testing.T, id string) {
+	t.Helper()
+	if _, err := db.Exec(`UPDATE notification_outbox SET next_attempt_at = NOW() - INTERVAL '1 second' WHERE id=$1`, id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotifyRetryDelay(t *testing.T) {
+	cases := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, notifyRetryBase},
+		{2, 2 * notifyRetryBase},
+		{3, 4 * notifyRetryBase},
+		{8, 128 * notifyRetryBase},
+		{20, notifyMaxRetryDelay},
+		{100, notifyMaxRetryDelay},
+	}
+	for _, tc := range cases {
+		if got := notifyRetryDelay(tc.attempts); got != tc.want {
+			t.Errorf("notifyRetryDelay(%d) = %v, want %v", tc.attempts, got, tc.want)
+		}
+	}
+}
+
+func TestNotificationRetryWithBackoff(t *testing.T) {
+	requireTestDB(t)
+	alice := newTestUser(t)
+	flaky := useFlakyChannel(t, 1)
+	if err := enqueueNotification(db, alice.ID, "test", "Заголовок", "Текст", "/todo"); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatchTestNotifications(t)
+	// Входящие доставлены сразу, отказ внешнего канала их не откатывает.
+	var inbox NotificationList
+	mustRequest(t, http.MethodGet, "/api/notifications", alice.Token, nil, http.StatusOK, &inbox)
+	if inbox.Total != 1 {
+		t.Fatalf("inbox has %d notifications, want 1", inbox.Total)
+	}
+	if s := loadOutboxState(t, alice.ID, notifyChannelInApp); !s.Sent || s.Attempts != 1 || s.Locked {
+		t.Errorf("inapp outbox = %+v, want sent after 1 attempt", s)
+	}
+
+	s := loadOutboxState(t, alice.ID, flakyChannelName)
+	if s.Sent || s.Failed || s.Locked || s.Attempts != 1 || s.LastError != "channel unavailable" {
+		t.Fatalf("flaky outbox after failure = %+v", s)
+	}
+	if want := notifyRetryBase.Seconds(); s.RetryIn < want-5 || s.RetryIn > want+1 {
+		t.Errorf("next attempt in %.0fs, want %.0fs", s.RetryIn, want)
+	}
+
+	// До next_attempt_at сообщение не трогается.
+	dispatchTestNotifications(t)
+	if flaky.attempts != 1 {
+		t.Fatalf("flaky channel called %d times before the retry is due, want 1", flaky.attempts)
+	}
+
+	makeOutboxDue(t, s.ID)
+	dispatchTestNotifications(t)
+	if len(flaky.delivered) != 1 || flaky.delivered[0] != s.ID {
+		t.Fatalf("flaky channel delivered %v, want [%s]", flaky.delivered, s.ID)
+	}
+	if s := loadOutboxState(t, alice.ID, flakyChannelName); !s.Sent || s.Attempts != 2 || s.Locked {
+		t.Errorf("flaky outbox after retry = %+v, want sent after 2 attempts", s)
+	}
+	mustRequest(t, http.MethodGet, "/api/notifications", alice.Token, nil, http.StatusOK, &inbox)
+	if inbox.Total != 1 {
+		t.Errorf("inbox has %d notifications after retry, want 1", inbox.Total)
+	}
+}
+
+func TestNotificationFailsAfterMaxAttempts(t *testing.T) {
+	requireTestDB(t)
+	alice := newTestUser(t)
+	flaky := useFlakyChannel(t, notifyMaxAttempts)
+	if err := enqueueNotification(db, alice.ID, "test", "Заголовок", "Текст", ""); err != nil {
+		t.Fatal(err)
+	}
+	id := loadOutboxState(t, alice.ID, flakyChannelName).ID
+	if _, err := db.Exec(`UPDATE notification_outbox SET attempts=$2 WHERE id=$1`, id, notifyMaxAttempts-2); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatchTestNotifications(t)
+	if s := loadOutboxState(t, alice.ID, flakyChannelName); s.Failed || s.Attempts != notifyMaxAttempts-1 {
+		t.Fatalf("outbox before the last attempt = %+v", s)
+	}
+
+	makeOutboxDue(t, id)
+	dispatchTestNotifications(t)
+	s := loadOutboxState(t, alice.ID, flakyChannelName)
+	if !s.Failed || s.Sent || s.Attempts != notifyMaxAttempts {
+		t.Fatalf("outbox after the last attempt = %+v, want failed after %d attempts", s, notifyMaxAttempts)
+	}
+
+	// Окончательно не доставленное сообщение больше не берётся в работу.
+	makeOutboxDue(t, id)
+	dispatchTestNotifications(t)
+	if flaky.attempts != 2 {
+		t.Errorf("flaky channel called %d times, want 2", flaky.attempts)
+	}
+}
+
+func TestClaimedNotificationIsSkippedUntilClaimExpires(t *testing.T) {
+	requireTestDB(t)
+	alice := newTestUser(t)
+	flaky := useFlakyChannel(t, 0)
+	if err := enqueueNotification(db, alice.ID, "test", "Заголовок", "Текст", ""); err != nil {
+		t.Fatal(err)
+	}
+	id := loadOutboxState(t, alice.ID, flakyChannelName).ID
+
+	// Строку держит другой экземпляр диспетчера.
+	if _, err := db.Exec(`UPDATE notification_outbox SET locked_until = NOW() + INTERVAL '1 minute' WHERE id=$1`, id); err != nil {
+		t.Fatal(err)
+	}
+	dispatchTestNotifications(t)
+	if flaky.attempts != 0 {
+		t.Fatalf("claimed notification was delivered %d times", flaky.attempts)
+	}
+
+	// Захват упавшего экземпляра истекает, и сообщение доставляется.
+	if _, err := db.Exec(`UPDATE notification_outbox SET locked_until = NOW() - INTERVAL '1 second' WHERE id=$1`, id); err != nil {
+		t.Fatal(err)
+	}
+	dispatchTestNotifications(t)
+	if s := loadOutboxState(t, alice.ID, flakyChannelName); !s.Sent || s.Locked || len(flaky.delivered) != 1 {
+		t.Errorf("outbox after the claim expired = %+v, delivered %v", s, flaky.delivered)
+	}
+}
+
+// TestRecurrenceSkipPast сверяет арифметический пропуск прошедших вхождений с перебором по одному.
+func TestRecurrenceSkipPast(t *testing.T) {
+	starts := []time.Time{
+		time.Date(2023, time.January, 31, 9, 0, 0, 0, time.UTC),
+		time.Date(2024, time.February, 25, 18, 30, 0, 0, time.UTC),
+		time.Date(2025, time.July, 10, 7, 0, 0, 0, time.UTC),
+	}
+	now := time.Date(2026, time.March, 4, 12, 0, 0, 0, time.UTC)
+	for _, value := range []string{
+		"FREQ=DAILY",
+		"FREQ=DAILY;INTERVAL=3",
+		"FREQ=WEEKLY;INTERVAL=2",
+		"FREQ=WEEKLY;BYDAY=MO,WE,FR",
+		"FREQ=WEEKLY;INTERVAL=3;BYDAY=TU,SU",
+		"FREQ=MONTHLY;BYMONTHDAY=15",
+		"FREQ=MONTHLY;INTERVAL=2",
+		"FREQ=DAILY;COUNT=500",
+		"FREQ=WEEKLY;BYDAY=TH;COUNT=2000",
+		"FREQ=DAILY;UNTIL=20250101T000000Z",
+	} {
+		rule, err := parseRecurrence(value)
+		if err != nil {
+			t.Fatalf("%s: %v", value, err)
+		}
+
+		for _, start := range starts {
+			wantPrev, wantOccurrence := start, 1
+			for {
+				next, ok := rule.next(wantPrev, wantOccurrence)
+				if !ok || !next.Before(now) {
+					break
+				}
+				wantPrev, wantOccurrence = next, wantOccurrence+1
+			}
+
+			// Для серии, закончившейся до now, skipPast может перескочить COUNT или UNTIL,
+			// поэтому сравнивается следующее вхождение, от которого материализуется серия.
+			wantNext, wantOK := rule.next(wantPrev, wantOccurrence)
+			gotPrev, gotOccurrence := rule.skipPast(start, 1, now)
+			gotNext, gotOK := rule.next(gotPrev, gotOccurrence)
+			if gotOK != wantOK || !gotNext.Equal(wantNext) {
+				t.Errorf("%s from %v: next after skipPast = %v (%t), want %v (%t)", value, start, gotNext, gotOK, wantNext, wantOK)
+			}
+		}
+	}
+}
+
+func TestEventStreamTicketIsSingleUse(t *testing.T) {
+	requireTestDB(t)
+	alice := newTestUser(t)
+
+	var ticket struct{ Ticket string }
+	mustRequest(t, http.MethodPost, "/api/events/ticket", alice.Token, nil, http.StatusCreated, &ticket)
+
+	// Контекст отменён заранее, чтобы поток закрылся сразу после заголовков.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stream := func(query string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/events?"+query, nil).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		testServer.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := stream("ticket=" + ticket.Ticket); code != http.StatusOK {
+		t.Fatalf("first connect: status %d, want 200", code)
+	}
+	if code := stream("ticket=" + ticket.Ticket); code != http.StatusUnauthorized {
+		t.Errorf("reused ticket: status %d, want 401", code)
+	}
+	if code := stream("access_token=" + alice.Token); code != http.StatusUnauthorized {
+		t.Errorf("access token in query: status %d, want 401", code)
+	}
+
+	mustRequest(t, http.MethodPost, "/api/events/ticket", alice.Token, nil, http.StatusCreated, &ticket)
+	if _, err := db.Exec(`UPDATE event_tickets SET expires_at = NOW() - INTERVAL '1 second' WHERE ticket_hash=$1`,
+		hashToken(ticket.Ticket)); err != nil {
+		t.Fatal(err)
+	}
+	if code := stream("ticket=" + ticket.Ticket); code != http.StatusUnauthorized {
+		t.Errorf("expired ticket: status %d, want 401", code)
+	}
+
+	// Тикет не переживает выход из сессии, для которой выдан.
+	mustRequest(t, http.MethodPost, "/api/events/ticket", alice.Token, nil, http.StatusCreated, &ticket)
+	mustRequest(t, http.MethodPost, "/api/logout", alice.Token, nil, http.StatusOK, nil)
+	if code := stream("ticket=" + ticket.Ticket); code != http.StatusUnauthorized {
+		t.Errorf("ticket of a revoked session: status %d, want 401", code)
+	}
+}
+
+func TestValidateCategory(t *testing.T) {
+	empty := ""
+	req := CategoryRequest{Name: "  Напитки ", Slug: " hot-drinks ", ParentID: &empty}
+	if err := validateCategory(&req); err != nil {
+		t.Fatalf("validateCategory: %v", err)
+	}
+	if req.Name != "Напитки" || req.Slug != "hot-drinks" || req.ParentID != nil {
+		t.Errorf("normalized request = %+v", req)
+	}
+
+	for _, bad := range []CategoryRequest{
+		{Name: " ", Slug: "drinks"},
+		{Name: "Напитки", Slug: "Drinks"},
+		{Name: "Напитки", Slug: "hot--drinks"},
+		{Name: "Напитки", Slug: "-drinks"},
+		{Name: "Напитки", Slug: ""},
+	} {
+		if err := validateCategory(&bad); err == nil {
+			t.Errorf("validateCategory(%+v) accepted an invalid category", bad)
+		}
+	}
+}
+
+func TestProductCategoriesAreValidated(t *testing.T) {
+	requireTestDB(t)
+	admin := newTestAdmin(t)
+	slug := fmt.Sprintf("c%d", time.Now().UnixNano())
+
+	var parent, child Category
+	mustRequest(t, http.MethodPost, "/api/admin/categories", admin.Token,
+		CategoryRequest{Name: "Раздел", Slug: slug}, http.StatusCreated, &parent)
+	mustRequest(t, http.MethodPost, "/api/admin/categories", admin.Token,
+		CategoryRequest{Name: "Раздел", Slug: slug}, http.StatusConflict, nil)
+	mustRequest(t, http.MethodPost, "/api/admin/categories", admin.Token,
+		CategoryRequest{Name: "Подраздел", Slug: slug + "-sub", ParentID: &parent.ID}, http.StatusCreated, &child)
+	mustRequest(t, http.MethodPut, "/api/admin/categories/"+parent.ID, admin.Token,
+		CategoryRequest{Name: "Раздел", Slug: slug, ParentID: &child.ID}, http.StatusBadRequest, nil)
+	mustRequest(t, http.MethodDelete, "/api/admin/categories/"+parent.ID, admin.Token, nil, http.StatusConflict, nil)
+
+	name := "Товар " + slug
+	products := func() int {
+		t.Helper()
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM products WHERE name=$1`, name).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	// Ошибка в категориях откатывает создание товара целиком.
+	for _, ids := range [][]string{{"not-a-uuid"}, {"00000000-0000-0000-0000-000000000000"}, {child.ID, "not-a-uuid"}} {
+		mustRequest(t, http.MethodPost, "/api/admin/products", admin.Token,
+			ProductRequest{Name: name, Price: 100, IsActive: true, CategoryIDs: ids}, http.StatusBadRequest, nil)
+	}
+	if n := products(); n != 0 {
+		t.Fatalf("%d products created with invalid categories", n)
+	}
+
+	var created struct{ ID string }
+	mustRequest(t, http.MethodPost, "/api/admin/products", admin.Token,
+		ProductRequest{Name: name, Price: 100, IsActive: true, CategoryIDs: []string{child.ID, child.ID}}, http.StatusCreated, &created)
+	var linked int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM product_categories WHERE product_id=$1`, created.ID).Scan(&linked); err != nil {
+		t.Fatal(err)
+	}
+	if linked != 1 {
+		t.Errorf("product linked to %d categories, want 1", linked)
+	}
+}
+
+// memoryStorage — FileStorage в памяти для тестов загрузки изображений.
+type memoryStorage struct {
+	files map[string][]byte
+	types map[string]string
+}
+
+func (s *memoryStorage) Put(key string, data []byte, contentType string) error {
+	s.files[key] = data
+	s.types[key] = contentType
+	return nil
+}
+
+func (s *memoryStorage) Delete(key string) error {
+	delete(s.files, key)
+	delete(s.types, key)
+	return nil
+}
+
+func (s *memoryStorage) URL(key string) string {
+	return "https://cdn.test/" + key
+}
+
+func (s *memoryStorage) key(t *testing.T, url string) string {
+	t.Helper()
+	key := strings.TrimPrefix(url, "https://cdn.test/")
+	if _, ok := s.files[key]; !ok {
+		t.Fatalf("%s is not stored", url)
+	}
+	return key
+}
+
+// useMemoryStorage подменяет хранилище файлов на время теста.
+func useMemoryStorage(t *testing.T) *memoryStorage {
+	t.Helper()
+	mem := &memoryStorage{files: map[string][]byte{}, types: map[string]string{}}
+	prev := storage
+	storage = mem
+	t.Cleanup(func() { storage = prev })
+	return mem
+}
+
+// encodeTestImage кодирует градиент w×h в PNG или GIF.
+func encodeTestImage(t *testing.T, format string, w, h int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 0x80, A: 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	default:
+		t.Fatalf("unknown format %q", format)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// imageUploadRequest собирает multipart-запрос с файлом в поле image.
+func imageUploadRequest(t *testing.T, productID, filename string, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("image", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/products/"+productID+"/image", &body)
+	req.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+	return req
+}
+
+func decodeJPEGSize(t *testing.T, data []byte) (int, int) {
+	t.Helper()
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "jpeg" {
+		t.Fatalf("format = %s, want jpeg", format)
+	}
+	return cfg.Width, cfg.Height
+}
+
+func TestLocalFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	fs := localFileStorage{Dir: filepath.Join(dir, "uploads"), BaseURL: "/uploads"}
+
+	key := "products/p1/photo.png"
+	if err := fs.Put(key, []byte("data"), "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	stored, err := os.ReadFile(filepath.Join(dir, "uploads", "products", "p1", "photo.png"))
+	if err != nil || string(stored) != "data" {
+		t.Fatalf("stored file = %q, %v", stored, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "uploads", "products", "p1", "photo.png.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+	if url := fs.URL(key); url != "/uploads/products/p1/photo.png" {
+		t.Errorf("URL = %s", url)
+	}
+
+	if err := fs.Delete(key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := fs.Delete(key); err != nil {
+		t.Errorf("Delete of a missing file: %v", err)
+	}
+
+	// Ключ не может указывать за пределы каталога хранилища.
+	for _, bad := range []string{"", "../escape.png", "products/../../escape.png", "/products/p1/a.png", "products//a.png"} {
+		if err := fs.Put(bad, []byte("data"), "image/png"); err == nil {
+			t.Errorf("Put(%q) accepted an invalid key", bad)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape.png")); !os.IsNotExist(err) {
+		t.Errorf("file written outside the storage directory: %v", err)
+	}
+}
+
+func TestDecodeProductImage(t *testing.T) {
+	img, err := decodeProductImage(encodeTestImage(t, "png", 30, 20))
+	if err != nil {
+		t.Fatalf("decodeProductImage: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 30 || b.Dy() != 20 {
+		t.Errorf("bounds = %v", b)
+	}
+
+	for name, data := range map[string][]byte{
+		"too wide":  encodeTestImage(t, "png", maxImageDimension+1, 1),
+		"too tall":  encodeTestImage(t, "gif", 1, maxImageDimension+1),
+		"truncated": encodeTestImage(t, "png", 30, 20)[:40],
+	} {
+		if _, err := decodeProductImage(data); err == nil {
+			t.Errorf("%s: decodeProductImage accepted the image", name)
+		}
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	for _, tc := range []struct{ w, h, max, wantW, wantH int }{
+		{1600, 400, imageMediumSize, 800, 200},
+		{1600, 400, imageThumbSize, 200, 50},
+		{300, 900, imageThumbSize, 66, 200},
+		{2000, 1, imageThumbSize, 200, 1},
+		// Маленькие изображения не увеличиваются.
+		{50, 40, imageThumbSize, 50, 40},
+	} {
+		img := resizeImage(image.NewNRGBA(image.Rect(0, 0, tc.w, tc.h)), tc.max)
+		if b := img.Bounds(); b.Dx() != tc.wantW || b.Dy() != tc.wantH {
+			t.Errorf("resize %dx%d to %d = %dx%d, want %dx%d", tc.w, tc.h, tc.max, b.Dx(), b.Dy(), tc.wantW, tc.wantH)
+		}
+	}
+
+	// Прозрачные пиксели заливаются белым, непрозрачные сохраняют цвет.
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.SetNRGBA(1, 0, color.NRGBA{R: 0x10, G: 0x20, B: 0x30, A: 0xff})
+	thumb := resizeImage(src, imageThumbSize)
+	if got := thumb.RGBAAt(0, 0); got != (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("transparent pixel = %v, want white", got)
+	}
+	if got := thumb.RGBAAt(1, 0); got != (color.RGBA{0x10, 0x20, 0x30, 0xff}) {
+		t.Errorf("opaque pixel = %v", got)
+	}
+
+	data, err := encodeJPEG(resizeImage(image.NewNRGBA(image.Rect(0, 0, 1600, 400)), imageThumbSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := decodeJPEGSize(t, data); w != 200 || h != 50 {
+		t.Errorf("thumbnail JPEG is %dx%d, want 200x50", w, h)
+	}
+}
+
+// Файл проверяется до обращения к базе, поэтому отказы проверяются без неё.
+func TestUploadProductImageRejectsInvalidFiles(t *testing.T) {
+	mem := useMemoryStorage(t)
+	oversized := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, maxImageSize)...)
+
+	for _, tc := range []struct {
+		name, filename string
+		data           []byte
+		status         int
+	}{
+		{"text named as png", "photo.png", []byte("just some text, not an image"), http.StatusUnsupportedMediaType},
+		{"html named as jpg", "photo.jpg", []byte("<html><script>alert(1)</script></html>"), http.StatusUnsupportedMediaType},
+		{"webp", "photo.webp", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), http.StatusUnsupportedMediaType},
+		{"corrupted png", "photo.png", []byte("\x89PNG\r\n\x1a\nbroken"), http.StatusBadRequest},
+		{"too many pixels", "photo.png", encodeTestImage(t, "png", maxImageDimension+1, 1), http.StatusBadRequest},
+		{"over the size limit", "photo.png", oversized, http.StatusRequestEntityTooLarge},
+		{"over the body limit", "photo.png", append(oversized, make([]byte, 2<<20)...), http.StatusRequestEntityTooLarge},
+	} {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(imageUploadRequest(t, "00000000-0000-0000-0000-000000000000", tc.filename, tc.data), rec)
+		c.SetParamNames("id")
+		c.SetParamValues("00000000-0000-0000-0000-000000000000")
+		if err := uploadProductImage(c); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if rec.Code != tc.status {
+			t.Errorf("%s: status %d, want %d: %s", tc.name, rec.Code, tc.status, rec.Body)
+		}
+	}
+	if len(mem.files) != 0 {
+		t.Errorf("rejected uploads stored %d files", len(mem.files))
+	}
+}
+
+func TestUploadProductImage(t *testing.T) {
+	requireTestDB(t)
+	mem := useMemoryStorage(t)
+	admin := newTestAdmin(t)
+	productID := createTestProduct(t, "Товар с фото", 100)
+
+	upload := func(productID, filename string, data []byte, status int) map[string]string {
+		t.Helper()
+		req := imageUploadRequest(t, productID, filename, data)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+admin.Token)
+		rec := httptest.NewRecorder()
+		testServer.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Fatalf("upload %s: status %d, want %d: %s", filename, rec.Code, status, rec.Body)
+		}
+		var resp map[string]string
+		if status == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp
+	}
+
+	// Тип определяется по содержимому: PNG с расширением .jpg сохраняется как PNG.
+	original := encodeTestImage(t, "png", 1600, 400)
+	first := upload(productID, "photo.jpg", original, http.StatusOK)
+	key := mem.key(t, first["original_url"])
+	if !strings.HasSuffix(key, ".png") || mem.types[key] != "image/png" || !bytes.Equal(mem.files[key], original) {
+		t.Errorf("original stored as %s (%s)", key, mem.types[key])
+	}
+	if w, h := decodeJPEGSize(t, mem.files[mem.key(t, first["image_url"])]); w != 800 || h != 200 {
+		t.Errorf("medium image is %dx%d, want 800x200", w, h)
+	}
+	if w, h := decodeJPEGSize(t, mem.files[mem.key(t, first["thumbnail_url"])]); w != 200 || h != 50 {
+		t.Errorf("thumbnail is %dx%d, want 200x50", w, h)
+	}
+
+	var imageURL, thumbURL string
+	if err := db.QueryRow(`SELECT image_url, thumbnail_url FROM products WHERE id=$1`, productID).Scan(&imageURL, &thumbURL); err != nil {
+		t.Fatal(err)
+	}
+	if imageURL != first["image_url"] || thumbURL != first["thumbnail_url"] {
+		t.Errorf("product image = %s, %s; want %s, %s", imageURL, thumbURL, first["image_url"], first["thumbnail_url"])
+	}
+
+	// Новое изображение заменяет старое, файлы старого удаляются.
+	second := upload(productID, "photo.gif", encodeTestImage(t, "gif", 100, 100), http.StatusOK)
+	if len(mem.files) != 3 {
+		t.Errorf("%d files stored after replacing the image, want 3", len(mem.files))
+	}
+	if key := mem.key(t, second["original_url"]); !strings.HasSuffix(key, ".gif") {
+		t.Errorf("original stored as %s", key)
+	}
+
+	upload("00000000-0000-0000-0000-000000000000", "photo.png", original, http.StatusNotFound)
+	upload("not-a-uuid", "photo.png", original, http.StatusNotFound)
+	if len(mem.files) != 3 {
+		t.Errorf("%d files stored after uploads to missing products, want 3", len(mem.files))
+	}
+
+	mustRequest(t, http.MethodDelete, "/api/admin/products/"+productID, admin.Token, nil, http.StatusOK, nil)
+	if len(mem.files) != 0 {
+		t.Errorf("%d files left after deleting the product", len(mem.files))
+	}
+}
+
+func TestValidateModifierGroup(t *testing.T) {
+	req := ModifierGroupRequest{Name: " Молоко ", MinSelect: 0, MaxSelect: 1}
+	if err := validateModifierGroup(&req); err != nil {
+		t.Fatalf("validateModifierGroup: %v", err)
+	}
+	if req.Name != "Молоко" {
+		t.Errorf("name = %q", req.Name)
+	}
+
+	for _, bad := range []ModifierGroupRequest{
+		{Name: " ", MaxSelect: 1},
+		{Name: "Молоко", MinSelect: -1, MaxSelect: 1},
+		{Name: "Молоко", MaxSelect: 0},
+		{Name: "Молоко", MinSelect: 3, MaxSelect: 2},
+	} {
+		if err := validateModifierGroup(&bad); err == nil {
+			t.Errorf("validateModifierGroup(%+v) accepted an invalid group", bad)
+		}
+	}
+}
+
+// stockOf возвращает остаток товара, а с непустым variantID — остаток варианта (nil — не учитывается).
+func stockOf(t *testing.T, productID, variantID string) *int {
+	t.Helper()
+	var stock sql.NullInt64
+	var err error
+	if variantID != "" {
+		err = db.QueryRow(`SELECT stock FROM product_variants WHERE id=$1`, variantID).Scan(&stock)
+	} else {
+		err = db.QueryRow(`SELECT stock FROM products WHERE id=$1`, productID).Scan(&stock)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stock.Valid {
+		return nil
+	}
+	n := int(stock.Int64)
+	return &n
+}
+
+func assertStock(t *testing.T, what string, got *int, want int) {
+	t.Helper()
+	if got == nil || *got != want {
+		t.Errorf("%s stock = %v, want %d", what, got, want)
+	}
+}
+
+// setTestStock задаёт остаток товара или варианта через корректировку склада.
+func setTestStock(t *testing.T, admin testUser, productID, variantID string, quantity int) {
+	t.Helper()
+	mustRequest(t, http.MethodPost, "/api/admin/products/"+productID+"/stock", admin.Token,
+		map[string]interface{}{"variant_id": variantID, "quantity": quantity}, http.StatusCreated, nil)
+}
+
+// addTestCartLine кладёт товар с опциями в корзину и возвращает id строки.
+func addTestCartLine(t *testing.T, user testUser, req AddToCartRequest) string {
+	t.Helper()
+	var line struct{ ID string }
+	mustRequest(t, http.MethodPost, "/api/cart", user.Token, req, http.StatusCreated, &line)
+	return line.ID
+}
+
+func TestReserveStockRejectsShortStock(t *testing.T) {
+	requireTestDB(t)
+	alice := newTestUser(t)
+	tracked := createTestProduct(t, "Эспрессо", 120)
+	untracked := createTestProduct(t, "Вода", 50)
+	if _, err := db.Exec(`UPDATE products SET stock=3 WHERE id=$1`, tracked); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		items []CartItem
+		msg   string
+	}{
+		{"one line", []CartItem{{ProductID: tracked, Name: "Эспрессо", Quantity: 4}}, `not enough stock for "Эспрессо": 3 left`},
+		{"pooled lines", []CartItem{
+			{ProductID: tracked, Name: "Эспрессо", Quantity: 2, ModifierIDs: []string{}},
+			{ProductID: untracked, Name: "Вода", Quantity: 100},
+			{ProductID: tracked, Name: "Эспрессо", Quantity: 2, ModifierIDs: []string{"x"}},
+		}, `not enough stock for "Эспрессо": 3 left`},
+		{"untracked product", []CartItem{{ProductID: untracked, Name: "Вода", Quantity: 100}}, ""},
+	} {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := reserveStock(tx, "", alice.ID, tc.items)
+		tx.Rollback()
+		if err != nil {
+			t.Fatalf("%s: reserveStock: %v", tc.name, err)
+		}
+		if msg != tc.msg {
+			t.Errorf("%s: msg = %q, want %q", tc.name, msg, tc.msg)
+		}
+	}
+	assertStock(t, "product", stockOf(t, tracked, ""), 3)
+}
+
+func TestCheckoutPoolsStockAcrossLines(t *testing.T) {
+	requireTestDB(t)
+	alice, admin := newTestUser(t), newTestAdmin(t)
+	productID := createTestProduct(t, "Латте", 200)
+	setTestStock(t, admin, productID, "", 3)
+
+	var group ModifierGroup
+	mustRequest(t, http.MethodPost, "/api/admin/products/"+productID+"/modifier-groups", admin.Token,
+		ModifierGroupRequest{Name: "Сироп", MaxSelect: 1}, http.StatusCreated, &group)
+	var vanilla, caramel Modifier
+	mustRequest(t, http.MethodPost, "/api/admin/modifier-groups/"+group.ID+"/modifiers", admin.Token,
+		ModifierRequest{Name: "Ванильный", PriceDelta: 30}, http.StatusCreated, &vanilla)
+	mustRequest(t, http.MethodPost, "/api/admin/modifier-groups/"+group.ID+"/modifiers", admin.Token,
+		ModifierRequest{Name: "Карамельный", PriceDelta: 30}, http.StatusCreated, &caramel)
+
+	// Каждая строка по отдельности укладывается в остаток, вместе — нет.
+	addTestCartLine(t, alice, AddToCartRequest{ProductID: productID, Quantity: 2, ModifierIDs: []string{vanilla.ID}})
+	second := addTestCartLine(t, alice, AddToCartRequest{ProductID: productID, Quantity: 2, ModifierIDs: []string{caramel.ID}})
+	var cart Cart
+	mustRequest(t, http.MethodGet, "/api/cart", alice.Token, nil, http.StatusOK, &cart)
+	if len(cart.Items) != 2 || cart.HasUnavailable {
+		t.Fatalf("cart = %+v, want two available lines", cart)
+	}
+
+	mustRequest(t, http.MethodPost, "/api/orders", alice.Token, nil, http.StatusConflict, nil)
+	assertStock(t, "product", stockOf(t, productID, ""), 3)
+	var orders int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM orders WHERE user_id=$1`, alice.ID).Scan(&orders); err != nil {
+		t.Fatal(err)
+	}
+	if orders != 0 {
+		t.Errorf("%d orders created despite short stock", orders)
+	}
+
+	mustRequest(t, http.MethodPatch, "/api/cart/"+second, alice.Token, map[string]int{"quantity": 1}, http.StatusOK, nil)
+	var order testOrder
+	mustRequest(t, http.MethodPost, "/api/orders", alice.Token, nil, http.StatusCreated, &order)
+	assertStock(t, "product", stockOf(t, productID, ""), 0)
+
+	// Обе строки списаны одним движением.
+	var movements StockMovementList
+	mustRequest(t, http.MethodGet, "/api/admin/products/"+productID+"/stock-movements", admin.Token, nil, http.StatusOK, &movements)
+	if len(movements.Items) != 2 {
+		t.Fatalf("movements = %+v, want adjustment and order", movements.Items)
+	}
+	if m := movements.Items[0]; m.Reason != stockReasonOrder || m.Delta != -3 || m.Balance != 0 || m.OrderID == nil || *m.OrderID != order.ID {
+		t.Errorf("order movement = %+v, want -3 to 0 for order %s", m, order.ID)
+	}
+
+	mustRequest(t, http.MethodPost, "/api/cart", alice.Token, AddToCartRequest{ProductID: productID, ModifierIDs: []string{vanilla.ID}},
+		http.StatusUnprocessableEntity, nil)
+}
+
+func TestVariantStockFallsBackToProductAndRestocksOnce(t *testing.T) {
+	requireTestDB(t)
+	alice, admin := newTestUser(t), newTestAdmin(t)
+	productID := createTestProduct(t, "Чай", 100)
+	setTestStock(t, admin, productID, "", 5)
+
+	var small, large ProductVariant
+	mustRequest(t, http.MethodPost, "/api/admin/products/"+productID+"/variants", admin.Token,
+		VariantRequest{Name: "S", IsDefault: true}, http.StatusCreated, &small)
+	mustRequest(t, http.MethodPost, "/api/admin/products/"+productID+"/variants", admin.Token,
+		VariantRequest{Name: "L", PriceDelta: 50}, http.StatusCreated, &large)
+	setTestStock(t, admin, productID, large.ID, 2)
+
+	// У S нет своего учёта — списывается с товара; L списывается со своего остатка.
+	addTestCartLine(t, alice, AddToCartRequest{ProductID: productID, Quantity: 2, VariantID: small.ID})
+	addTestCartLine(t, alice, AddToCartRequest{ProductID: productID, Quantity: 2, VariantID: large.ID})
+	var order testOrder
+	mustRequest(t, http.MethodPost, "/api/orders", alice.Token, nil, http.StatusCreated, &order)
+
+	assertStock(t, "product", stockOf(t, productID, ""), 3)
+	assertStock(t, "variant L", stockOf(t, productID, large.ID), 0)
+	if s := stockOf(t, productID, small.ID); s != nil {
+		t.Errorf("variant S stock = %d, want untracked", *s)
+	}
+
+	transition := "/api/admin/orders/" + order.ID + "/transition"
+	mustRequest(t, http.MethodPost, transition, admin.Token, map[string]string{"status": "cancelled"}, http.StatusOK, nil)
+	assertStock(t, "product", stockOf(t, productID, ""), 5)
+	assertStock(t, "variant L", stockOf(t, productID, large.ID), 2)
+
+	// Повторная отмена запрещена, а повторный возврат по журналу ничего не меняет.
+	mustRequest(t, http.MethodPost, transition, admin.Token, map[string]string{"status": "cancelled"}, http.StatusConflict, nil)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restockOrder(tx, order.ID, admin.ID); err != nil {
+		tx.Rollback()
+		t.Fatalf("restockOrder: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	assertStock(t, "product", stockOf(t, productID, ""), 5)
+	assertStock(t, "variant L", stockOf(t, productID, large.ID), 2)
+
+	var returns int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM stock_movements WHERE order_id=$1 AND reason=$2`,
+		order.ID, stockReasonCancelled).Scan(&returns); err != nil {
+		t.Fatal(err)
+	}
+	if returns != 2 {
+		t.Errorf("%d restock movements, want 2", returns)
+	}
+}
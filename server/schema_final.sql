@@ -18,15 +18,13 @@ CREATE TABLE IF NOT EXISTS public.users (
 
     profile_tag VARCHAR(50) UNIQUE,
 
-    -- Роли: TRUE = Admin, FALSE = User
-    is_admin BOOLEAN NOT NULL DEFAULT false,
+    -- Роли назначаются через user_roles
 
     created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
 CREATE INDEX IF NOT EXISTS idx_users_username ON public.users(username);
-CREATE INDEX IF NOT EXISTS idx_users_is_admin ON public.users(is_admin) WHERE is_admin = true;
 
 -- Таблица: groups
 CREATE TABLE IF NOT EXISTS public.groups (
@@ -84,6 +82,8 @@ CREATE TABLE IF NOT EXISTS public.cart_items (
 
 CREATE INDEX IF NOT EXISTS idx_cart_items_user_id ON public.cart_items(user_id);
 
+-- Уникальность строк корзины и объединение дублей — в разделе вариантов и модификаторов ниже
+
 -- Taблица: reviews
 CREATE TABLE IF NOT EXISTS public.reviews (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
@@ -107,3 +107,546 @@ CREATE INDEX IF NOT EXISTS idx_reviews_user_id ON public.reviews(user_id);
 CREATE INDEX IF NOT EXISTS idx_reviews_product_id ON public.reviews(product_id);
 CREATE INDEX IF NOT EXISTS idx_reviews_status ON public.reviews(status);
 CREATE INDEX IF NOT EXISTS idx_reviews_created_at ON public.reviews(created_at DESC);
+
+-- Таблица: orders
+CREATE TABLE IF NOT EXISTS public.orders (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'new',
+    total INTEGER NOT NULL,
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT orders_user_id_fkey FOREIGN KEY (user_id) 
+        REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_orders_user_id ON public.orders(user_id);
+CREATE INDEX IF NOT EXISTS idx_orders_created_at ON public.orders(created_at DESC);
+
+-- Таблица: order_items
+-- name и price копируются из products в момент оформления заказа
+CREATE TABLE IF NOT EXISTS public.order_items (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    order_id UUID NOT NULL,
+    product_id UUID,
+    name VARCHAR(255) NOT NULL,
+    price INTEGER NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    CONSTRAINT order_items_order_id_fkey FOREIGN KEY (order_id) 
+        REFERENCES public.orders(id) ON DELETE CASCADE,
+    CONSTRAINT order_items_product_id_fkey FOREIGN KEY (product_id) 
+        REFERENCES public.products(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_items_order_id ON public.order_items(order_id);
+
+-- Таблица: order_status_history
+CREATE TABLE IF NOT EXISTS public.order_status_history (
+    id BIGSERIAL PRIMARY KEY,
+    order_id UUID NOT NULL,
+    from_status VARCHAR(20),
+    to_status VARCHAR(20) NOT NULL,
+    changed_by UUID,
+    changed_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT order_status_history_order_id_fkey FOREIGN KEY (order_id) 
+        REFERENCES public.orders(id) ON DELETE CASCADE,
+    CONSTRAINT order_status_history_changed_by_fkey FOREIGN KEY (changed_by) 
+        REFERENCES public.users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_status_history_order_id ON public.order_status_history(order_id);
+CREATE INDEX IF NOT EXISTS idx_orders_status ON public.orders(status);
+
+-- Таблица: promo_codes
+-- kind: percent (value — процент), fixed (value — сумма в рублях),
+-- buy_n_get_one (за каждые buy_quantity единиц product_id следующая бесплатно)
+CREATE TABLE IF NOT EXISTS public.promo_codes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    code VARCHAR(50) NOT NULL,
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('percent', 'fixed', 'buy_n_get_one')),
+    value INTEGER NOT NULL DEFAULT 0,
+    product_id UUID,
+    buy_quantity INTEGER NOT NULL DEFAULT 0,
+    min_order_total INTEGER NOT NULL DEFAULT 0,
+    starts_at TIMESTAMP WITHOUT TIME ZONE,
+    ends_at TIMESTAMP WITHOUT TIME ZONE,
+    max_uses INTEGER,
+    max_uses_per_user INTEGER,
+    is_active BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT promo_codes_product_id_fkey FOREIGN KEY (product_id) 
+        REFERENCES public.products(id) ON DELETE SET NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_promo_codes_code ON public.promo_codes(UPPER(code));
+
+-- Таблица: cart_promos (промокод, применённый к корзине пользователя)
+CREATE TABLE IF NOT EXISTS public.cart_promos (
+    user_id UUID PRIMARY KEY,
+    promo_id UUID NOT NULL,
+    applied_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT cart_promos_user_id_fkey FOREIGN KEY (user_id) 
+        REFERENCES public.users(id) ON DELETE CASCADE,
+    CONSTRAINT cart_promos_promo_id_fkey FOREIGN KEY (promo_id) 
+        REFERENCES public.promo_codes(id) ON DELETE CASCADE
+);
+
+-- Таблица: promo_redemptions (использования промокодов в заказах)
+CREATE TABLE IF NOT EXISTS public.promo_redemptions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    promo_id UUID NOT NULL,
+    user_id UUID NOT NULL,
+    order_id UUID NOT NULL,
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT promo_redemptions_promo_id_fkey FOREIGN KEY (promo_id) 
+        REFERENCES public.promo_codes(id) ON DELETE CASCADE,
+    CONSTRAINT promo_redemptions_user_id_fkey FOREIGN KEY (user_id) 
+        REFERENCES public.users(id) ON DELETE CASCADE,
+    CONSTRAINT promo_redemptions_order_id_fkey FOREIGN KEY (order_id) 
+        REFERENCES public.orders(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_promo_redemptions_promo_user ON public.promo_redemptions(promo_id, user_id);
+
+-- Суммы заказа до и после скидки
+ALTER TABLE public.orders ADD COLUMN IF NOT EXISTS subtotal INTEGER;
+ALTER TABLE public.orders ADD COLUMN IF NOT EXISTS discount INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE public.orders ADD COLUMN IF NOT EXISTS promo_code VARCHAR(50);
+UPDATE public.orders SET subtotal = total WHERE subtotal IS NULL;
+ALTER TABLE public.orders ALTER COLUMN subtotal SET NOT NULL;
+
+-- Таблица: sessions
+-- Одна строка — один refresh-токен (хранится только SHA-256). Токены одного входа
+-- объединены family_id; он же записывается в access-токен как sid.
+CREATE TABLE IF NOT EXISTS public.sessions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    family_id UUID NOT NULL,
+    user_id UUID NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITHOUT TIME ZONE,
+    revoked_at TIMESTAMP WITHOUT TIME ZONE,
+    user_agent VARCHAR(500),
+    ip VARCHAR(64),
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT sessions_user_id_fkey FOREIGN KEY (user_id) 
+        REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_family_id ON public.sessions(family_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON public.sessions(user_id);
+
+-- Email для восстановления пароля (необязательный)
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS email VARCHAR(255);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON public.users(LOWER(email));
+
+-- Таблица: password_reset_tokens (хранится только SHA-256 токена)
+CREATE TABLE IF NOT EXISTS public.password_reset_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITHOUT TIME ZONE,
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT password_reset_tokens_user_id_fkey FOREIGN KEY (user_id) 
+        REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user_id ON public.password_reset_tokens(user_id);
+
+-- Таблица: login_throttles (неудачные попытки входа по имени пользователя и по IP)
+CREATE TABLE IF NOT EXISTS public.login_throttles (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('username', 'ip')),
+    key VARCHAR(255) NOT NULL,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until TIMESTAMP WITHOUT TIME ZONE,
+    CONSTRAINT login_throttles_kind_key UNIQUE (kind, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_throttles_locked_until ON public.login_throttles(locked_until);
+
+-- Таблицы: roles, role_permissions, user_roles
+-- Список допустимых прав задаётся в коде (allPermissions в main.go).
+CREATE TABLE IF NOT EXISTS public.roles (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name VARCHAR(50) NOT NULL UNIQUE,
+    description TEXT,
+    is_system BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS public.role_permissions (
+    role_id UUID NOT NULL,
+    permission VARCHAR(50) NOT NULL,
+    PRIMARY KEY (role_id, permission),
+    CONSTRAINT role_permissions_role_id_fkey FOREIGN KEY (role_id) 
+        REFERENCES public.roles(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS public.user_roles (
+    user_id UUID NOT NULL,
+    role_id UUID NOT NULL,
+    PRIMARY KEY (user_id, role_id),
+    CONSTRAINT user_roles_user_id_fkey FOREIGN KEY (user_id) 
+        REFERENCES public.users(id) ON DELETE CASCADE,
+    CONSTRAINT user_roles_role_id_fkey FOREIGN KEY (role_id) 
+        REFERENCES public.roles(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_roles_role_id ON public.user_roles(role_id);
+
+INSERT INTO public.roles (name, description, is_system) VALUES
+    ('admin', 'Полный доступ', true),
+    ('catalog_manager', 'Управление товарами и промокодами', false),
+    ('moderator', 'Модерация отзывов', false),
+    ('fulfillment', 'Обработка заказов', false)
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO public.role_permissions (role_id, permission)
+SELECT r.id, p.permission
+FROM public.roles r
+JOIN (VALUES
+    ('admin', 'products:write'),
+    ('admin', 'reviews:moderate'),
+    ('admin', 'orders:manage'),
+    ('admin', 'promos:manage'),
+    ('admin', 'users:manage'),
+    ('catalog_manager', 'products:write'),
+    ('catalog_manager', 'promos:manage'),
+    ('moderator', 'reviews:moderate'),
+    ('fulfillment', 'orders:manage')
+) AS p(role_name, permission) ON p.role_name = r.name
+ON CONFLICT DO NOTHING;
+
+-- Перенос старого флага users.is_admin в роль admin
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_schema = 'public' AND table_name = 'users' AND column_name = 'is_admin'
+    ) THEN
+        INSERT INTO public.user_roles (user_id, role_id)
+        SELECT u.id, r.id FROM public.users u, public.roles r
+        WHERE u.is_admin AND r.name = 'admin'
+        ON CONFLICT DO NOTHING;
+
+        DROP INDEX IF EXISTS public.idx_users_is_admin;
+        ALTER TABLE public.users DROP COLUMN is_admin;
+    END IF;
+END $$;
+
+-- Блокировка и мягкое удаление пользователей
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS blocked_at TIMESTAMP WITHOUT TIME ZONE;
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITHOUT TIME ZONE;
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON public.users(created_at DESC);
+
+-- Таблица: group_members (совместный доступ к группам задач)
+-- role: viewer / editor / owner; status: pending / accepted / declined
+CREATE TABLE IF NOT EXISTS public.group_members (
+    group_id UUID NOT NULL,
+    user_id UUID NOT NULL,
+    role VARCHAR(20) NOT NULL CHECK (role IN ('viewer', 'editor', 'owner')),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'accepted', 'declined')),
+    invited_by UUID,
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    responded_at TIMESTAMP WITHOUT TIME ZONE,
+    PRIMARY KEY (group_id, user_id),
+    CONSTRAINT group_members_group_id_fkey FOREIGN KEY (group_id) 
+        REFERENCES public.groups(id) ON DELETE CASCADE,
+    CONSTRAINT group_members_user_id_fkey FOREIGN KEY (user_id) 
+        REFERENCES public.users(id) ON DELETE CASCADE,
+    CONSTRAINT group_members_invited_by_fkey FOREIGN KEY (invited_by) 
+        REFERENCES public.users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_group_members_user_id ON public.group_members(user_id, status);
+
+-- Расширенные поля задач (due_at и completed_at — в UTC)
+ALTER TABLE public.tasks ADD COLUMN IF NOT EXISTS description TEXT;
+ALTER TABLE public.tasks ADD COLUMN IF NOT EXISTS due_at TIMESTAMP WITHOUT TIME ZONE;
+ALTER TABLE public.tasks ADD COLUMN IF NOT EXISTS priority VARCHAR(10) NOT NULL DEFAULT 'normal'
+    CHECK (priority IN ('low', 'normal', 'high'));
+ALTER TABLE public.tasks ADD COLUMN IF NOT EXISTS position INTEGER;
+ALTER TABLE public.tasks ADD COLUMN IF NOT EXISTS completed_at TIMESTAMP WITHOUT TIME ZONE;
+
+-- Ручной порядок для существующих задач: как раньше, новые сверху
+UPDATE public.tasks t
+SET position = o.pos
+FROM (
+    SELECT id, ROW_NUMBER() OVER (PARTITION BY group_id ORDER BY created_at DESC) AS pos
+    FROM public.tasks
+) o
+WHERE t.id = o.id AND t.position IS NULL;
+
+ALTER TABLE public.tasks ALTER COLUMN position SET DEFAULT 0;
+ALTER TABLE public.tasks ALTER COLUMN position SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_tasks_group_position ON public.tasks(group_id, position);
+CREATE INDEX IF NOT EXISTS idx_tasks_due_at ON public.tasks(due_at) WHERE NOT done;
+
+-- Таблица: task_items (пункты чек-листа внутри задачи)
+CREATE TABLE IF NOT EXISTS public.task_items (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    task_id UUID NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    done BOOLEAN NOT NULL DEFAULT false,
+    position INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT task_items_task_id_fkey FOREIGN KEY (task_id) 
+        REFERENCES public.tasks(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_task_items_task_id ON public.task_items(task_id, position);
+
+-- Повторяющиеся задачи: правило RRULE хранится в каждом вхождении серии,
+-- series_id — id первого вхождения, occurrence — порядковый номер вхождения
+ALTER TABLE public.tasks ADD COLUMN IF NOT EXISTS recurrence TEXT;
+ALTER TABLE public.tasks ADD COLUMN IF NOT EXISTS series_id UUID;
+ALTER TABLE public.tasks ADD COLUMN IF NOT EXISTS occurrence INTEGER NOT NULL DEFAULT 1;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_tasks_series_occurrence ON public.tasks(series_id, occurrence);
+
+-- Таблица: labels (пользовательские метки задач)
+CREATE TABLE IF NOT EXISTS public.labels (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL,
+    name VARCHAR(50) NOT NULL,
+    color VARCHAR(7) NOT NULL DEFAULT '#6c757d',
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT labels_user_id_fkey FOREIGN KEY (user_id) 
+        REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_labels_user_name ON public.labels(user_id, LOWER(name));
+
+-- Таблица: task_labels (метки, навешенные на задачи)
+CREATE TABLE IF NOT EXISTS public.task_labels (
+    task_id UUID NOT NULL,
+    label_id UUID NOT NULL,
+    PRIMARY KEY (task_id, label_id),
+    CONSTRAINT task_labels_task_id_fkey FOREIGN KEY (task_id) 
+        REFERENCES public.tasks(id) ON DELETE CASCADE,
+    CONSTRAINT task_labels_label_id_fkey FOREIGN KEY (label_id) 
+        REFERENCES public.labels(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_task_labels_label_id ON public.task_labels(label_id);
+
+-- Полнотекстовый поиск по задачам; выражение совпадает с taskSearchVector в main.go
+CREATE INDEX IF NOT EXISTS idx_tasks_search ON public.tasks
+    USING GIN (to_tsvector('russian', title || ' ' || COALESCE(description, '')));
+
+-- Корзина: удалённые группы и задачи помечаются deleted_at и окончательно
+-- удаляются сервером через TRASH_RETENTION_DAYS дней
+ALTER TABLE public.groups ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITHOUT TIME ZONE;
+ALTER TABLE public.tasks ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITHOUT TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_groups_deleted_at ON public.groups(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_tasks_deleted_at ON public.tasks(deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- Таблица: notifications (входящие уведомления пользователя)
+CREATE TABLE IF NOT EXISTS public.notifications (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL,
+    kind VARCHAR(50) NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    body TEXT NOT NULL,
+    link VARCHAR(255),
+    read_at TIMESTAMP WITHOUT TIME ZONE,
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT notifications_user_id_fkey FOREIGN KEY (user_id) 
+        REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_user ON public.notifications(user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_notifications_unread ON public.notifications(user_id) WHERE read_at IS NULL;
+
+-- Таблица: notification_outbox (транзакционный outbox: по строке на уведомление и канал доставки)
+CREATE TABLE IF NOT EXISTS public.notification_outbox (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL,
+    channel VARCHAR(20) NOT NULL,
+    kind VARCHAR(50) NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    body TEXT NOT NULL,
+    link VARCHAR(255),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_error TEXT,
+    locked_until TIMESTAMP WITHOUT TIME ZONE,
+    sent_at TIMESTAMP WITHOUT TIME ZONE,
+    failed_at TIMESTAMP WITHOUT TIME ZONE,
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT notification_outbox_user_id_fkey FOREIGN KEY (user_id) 
+        REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_notification_outbox_pending ON public.notification_outbox(next_attempt_at)
+    WHERE sent_at IS NULL AND failed_at IS NULL;
+
+-- Напоминания о сроке задачи: когда напоминание уже отправлено
+ALTER TABLE public.tasks ADD COLUMN IF NOT EXISTS reminded_at TIMESTAMP WITHOUT TIME ZONE;
+
+-- Таблица: event_tickets (одноразовые тикеты на подключение к потоку событий /api/events)
+CREATE TABLE IF NOT EXISTS public.event_tickets (
+    ticket_hash VARCHAR(64) PRIMARY KEY,
+    user_id UUID NOT NULL,
+    session_id UUID NOT NULL,
+    expires_at TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+    CONSTRAINT event_tickets_user_id_fkey FOREIGN KEY (user_id) 
+        REFERENCES public.users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_event_tickets_expires_at ON public.event_tickets(expires_at);
+
+-- Таблица: categories (разделы каталога, вложенные через parent_id)
+CREATE TABLE IF NOT EXISTS public.categories (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    parent_id UUID,
+    name VARCHAR(100) NOT NULL,
+    slug VARCHAR(100) NOT NULL UNIQUE,
+    sort_order INTEGER NOT NULL DEFAULT 0,
+    is_active BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT categories_parent_id_fkey FOREIGN KEY (parent_id) 
+        REFERENCES public.categories(id) ON DELETE RESTRICT
+);
+
+CREATE INDEX IF NOT EXISTS idx_categories_parent_id ON public.categories(parent_id);
+
+-- Таблица: product_categories (товар может входить в несколько категорий)
+CREATE TABLE IF NOT EXISTS public.product_categories (
+    product_id UUID NOT NULL,
+    category_id UUID NOT NULL,
+    PRIMARY KEY (product_id, category_id),
+    CONSTRAINT product_categories_product_id_fkey FOREIGN KEY (product_id) 
+        REFERENCES public.products(id) ON DELETE CASCADE,
+    CONSTRAINT product_categories_category_id_fkey FOREIGN KEY (category_id) 
+        REFERENCES public.categories(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_product_categories_category_id ON public.product_categories(category_id);
+
+-- Полнотекстовый поиск по товарам; выражение совпадает с productSearchVector в main.go
+CREATE INDEX IF NOT EXISTS idx_products_search ON public.products
+    USING GIN (to_tsvector('russian', name || ' ' || COALESCE(description, '')));
+CREATE INDEX IF NOT EXISTS idx_products_created_at ON public.products(created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_products_price ON public.products(price, id);
+
+-- Загруженные изображения товаров: миниатюра и ключи файлов в хранилище
+ALTER TABLE public.products ADD COLUMN IF NOT EXISTS thumbnail_url VARCHAR(500);
+ALTER TABLE public.products ADD COLUMN IF NOT EXISTS image_keys TEXT[] NOT NULL DEFAULT '{}';
+
+-- Таблица: product_variants (размеры товара с надбавкой к базовой цене)
+CREATE TABLE IF NOT EXISTS public.product_variants (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    product_id UUID NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    price_delta INTEGER NOT NULL DEFAULT 0,
+    sort_order INTEGER NOT NULL DEFAULT 0,
+    is_default BOOLEAN NOT NULL DEFAULT false,
+    is_active BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT product_variants_product_id_fkey FOREIGN KEY (product_id) 
+        REFERENCES public.products(id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_product_variants_name ON public.product_variants(product_id, LOWER(name));
+CREATE UNIQUE INDEX IF NOT EXISTS idx_product_variants_default ON public.product_variants(product_id) WHERE is_default;
+
+-- Таблица: modifier_groups (группы добавок; группа обязательна при min_select > 0)
+CREATE TABLE IF NOT EXISTS public.modifier_groups (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    product_id UUID NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    min_select INTEGER NOT NULL DEFAULT 0,
+    max_select INTEGER NOT NULL DEFAULT 1,
+    sort_order INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT modifier_groups_product_id_fkey FOREIGN KEY (product_id) 
+        REFERENCES public.products(id) ON DELETE CASCADE,
+    CONSTRAINT modifier_groups_select_check CHECK (min_select >= 0 AND max_select >= 1 AND max_select >= min_select)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_modifier_groups_name ON public.modifier_groups(product_id, LOWER(name));
+
+-- Таблица: modifiers (добавки внутри группы)
+CREATE TABLE IF NOT EXISTS public.modifiers (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    group_id UUID NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    price_delta INTEGER NOT NULL DEFAULT 0,
+    sort_order INTEGER NOT NULL DEFAULT 0,
+    is_active BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT modifiers_group_id_fkey FOREIGN KEY (group_id) 
+        REFERENCES public.modifier_groups(id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_modifiers_name ON public.modifiers(group_id, LOWER(name));
+
+-- Выбранный вариант и набор модификаторов строки корзины; modifier_ids хранится отсортированным,
+-- поэтому одинаковые наборы дают одну строку
+ALTER TABLE public.cart_items ADD COLUMN IF NOT EXISTS variant_id UUID
+    REFERENCES public.product_variants(id) ON DELETE CASCADE;
+ALTER TABLE public.cart_items ADD COLUMN IF NOT EXISTS modifier_ids UUID[] NOT NULL DEFAULT '{}';
+
+-- Объединение дублей, накопленных до появления уникального индекса
+UPDATE public.cart_items c
+SET quantity = d.total
+FROM (
+    SELECT MIN(id::text)::uuid AS keep_id, SUM(quantity) AS total
+    FROM public.cart_items
+    GROUP BY user_id, product_id, variant_id, modifier_ids
+    HAVING COUNT(*) > 1
+) d
+WHERE c.id = d.keep_id;
+
+DELETE FROM public.cart_items c
+USING public.cart_items k
+WHERE c.user_id = k.user_id
+  AND c.product_id = k.product_id
+  AND c.variant_id IS NOT DISTINCT FROM k.variant_id
+  AND c.modifier_ids = k.modifier_ids
+  AND c.id::text > k.id::text;
+
+DROP INDEX IF EXISTS public.idx_cart_items_user_product;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cart_items_user_options ON public.cart_items
+    (user_id, product_id, COALESCE(variant_id, '00000000-0000-0000-0000-000000000000'::uuid), modifier_ids);
+
+-- Складской учёт: NULL в stock означает, что остаток не ведётся; вариант без своего остатка
+-- списывается с остатка товара
+ALTER TABLE public.products ADD COLUMN IF NOT EXISTS stock INTEGER CHECK (stock >= 0);
+ALTER TABLE public.products ADD COLUMN IF NOT EXISTS low_stock_threshold INTEGER NOT NULL DEFAULT 5
+    CHECK (low_stock_threshold >= 0);
+ALTER TABLE public.product_variants ADD COLUMN IF NOT EXISTS stock INTEGER CHECK (stock >= 0);
+ALTER TABLE public.order_items ADD COLUMN IF NOT EXISTS variant_id UUID
+    REFERENCES public.product_variants(id) ON DELETE SET NULL;
+
+-- Таблица: stock_movements (журнал движения остатков: заказы, отмены, ручные корректировки)
+CREATE TABLE IF NOT EXISTS public.stock_movements (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    product_id UUID NOT NULL,
+    variant_id UUID,
+    delta INTEGER NOT NULL,
+    balance INTEGER NOT NULL,
+    reason VARCHAR(30) NOT NULL,
+    note TEXT,
+    order_id UUID,
+    user_id UUID,
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT stock_movements_product_id_fkey FOREIGN KEY (product_id) 
+        REFERENCES public.products(id) ON DELETE CASCADE,
+    CONSTRAINT stock_movements_variant_id_fkey FOREIGN KEY (variant_id) 
+        REFERENCES public.product_variants(id) ON DELETE CASCADE,
+    CONSTRAINT stock_movements_order_id_fkey FOREIGN KEY (order_id) 
+        REFERENCES public.orders(id) ON DELETE SET NULL,
+    CONSTRAINT stock_movements_user_id_fkey FOREIGN KEY (user_id) 
+        REFERENCES public.users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_stock_movements_product ON public.stock_movements(product_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_stock_movements_order ON public.stock_movements(order_id) WHERE order_id IS NOT NULL;